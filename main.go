@@ -12,6 +12,7 @@ import (
 	"github.com/thomastay/expression_language/pkg/bytecode"
 	"github.com/thomastay/expression_language/pkg/compiler"
 	"github.com/thomastay/expression_language/pkg/parser"
+	"github.com/thomastay/expression_language/pkg/stdlib"
 	"github.com/thomastay/expression_language/pkg/vm"
 
 	"github.com/k0kubun/pp/v3"
@@ -29,7 +30,7 @@ func init() {
 func main() {
 	shouldSeed := flag.Bool("seed", true, "Seed the VM")
 	flag.Parse()
-	m := vm.New(vm.Params{Debug: true})
+	m := vm.New(vm.Params{Debug: true, StdlibVersion: stdlib.Latest})
 	var env vm.VMEnv
 	if *shouldSeed {
 		env = seedEnv
@@ -106,17 +107,16 @@ func runOnString(s string, m vm.VMState, env vm.VMEnv) (bytecode.BVal, error) {
 //export runOnString
 func wasmRunOnString(s string) (vm.Result, error) {
 	// For wasm only! Don't use internally
-	m := vm.New(vm.Params{})
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
 	return m.EvalString(s, seedEnv)
 }
 
 // seed the VM with some useful variables
 var fooObjVal = map[string]bytecode.BVal{
 	"bar": bytecode.BInt(10),
-	"baz": vm.WrapFn("baz", func(x bytecode.BVal) bytecode.BVal {
+	"baz": vm.WrapFn("baz", func(x float64) float64 {
 		log.Println(x)
-		xx := x.(bytecode.BInt)
-		return bytecode.BFloat(float64(xx) * 43.4)
+		return x * 43.4
 	}),
 }
 var seedEnv = vm.VMEnv{
@@ -135,13 +135,9 @@ var seedEnv = vm.VMEnv{
 		log.Println(x)
 		return bytecode.BNull{}
 	}),
-	"ba": vm.WrapFn("ba", func(x bytecode.BVal) (bytecode.BVal, error) {
+	"ba": vm.WrapFn("ba", func(x int64) float64 {
 		log.Println(x)
-		xx, ok := x.(bytecode.BInt)
-		if !ok {
-			return nil, fmt.Errorf("Was not passed in a integer")
-		}
-		return bytecode.BFloat(float64(xx) * 43.4), nil
+		return float64(x) * 43.4
 	}),
 	"vv": vm.WrapFn("vv", func(x bytecode.BVal) {
 		log.Println(x)
@@ -37,6 +37,9 @@ import (
 type Expr interface {
 	isExpr()
 	String() string
+	// The part of the source that the node was parsed from. Nodes created by the compiler, e.g. by folding
+	// constants, have the span of the nodes they replaced
+	Span() Span
 }
 
 // The number of nodes generated by the parser. Note that the compiler also has some more node types
@@ -51,6 +54,9 @@ func (x *ECond) isExpr()        {}
 func (x *ECall) isExpr()        {}
 func (x *EArray) isExpr()       {}
 
+// Only generated when the expression has syntax errors, so it isn't counted in NumASTNodeTypes
+func (x *EBad) isExpr() {}
+
 var NumASTTotalNodeTypes = NumASTNodeTypes + 5
 
 func (x *EInt) isExpr()   {}
@@ -74,6 +80,7 @@ func (x *EBool) isExpr()  {}
 //	case *ECond:
 //	case *ECall:
 //	case *EArray:
+//	case *EBad:
 //	default:
 //		panic("AST type is not impl")
 //	}
@@ -93,6 +100,8 @@ type EUnOp struct {
 type EIdxAccess struct {
 	Base  Expr
 	Index Expr
+	// The closing ]
+	Close *lexer.Token
 }
 type EFieldAccess struct {
 	Base  Expr
@@ -107,15 +116,45 @@ type ECall struct {
 	Base   Expr         // ( @@ "." )?`
 	Method *lexer.Token // @Ident`
 	Exprs  ExprList     // ( @@ )?`
+	// The closing )
+	Close *lexer.Token
 }
 type ExprList []Expr
-type EArray []Expr // "[" ( @@ ( "," @@ )* )? "]"`
+type EArray struct {
+	Exprs ExprList // "[" ( @@ ( "," @@ )* )? "]"`
+	// The opening [ and closing ]
+	Open  *lexer.Token
+	Close *lexer.Token
+}
+
+// A placeholder for the part of the expression from Start to End that couldn't be parsed.
+// The parser reports a syntax error for each one.
+type EBad struct {
+	Start *lexer.Token
+	End   *lexer.Token
+}
 
-type EInt int64
-type EFloat float64
-type EStr string
-type EIdent string
-type EBool bool
+// Values, which replace EValue after the compiler parses them
+type EInt struct {
+	Val        int64
+	Start, End *lexer.Token
+}
+type EFloat struct {
+	Val        float64
+	Start, End *lexer.Token
+}
+type EStr struct {
+	Val        string
+	Start, End *lexer.Token
+}
+type EIdent struct {
+	Val        string
+	Start, End *lexer.Token
+}
+type EBool struct {
+	Val        bool
+	Start, End *lexer.Token
+}
 
 func (x *EValue) String() string {
 	return x.Val.String()
@@ -165,26 +204,26 @@ func (x *EArray) String() string {
 	if x == nil {
 		return ""
 	}
-	exprs := make([]string, len(*x))
-	for i, val := range *x {
-		exprs[i] = val.String()
-	}
-	return fmt.Sprintf("[%s]", strings.Join(exprs, ", "))
+	return fmt.Sprintf("[%s]", x.Exprs)
+}
+
+func (x *EBad) String() string {
+	return "<bad expression>"
 }
 
 func (x *EInt) String() string {
-	return strconv.FormatInt(int64(*x), 10)
+	return strconv.FormatInt(x.Val, 10)
 }
 func (x *EFloat) String() string {
-	return strconv.FormatFloat(float64(*x), 'e', 3, 64)
+	return strconv.FormatFloat(x.Val, 'e', 3, 64)
 
 }
 func (x *EStr) String() string {
-	return string(*x)
+	return x.Val
 }
 func (x *EIdent) String() string {
-	return string(*x)
+	return x.Val
 }
 func (x *EBool) String() string {
-	return strconv.FormatBool(bool(*x))
+	return strconv.FormatBool(x.Val)
 }
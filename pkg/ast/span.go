@@ -0,0 +1,149 @@
+package ast
+
+import (
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// The part of the source from the first character of Start to the last character of End.
+// Start and End are nil if the span is unknown, e.g. for nodes that weren't created by the parser.
+type Span struct {
+	Start *lexer.Token
+	End   *lexer.Token
+}
+
+func (s Span) IsValid() bool {
+	return s.Start != nil && s.End != nil
+}
+
+// Renders the line of source that the span starts on, with the span underlined, the same way that the parser
+// reports errors:
+//
+//	| a + 'x'
+//	| ^^^^^^^---
+//
+// Returns an empty string if the span isn't valid.
+func (s Span) Underline(source string) string {
+	if !s.IsValid() {
+		return ""
+	}
+	lines := strings.Split(source, "\n")
+	lineNum := s.Start.Pos.Line
+	if lineNum < 1 || lineNum > len(lines) {
+		return ""
+	}
+	line := lines[lineNum-1]
+	start := s.Start.Pos.Column - 1
+	if start < 0 || start > len(line) {
+		return ""
+	}
+	// Only underline up to the end of the first line
+	width := len(line) - start
+	if s.End.Pos.Line == lineNum {
+		width = s.End.Pos.Column - 1 + len(s.End.Value) - start
+	}
+	if width < 1 {
+		width = 1
+	}
+	return " | " + line + "\n | " + strings.Repeat(" ", start) + strings.Repeat("^", width) + "---\n"
+}
+
+// The smallest span that covers both a and b, or whichever of them is valid.
+// Passes like constant folding can reorder children, so a doesn't have to come before b
+func spanBetween(a, b Span) Span {
+	if !a.IsValid() {
+		return b
+	}
+	if !b.IsValid() {
+		return a
+	}
+	result := a
+	if b.Start.Pos.Offset < result.Start.Pos.Offset {
+		result.Start = b.Start
+	}
+	if b.End.Pos.Offset > result.End.Pos.Offset {
+		result.End = b.End
+	}
+	return result
+}
+
+func tokenSpan(tok *lexer.Token) Span {
+	return Span{Start: tok, End: tok}
+}
+
+func spanOf(expr Expr) Span {
+	if expr == nil {
+		return Span{}
+	}
+	return expr.Span()
+}
+
+func (x *EValue) Span() Span {
+	return tokenSpan(x.Val)
+}
+
+func (x *EBinOp) Span() Span {
+	return spanBetween(spanOf(x.Left), spanOf(x.Right))
+}
+
+func (x *EUnOp) Span() Span {
+	return spanBetween(tokenSpan(x.Op), spanOf(x.Val))
+}
+
+func (x *EIdxAccess) Span() Span {
+	if x.Close == nil {
+		return spanBetween(spanOf(x.Base), spanOf(x.Index))
+	}
+	return spanBetween(spanOf(x.Base), tokenSpan(x.Close))
+}
+
+func (x *EFieldAccess) Span() Span {
+	return spanBetween(spanOf(x.Base), tokenSpan(x.Field))
+}
+
+func (x *ECond) Span() Span {
+	return spanBetween(spanOf(x.Cond), spanOf(x.Second))
+}
+
+func (x *ECall) Span() Span {
+	start := tokenSpan(x.Method)
+	if x.Base != nil {
+		start = x.Base.Span()
+	}
+	if x.Close != nil {
+		return spanBetween(start, tokenSpan(x.Close))
+	}
+	if len(x.Exprs) > 0 {
+		return spanBetween(start, spanOf(x.Exprs[len(x.Exprs)-1]))
+	}
+	return start
+}
+
+func (x *EArray) Span() Span {
+	return Span{Start: x.Open, End: x.Close}
+}
+
+func (x *EBad) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
+
+func (x *EInt) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
+
+func (x *EFloat) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
+
+func (x *EStr) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
+
+func (x *EIdent) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
+
+func (x *EBool) Span() Span {
+	return Span{Start: x.Start, End: x.End}
+}
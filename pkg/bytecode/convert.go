@@ -0,0 +1,540 @@
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conversion between Go values and BVals, so that hosts don't have to build up a VMEnv by hand.
+//
+//	Go                           BVal
+//	bool                         BBool
+//	int*, uint*                  BInt (uints larger than MaxInt64 are an error)
+//	float*                       BFloat
+//	string, []byte               BStr
+//	json.Number                  BInt if it's an integer that fits, else BFloat
+//	time.Time                    BStr in RFC 3339 format. ToGo also accepts a BInt of seconds since the Unix epoch
+//	slices and arrays            BArray
+//	maps with string keys        BObj
+//	structs                      BObj, see below
+//	pointers and interfaces      whatever they point to, or BNull if nil
+//	BVals (including BFunc)      themselves, including host values that embed HostValue
+//
+// Only exported struct fields are converted. The `expr` struct tag controls the key the field is stored under,
+// just like the `json` tag in encoding/json:
+//
+//	Radius int    `expr:"radius"`            // stored as "radius"
+//	Notes  string `expr:"notes,omitempty"`   // left out if it's the zero value
+//	Secret string `expr:"-"`                 // never converted
+//
+// Fields of embedded structs are flattened into the outer object, unless the outer struct has a field of the same name.
+
+// Returned by FromGo and ToGo when a value can't be converted.
+type ConversionError struct {
+	// Where the error happened in the value being converted, e.g. "user.tags[1]". Empty for the top level.
+	Path string
+	// The type being converted from and to
+	From string
+	To   string
+	// Optional extra detail, e.g. "value out of range"
+	Reason string
+}
+
+func (e *ConversionError) Error() string {
+	s := fmt.Sprintf("TypeError: cannot convert %s to %s", e.From, e.To)
+	if e.Path != "" {
+		s += " at " + e.Path
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// Values nested deeper than this are rejected, which also stops us looping forever on cyclic pointers
+const maxConvertDepth = 1000
+
+var timeType = reflect.TypeOf(time.Time{})
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+var bValType = reflect.TypeOf((*BVal)(nil)).Elem()
+
+// Converts a Go value into a BVal. See the table above for how each type is converted.
+func FromGo(x any) (BVal, error) {
+	if x == nil {
+		return BNull{}, nil
+	}
+	return fromGo(reflect.ValueOf(x), "", 0)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func fromGo(v reflect.Value, path string, depth int) (BVal, error) {
+	if depth > maxConvertDepth {
+		return nil, &ConversionError{Path: path, From: v.Type().String(), To: "a value", Reason: "too deeply nested, is there a cycle?"}
+	}
+	// Includes host values, see HostValue
+	if v.Type().Implements(bValType) && v.Kind() != reflect.Interface && !(v.Kind() == reflect.Pointer && v.IsNil()) {
+		return v.Interface().(BVal), nil
+	}
+	switch v.Type() {
+	case timeType:
+		return BStr(v.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	case jsonNumberType:
+		n := v.Interface().(json.Number)
+		if i, err := n.Int64(); err == nil {
+			return BInt(i), nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, &ConversionError{Path: path, From: "json.Number", To: "float", Reason: err.Error()}
+		}
+		return BFloat(f), nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return BNull{}, nil
+		}
+		return fromGo(v.Elem(), path, depth+1)
+	case reflect.Bool:
+		return BBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return BInt(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return nil, &ConversionError{Path: path, From: v.Type().String(), To: "int", Reason: "value out of range"}
+		}
+		return BInt(u), nil
+	case reflect.Float32, reflect.Float64:
+		return BFloat(v.Float()), nil
+	case reflect.String:
+		return BStr(v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return BNull{}, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return BStr(bytesOf(v)), nil
+		}
+		arr := make(BArray, v.Len())
+		for i := range arr {
+			x, err := fromGo(v.Index(i), fmt.Sprintf("%s[%d]", path, i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = x
+		}
+		return arr, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return BNull{}, nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, &ConversionError{Path: path, From: v.Type().String(), To: "object", Reason: "map keys must be strings"}
+		}
+		obj := make(BObj, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key().String()
+			x, err := fromGo(iter.Value(), joinPath(path, k), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj[k] = x
+		}
+		return obj, nil
+	case reflect.Struct:
+		obj := make(BObj)
+		for _, f := range structFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok {
+				// Promoted through a nil embedded pointer, so the field doesn't exist, like in encoding/json
+				continue
+			}
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			x, err := fromGo(fv, joinPath(path, f.name), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			obj[f.name] = x
+		}
+		return obj, nil
+	default:
+		return nil, &ConversionError{Path: path, From: v.Type().String(), To: "a value", Reason: "unsupported type"}
+	}
+}
+
+func bytesOf(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+// Converts a BVal into the Go value that target points to, which must be a non nil pointer.
+// See the table above for how each type is converted. Conversions are strict: ints can be stored in floats
+// if they fit exactly, but floats can't be stored in ints, and nothing is converted to or from strings except time.Time.
+// Object keys without a matching struct field are ignored, and struct fields without a matching key are left alone.
+func ToGo(val BVal, target any) error {
+	if val == nil {
+		val = BNull{}
+	}
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return &ConversionError{From: val.Typename(), To: fmt.Sprintf("%T", target), Reason: "target must be a non nil pointer"}
+	}
+	return toGo(val, v.Elem(), "", 0)
+}
+
+func toGo(val BVal, dst reflect.Value, path string, depth int) error {
+	if val == nil {
+		val = BNull{}
+	}
+	if depth > maxConvertDepth {
+		return &ConversionError{Path: path, From: val.Typename(), To: dst.Type().String(), Reason: "too deeply nested"}
+	}
+	mismatch := func() error {
+		return &ConversionError{Path: path, From: val.Typename(), To: dst.Type().String()}
+	}
+	// e.g. a field of type BVal, or BObj
+	if reflect.TypeOf(val).AssignableTo(dst.Type()) && dst.Type() != reflect.TypeOf((*any)(nil)).Elem() {
+		dst.Set(reflect.ValueOf(val))
+		return nil
+	}
+	switch dst.Type() {
+	case timeType:
+		switch v := val.(type) {
+		case BStr:
+			t, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return &ConversionError{Path: path, From: "string", To: "time.Time", Reason: err.Error()}
+			}
+			dst.Set(reflect.ValueOf(t))
+		case BInt:
+			dst.Set(reflect.ValueOf(time.Unix(int64(v), 0).UTC()))
+		default:
+			return mismatch()
+		}
+		return nil
+	case jsonNumberType:
+		switch v := val.(type) {
+		case BInt:
+			dst.SetString(strconv.FormatInt(int64(v), 10))
+		case BFloat:
+			dst.SetString(strconv.FormatFloat(float64(v), 'g', -1, 64))
+		default:
+			return mismatch()
+		}
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if _, ok := val.(BNull); ok {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return toGo(val, dst.Elem(), path, depth+1)
+	case reflect.Interface:
+		if dst.NumMethod() > 0 {
+			return mismatch()
+		}
+		x, err := toNativeGo(val, path)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+		} else {
+			dst.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case reflect.Bool:
+		b, ok := val.(BBool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := val.(BInt)
+		if !ok {
+			return mismatch()
+		}
+		if dst.OverflowInt(int64(i)) {
+			return &ConversionError{Path: path, From: "int", To: dst.Type().String(), Reason: fmt.Sprintf("%d is out of range", i)}
+		}
+		dst.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := val.(BInt)
+		if !ok {
+			return mismatch()
+		}
+		if i < 0 || dst.OverflowUint(uint64(i)) {
+			return &ConversionError{Path: path, From: "int", To: dst.Type().String(), Reason: fmt.Sprintf("%d is out of range", i)}
+		}
+		dst.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v := val.(type) {
+		case BInt:
+			if !intFitsFloat(int64(v), dst.Kind()) {
+				return &ConversionError{Path: path, From: "int", To: dst.Type().String(), Reason: fmt.Sprintf("%d cannot be represented exactly", v)}
+			}
+			f = float64(v)
+		case BFloat:
+			f = float64(v)
+		default:
+			return mismatch()
+		}
+		if dst.OverflowFloat(f) {
+			return &ConversionError{Path: path, From: val.Typename(), To: dst.Type().String(), Reason: fmt.Sprintf("%g is out of range", f)}
+		}
+		dst.SetFloat(f)
+	case reflect.String:
+		s, ok := val.(BStr)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetString(string(s))
+	case reflect.Slice:
+		switch v := val.(type) {
+		case BNull:
+			dst.Set(reflect.Zero(dst.Type()))
+		case BStr:
+			if dst.Type().Elem().Kind() != reflect.Uint8 {
+				return mismatch()
+			}
+			dst.SetBytes([]byte(v))
+		case BArray:
+			slice := reflect.MakeSlice(dst.Type(), len(v), len(v))
+			for i, x := range v {
+				if err := toGo(x, slice.Index(i), fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+					return err
+				}
+			}
+			dst.Set(slice)
+		default:
+			return mismatch()
+		}
+	case reflect.Array:
+		arr, ok := val.(BArray)
+		if !ok {
+			return mismatch()
+		}
+		if len(arr) != dst.Len() {
+			return &ConversionError{Path: path, From: "array", To: dst.Type().String(), Reason: fmt.Sprintf("expected %d elements, got %d", dst.Len(), len(arr))}
+		}
+		for i, x := range arr {
+			if err := toGo(x, dst.Index(i), fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		switch v := val.(type) {
+		case BNull:
+			dst.Set(reflect.Zero(dst.Type()))
+		case BObj:
+			if dst.Type().Key().Kind() != reflect.String {
+				return &ConversionError{Path: path, From: "object", To: dst.Type().String(), Reason: "map keys must be strings"}
+			}
+			m := reflect.MakeMapWithSize(dst.Type(), len(v))
+			for k, x := range v {
+				elem := reflect.New(dst.Type().Elem()).Elem()
+				if err := toGo(x, elem, joinPath(path, k), depth+1); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), elem)
+			}
+			dst.Set(m)
+		default:
+			return mismatch()
+		}
+	case reflect.Struct:
+		obj, ok := val.(BObj)
+		if !ok {
+			return mismatch()
+		}
+		for _, f := range structFields(dst.Type()) {
+			x, ok := obj[f.name]
+			if !ok {
+				continue
+			}
+			fieldPath := joinPath(path, f.name)
+			fv, ok := fieldByIndexAlloc(dst, f.index)
+			if !ok {
+				return &ConversionError{Path: fieldPath, From: x.Typename(), To: dst.Type().String(), Reason: "cannot set a field of a nil embedded pointer to an unexported struct"}
+			}
+			if err := toGo(x, fv, fieldPath, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return &ConversionError{Path: path, From: val.Typename(), To: dst.Type().String(), Reason: "unsupported type"}
+	}
+	return nil
+}
+
+// Whether i can be stored in a float of the given kind without losing precision
+func intFitsFloat(i int64, kind reflect.Kind) bool {
+	maxExact := int64(1) << 53 // the mantissa of a float64
+	if kind == reflect.Float32 {
+		maxExact = 1 << 24
+	}
+	return -maxExact <= i && i <= maxExact
+}
+
+// Converts a BVal into the Go type you'd naturally expect, for storing into an `any`
+func toNativeGo(val BVal, path string) (any, error) {
+	switch v := val.(type) {
+	case BNull:
+		return nil, nil
+	case BBool:
+		return bool(v), nil
+	case BInt:
+		return int64(v), nil
+	case BFloat:
+		return float64(v), nil
+	case BStr:
+		return string(v), nil
+	case BArray:
+		result := make([]any, len(v))
+		for i, x := range v {
+			nx, err := toNativeGo(x, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			result[i] = nx
+		}
+		return result, nil
+	case BObj:
+		result := make(map[string]any, len(v))
+		for k, x := range v {
+			nx, err := toNativeGo(x, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			result[k] = nx
+		}
+		return result, nil
+	default:
+		// e.g. functions, which have no natural Go type. Keep them as they are
+		return val, nil
+	}
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// Returns the fields of a struct that should be converted, following the rules of the `expr` tag
+func structFields(t reflect.Type) []structField {
+	return structFieldsVisited(t, map[reflect.Type]bool{t: true})
+}
+
+// Like structFields, skipping embedded structs that are in visited, so that types that embed themselves end
+func structFieldsVisited(t reflect.Type, visited map[reflect.Type]bool) []structField {
+	var fields []structField
+	seen := make(map[string]bool)
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("expr")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, f)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		seen[name] = true
+		fields = append(fields, structField{
+			name:      name,
+			index:     f.Index,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	// Outer fields win over fields of embedded structs
+	for _, e := range embedded {
+		ft := e.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if visited[ft] {
+			continue
+		}
+		visited[ft] = true
+		for _, inner := range structFieldsVisited(ft, visited) {
+			if seen[inner.name] {
+				continue
+			}
+			seen[inner.name] = true
+			inner.index = append(append([]int{}, e.Index...), inner.index...)
+			fields = append(fields, inner)
+		}
+	}
+	return fields
+}
+
+// Like reflect.Value.FieldByIndex, but returns false instead of panicking if an embedded struct pointer is nil
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Like reflect.Value.FieldByIndex, but allocates nil embedded struct pointers along the way.
+// Returns false if one of them can't be set, because its type is unexported.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
@@ -0,0 +1,247 @@
+package bytecode_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+type Address struct {
+	City string `expr:"city"`
+	Zip  string `expr:"zip,omitempty"`
+}
+
+type Base struct {
+	ID   int    `expr:"id"`
+	Name string `expr:"name"`
+}
+
+type User struct {
+	Base
+	Name     string         `expr:"name"`
+	Age      uint8          `expr:"age"`
+	Score    float64        `expr:"score"`
+	Tags     []string       `expr:"tags"`
+	Address  *Address       `expr:"address"`
+	Labels   map[string]int `expr:"labels,omitempty"`
+	Joined   time.Time      `expr:"joined"`
+	Balance  json.Number    `expr:"balance"`
+	Extra    any            `expr:"extra"`
+	Password string         `expr:"-"`
+	private  int
+}
+
+type Inner struct {
+	A int `expr:"a"`
+}
+
+type Outer struct {
+	*Inner
+	B int `expr:"b"`
+}
+
+type inner struct {
+	A int `expr:"a"`
+}
+
+type outerOfUnexported struct {
+	*inner
+	B int `expr:"b"`
+}
+
+// Embeds itself, so its fields can't be found by following every embedded struct
+type Recursive struct {
+	*Recursive
+	X int `expr:"x"`
+}
+
+var joined = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+var testUser = User{
+	Base:     Base{ID: 7, Name: "shadowed"},
+	Name:     "ada",
+	Age:      36,
+	Score:    9.5,
+	Tags:     []string{"admin", "ops"},
+	Address:  &Address{City: "London"},
+	Joined:   joined,
+	Balance:  "12",
+	Extra:    []any{int64(1), "two"},
+	Password: "hunter2",
+	private:  3,
+}
+
+var testUserBVal = BObj{
+	"id":      BInt(7),
+	"name":    BStr("ada"),
+	"age":     BInt(36),
+	"score":   BFloat(9.5),
+	"tags":    BArray{BStr("admin"), BStr("ops")},
+	"address": BObj{"city": BStr("London")},
+	"joined":  BStr("2021-03-04T05:06:07Z"),
+	"balance": BInt(12),
+	"extra":   BArray{BInt(1), BStr("two")},
+}
+
+func TestFromGo(t *testing.T) {
+	tests := []struct {
+		in       any
+		expected BVal
+	}{
+		{nil, BNull{}},
+		{true, BBool(true)},
+		{int8(-3), BInt(-3)},
+		{uint32(3), BInt(3)},
+		{float32(1.5), BFloat(1.5)},
+		{"s", BStr("s")},
+		{[]byte("bytes"), BStr("bytes")},
+		{json.Number("1.25"), BFloat(1.25)},
+		{[2]int{1, 2}, BArray{BInt(1), BInt(2)}},
+		{[]string(nil), BNull{}},
+		{map[string]bool{"a": true}, BObj{"a": BBool(true)}},
+		{(*Address)(nil), BNull{}},
+		{BStr("already a BVal"), BStr("already a BVal")},
+		{testUser, testUserBVal},
+		{&testUser, testUserBVal},
+		// Fields promoted through a nil pointer are left out
+		{Outer{B: 1}, BObj{"b": BInt(1)}},
+		{Outer{Inner: &Inner{A: 2}, B: 1}, BObj{"a": BInt(2), "b": BInt(1)}},
+		{outerOfUnexported{inner: &inner{A: 2}}, BObj{"a": BInt(2), "b": BInt(0)}},
+		{Recursive{Recursive: &Recursive{X: 2}, X: 1}, BObj{"x": BInt(1)}},
+	}
+	for _, test := range tests {
+		actual, err := FromGo(test.in)
+		if err != nil {
+			t.Errorf("FromGo(%#v): unexpected error %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("FromGo(%#v): expected %s, got %s", test.in, test.expected, actual)
+		}
+	}
+}
+
+func TestFromGoErrors(t *testing.T) {
+	type cyclic struct{ Next *cyclic }
+	cycle := &cyclic{}
+	cycle.Next = cycle
+
+	tests := []struct {
+		in     any
+		errMsg string
+	}{
+		{uint64(1 << 63), "cannot convert uint64 to int: value out of range"},
+		{map[int]string{}, "map keys must be strings"},
+		{make(chan int), "cannot convert chan int to a value: unsupported type"},
+		{map[string]any{"f": func() {}}, "at f: unsupported type"},
+		{[]any{1, complex(1, 2)}, "at [1]: unsupported type"},
+		{cycle, "too deeply nested"},
+	}
+	for _, test := range tests {
+		_, err := FromGo(test.in)
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Errorf("FromGo(%T): expected a ConversionError, got %v", test.in, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("FromGo(%T): expected error containing %q, got %q", test.in, test.errMsg, err)
+		}
+	}
+}
+
+func TestToGo(t *testing.T) {
+	var user User
+	if err := ToGo(testUserBVal, &user); err != nil {
+		t.Fatal(err)
+	}
+	expected := testUser
+	expected.Base.Name = ""
+	expected.Password = ""
+	expected.private = 0
+	if !reflect.DeepEqual(user, expected) {
+		t.Errorf("expected %+v, got %+v", expected, user)
+	}
+
+	// Round trips
+	bval, err := FromGo(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bval, testUserBVal) {
+		t.Errorf("expected %s, got %s", testUserBVal, bval)
+	}
+
+	var f float32
+	if err := ToGo(BInt(3), &f); err != nil || f != 3 {
+		t.Errorf("expected int to convert to float32, got %v, %v", f, err)
+	}
+	var tm time.Time
+	if err := ToGo(BInt(joined.Unix()), &tm); err != nil || !tm.Equal(joined) {
+		t.Errorf("expected unix seconds to convert to time, got %v, %v", tm, err)
+	}
+	var x any
+	if err := ToGo(BObj{"a": BArray{BInt(1), BNull{}}}, &x); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]any{"a": []any{int64(1), nil}}; !reflect.DeepEqual(x, expected) {
+		t.Errorf("expected %v, got %v", expected, x)
+	}
+	var v BVal
+	if err := ToGo(BStr("a"), &v); err != nil || v != BStr("a") {
+		t.Errorf("expected BVal to be stored as is, got %v, %v", v, err)
+	}
+
+	// Nil embedded pointers are allocated if they can be
+	var outer Outer
+	if err := ToGo(BObj{"a": BInt(2), "b": BInt(1)}, &outer); err != nil || outer.Inner == nil || outer.A != 2 || outer.B != 1 {
+		t.Errorf("expected the embedded struct to be allocated, got %+v, %v", outer, err)
+	}
+	unexported := outerOfUnexported{inner: &inner{}}
+	if err := ToGo(BObj{"a": BInt(2), "b": BInt(1)}, &unexported); err != nil || unexported.A != 2 || unexported.B != 1 {
+		t.Errorf("expected the fields of the embedded struct to be set, got %+v, %v", unexported, err)
+	}
+	var recursive Recursive
+	if err := ToGo(BObj{"x": BInt(1)}, &recursive); err != nil || recursive.X != 1 || recursive.Recursive != nil {
+		t.Errorf("expected only x to be set, got %+v, %v", recursive, err)
+	}
+}
+
+func TestToGoErrors(t *testing.T) {
+	tests := []struct {
+		in     BVal
+		target any
+		errMsg string
+	}{
+		{BStr("a"), &struct{}{}, "cannot convert string to struct {}"},
+		{BFloat(1.5), new(int), "cannot convert float to int"},
+		{BInt(300), new(uint8), "cannot convert int to uint8: 300 is out of range"},
+		{BInt(-1), new(uint), "-1 is out of range"},
+		{BInt(1<<53 + 1), new(float64), "9007199254740993 cannot be represented exactly"},
+		{BInt(1<<24 + 1), new(float32), "cannot be represented exactly"},
+		{BArray{BInt(1)}, new([2]int), "expected 2 elements, got 1"},
+		{BObj{"age": BStr("old")}, new(User), "cannot convert string to uint8 at age"},
+		{BObj{"tags": BArray{BStr("a"), BInt(1)}}, new(User), "cannot convert int to string at tags[1]"},
+		{BObj{"address": BObj{"city": BBool(true)}}, new(User), "at address.city"},
+		{BStr("yesterday"), new(time.Time), "cannot convert string to time.Time"},
+		{BObj{}, map[string]int{}, "target must be a non nil pointer"},
+		{BObj{}, (*User)(nil), "target must be a non nil pointer"},
+		{BObj{"a": BInt(1)}, new(outerOfUnexported), "at a: cannot set a field of a nil embedded pointer to an unexported struct"},
+	}
+	for _, test := range tests {
+		err := ToGo(test.in, test.target)
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Errorf("ToGo(%s, %T): expected a ConversionError, got %v", test.in, test.target, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("ToGo(%s, %T): expected error containing %q, got %q", test.in, test.target, test.errMsg, err)
+		}
+	}
+}
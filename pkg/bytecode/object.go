@@ -0,0 +1,73 @@
+package bytecode
+
+import "errors"
+
+// Embed HostValue in a Go type to make it a BVal, so that it can be passed to the VM as is.
+// The type still has to implement String and Typename, and can override IsTruthy, which is true by default.
+// See the interfaces below for how host values can overload operators.
+//
+//	type User struct {
+//		bytecode.HostValue
+//		db *sql.DB
+//		id int64
+//	}
+type HostValue struct{}
+
+func (HostValue) isBVal() {}
+
+func (HostValue) IsTruthy() bool {
+	return true
+}
+
+// Implemented by host values that have attributes, so that they can be used like a BObj without copying
+// them into a map first. obj.name calls GetAttr("name") when the expression is evaluated.
+type Object interface {
+	BVal
+	// Returns false if the object has no attribute called name, in which case the VM looks for a method instead.
+	// Errors stop the evaluation.
+	GetAttr(name string) (val BVal, ok bool, err error)
+}
+
+// Optionally implemented by Objects that have methods. obj.name(args) calls CallMethod("name", args) on obj
+// if GetAttr and the VM's method table don't have anything called name.
+type MethodCaller interface {
+	Object
+	// Returns false if the object has no method called name.
+	CallMethod(name string, args []BVal) (val BVal, ok bool, err error)
+}
+
+// Host values can optionally implement these interfaces to overload operators.
+// The runtime only calls them when the operator isn't defined for the builtin types, e.g. for money + money,
+// but never for 1 + 2. It first calls the hook on the left operand, then on the right operand with reversed set
+// to true, so money + 1 calls Add(1, false) on money, and 1 + money calls Add(1, true) on money.
+// Return ErrNotImplemented from a hook to let the other operand handle the operation. If neither can, the
+// operation fails with the usual TypeError.
+//
+// Truthiness is not a hook, since every BVal implements IsTruthy. HostValue makes host values truthy by default.
+var ErrNotImplemented = errors.New("operation not implemented")
+
+// Overloads a + b
+type Adder interface {
+	Add(other BVal, reversed bool) (BVal, error)
+}
+
+// Overloads a - b
+type Subtracter interface {
+	Sub(other BVal, reversed bool) (BVal, error)
+}
+
+// Overloads <, <=, > and >=. Cmp returns -1 if the receiver is less than other, 0 if they're equal, and 1 if
+// the receiver is greater. The runtime reverses the result itself if the receiver is the right operand.
+type Comparer interface {
+	Cmp(other BVal) (int, error)
+}
+
+// Overloads == and !=. Without it, host values are only equal to themselves
+type Equaler interface {
+	Eq(other BVal) bool
+}
+
+// Overloads a[i]
+type Indexer interface {
+	Index(i BVal) (BVal, error)
+}
@@ -1,6 +1,7 @@
 package bytecode
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"strconv"
@@ -56,6 +57,14 @@ type BFunc struct {
 	Fn      VMFunc
 	NumArgs int
 	Name    string // for debugging
+	// If true, NumArgs is the minimum number of args, and Fn may be passed more than that
+	Variadic bool
+	// Optional. The number of instructions a call to Fn costs, for functions whose running time depends on
+	// their input (e.g. sorting an array). This is counted towards the VM's MaxInstructions before Fn is called.
+	Cost func(args []BVal) int
+	// Optional. Like Fn, but also receives the context passed to the VM's EvalContext.
+	// If set, the VM calls this instead of Fn, so that slow functions can stop when the evaluation is canceled.
+	FnContext func(ctx context.Context, args []BVal) (BVal, error)
 }
 
 func (b BNull) String() string {
@@ -74,6 +83,9 @@ func (b BStr) String() string {
 	return "'" + string(b) + "'"
 }
 func (b BFunc) String() string {
+	if b.Variadic {
+		return fmt.Sprintf("Function %s taking in at least %d args", b.Name, b.NumArgs)
+	}
 	return fmt.Sprintf("Function %s taking in %d args", b.Name, b.NumArgs)
 }
 func (b BObj) String() string {
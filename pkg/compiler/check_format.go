@@ -0,0 +1,74 @@
+package compiler
+
+import (
+	. "github.com/thomastay/expression_language/pkg/ast"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/types"
+)
+
+// Returns a pass that reports errors in literal format strings at compile time, instead of waiting for them to
+// fail at runtime. This checks the format string of:
+//  1. The % operator with a string literal on the left, e.g. '%d items' % n
+//  1. Calls to the string method .format() with a string literal as the format, unless params.Methods overrides it
+//  1. Calls to format() with a string literal as the format, if params.Schema declares format as the stdlib's.
+//     Without a schema, format could be any function in the env, since the env shadows the stdlib
+func CheckFormatStrings(params Params) func(*Expr) walkError {
+	checkMethod := true
+	if _, ok := params.Methods["string"]["format"]; ok {
+		checkMethod = false
+	}
+	checkFunc := false
+	if t, ok := params.Schema["format"]; ok {
+		checkFunc = types.Identical(t, types.Of(stdlib.Format))
+	}
+	return func(ptrToExpr *Expr) walkError {
+		return checkFormatStrings(ptrToExpr, checkMethod, checkFunc)
+	}
+}
+
+func checkFormatStrings(ptrToExpr *Expr, checkMethod, checkFunc bool) walkError {
+	var errs []CompileError
+	switch node := (*ptrToExpr).(type) {
+	case *EBinOp:
+		format, ok := node.Left.(*EStr)
+		if !ok || node.Op.Value != "%" {
+			break
+		}
+		numArgs := -1 // unknown
+		switch right := node.Right.(type) {
+		case *EArray:
+			numArgs = len(right.Exprs)
+		case *EInt, *EFloat, *EStr, *EBool:
+			numArgs = 1
+		}
+		if err := runtime.CheckPercentFormat(format.Val, numArgs); err != nil {
+			errs = append(errs, newCompileError(err, CodeFormat, node.Span()))
+		}
+	case *ECall:
+		if node.Method.Value != "format" {
+			break
+		}
+		var format *EStr
+		var numArgs int
+		if node.Base == nil {
+			// format('...', args...)
+			if !checkFunc || len(node.Exprs) == 0 {
+				break
+			}
+			format, _ = node.Exprs[0].(*EStr)
+			numArgs = len(node.Exprs) - 1
+		} else if checkMethod {
+			// '...'.format(args...)
+			format, _ = node.Base.(*EStr)
+			numArgs = len(node.Exprs)
+		}
+		if format == nil {
+			break
+		}
+		if err := runtime.CheckBraceFormat(format.Val, numArgs); err != nil {
+			errs = append(errs, newCompileError(err, CodeFormat, node.Span()))
+		}
+	}
+	return errs
+}
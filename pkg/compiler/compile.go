@@ -3,36 +3,77 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"runtime/debug"
 
-	"github.com/alecthomas/participle/v2/lexer"
 	. "github.com/thomastay/expression_language/pkg/ast"
 	. "github.com/thomastay/expression_language/pkg/bytecode"
 	"github.com/thomastay/expression_language/pkg/parser"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/types"
 )
 
 // The main entry point for apps who want to cache the bytecode across several runs
 // If you don't, then just do vm.EvalString(s)
 func CompileString(s string) Compilation {
+	return CompileStringParams(s, Params{})
+}
+
+// Like CompileString, with the same params as Compile.
+// If s has syntax errors, the parts of it that could be parsed are still checked, so the Compilation has every
+// syntax, number, format string and type error at once. It has no bytecode though.
+func CompileStringParams(s string, params Params) (c Compilation) {
+	defer recoverInternalError(&c)
 	expr, err := parser.ParseString(s)
+	var syntaxErrs *parser.SyntaxErrors
+	if errors.As(err, &syntaxErrs) {
+		c = Compilation{Source: s}
+		for _, syntaxErr := range syntaxErrs.Errs {
+			c.Errors = append(c.Errors, CompileError{Err: syntaxErr, Start: syntaxErr.Token, End: syntaxErr.Token, Code: CodeSyntax})
+		}
+		if expr != nil {
+			// Check the rest of the expression too, so that all errors can be fixed at once
+			for _, compileErr := range Compile(expr, params).Errors {
+				if compileErr.Err != errSyntax {
+					c.Errors = append(c.Errors, compileErr)
+				}
+			}
+		}
+		return c
+	}
 	if err != nil {
 		return Compilation{
-			Errors: []CompileError{{Err: err}},
+			Errors: []CompileError{{Err: err, Code: CodeSyntax}},
+			Source: s,
 		}
 	}
-	return Compile(expr, Params{})
+	c = Compile(expr, params)
+	c.Source = s
+	return c
 }
 
 // Compiles the parse tree down to bytecode, represented by the Compilation object
 // Note that a compilation may have errors. Users are expected to check the Compilation.Errors
 // object to report them. Note that a Compilation may have errors but still be ok to interpret
 // because this package will attempt a best effort compile
-func Compile(expr Expr, params Params) Compilation {
+// Compile never panics. If it hits a bug, the Compilation has a single *runtime.InternalError instead.
+func Compile(expr Expr, params Params) (c Compilation) {
+	defer recoverInternalError(&c)
 	// This function merely orchestrates the steps, then compileToBytecode does the actual compiling
 	// Stage 1: Parsing of values and reporting overflow errors or simple errors
-	c := Compilation{}
+	// Every node is still valid after a failed parse, e.g. an out of range int is 0, and EBad is of any type,
+	// so the checks all run to report as many errors as possible
 	c.Errors = walk(&expr, ParseValue)
+	c.Errors = append(c.Errors, walk(&expr, CheckFormatStrings(params))...)
+	if params.Schema != nil || params.Expect != nil {
+		tc := newTypeChecker(params.Schema, params.Methods)
+		errs := tc.check(&expr)
+		if len(errs) == 0 && params.Expect != nil {
+			errs = tc.expect(expr, params.Expect)
+		}
+		c.Errors = append(c.Errors, errs...)
+	}
 	if len(c.Errors) > 0 {
 		return c
 	}
@@ -59,30 +100,50 @@ func Compile(expr Expr, params Params) Compilation {
 	return c
 }
 
+// Replaces the compilation with an InternalError if the compiler panicked. Must be deferred.
+func recoverInternalError(c *Compilation) {
+	if r := recover(); r != nil {
+		*c = Compilation{
+			Errors: []CompileError{{
+				Err:  &runtime.InternalError{Value: r, Stack: string(debug.Stack()), Pc: -1},
+				Code: CodeInternal,
+			}},
+		}
+	}
+}
+
 // This function does the actual compiling to bytecode
 func (c *Compilation) compileToBytecode(expr Expr) {
 	seen := newSeenConstants()
 	// ?: why doesn't this defer work?
 	// defer func() { c.Constants = seen.constants }()
 
+	// The span of the node being compiled, which its instructions are attributed to
+	var span Span
+	push := func(b Bytecode) {
+		c.Bytecode.Push(b)
+		c.Spans = append(c.Spans, span)
+	}
+
 	var compileRec func(Expr)
 	compileRec = func(expr Expr) {
 		if expr == nil {
 			panic("No nil expressions!")
 		}
+		defer func(outer Span) { span = outer }(span)
+		span = expr.Span()
 		switch node := expr.(type) {
 		case *EValue:
 			panic("No more EValues at this point")
 		case *EInt, *EFloat, *EStr, *EBool:
 			pos := getPosOfConstExpr(node, &seen)
-			c.Bytecode.Push(Bytecode{
+			push(Bytecode{
 				Inst: OpConst,
 				Val:  pos,
 			})
 		case *EIdent:
-			val := string(*node)
-			pos := seen.AddStr(val)
-			c.Bytecode.Push(Bytecode{
+			pos := seen.AddStr(node.Val)
+			push(Bytecode{
 				Inst: OpLoad,
 				Val:  pos,
 			})
@@ -94,7 +155,7 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 					// IMM not defined for all binary ops for now
 					if instImm, ok := simpleBinaryOpsImm[op]; ok {
 						pos := getPosOfConstExpr(node.Right, &seen)
-						c.Bytecode.Push(Bytecode{
+						push(Bytecode{
 							Inst: instImm,
 							Val:  pos,
 						})
@@ -102,7 +163,7 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 					} // else fallthrough
 				}
 				compileRec(node.Right)
-				c.Bytecode.Push(Bytecode{Inst: inst})
+				push(Bytecode{Inst: inst})
 			} else {
 				switch node.Op.Value {
 				case "and":
@@ -112,7 +173,7 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 					// | 2   |    Second Expr
 					// | 3   ---> ...
 					compileRec(node.Left)
-					c.Bytecode.Push(Bytecode{
+					push(Bytecode{
 						Inst: OpBrIfFalseOrPop,
 						// patch the val later on
 					})
@@ -126,7 +187,7 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 					// | 2   |    Second Expr
 					// | 3   ---> ...
 					compileRec(node.Left)
-					c.Bytecode.Push(Bytecode{
+					push(Bytecode{
 						Inst: OpBrIfOrPop,
 						// patch the val later on
 					})
@@ -134,15 +195,15 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 					compileRec(node.Right)
 					c.Bytecode.IntData[jumpIdx] = c.Bytecode.Len()
 				default:
-					log.Panicf("Not implemented %v", node)
+					panic(fmt.Sprintf("Not implemented %v", node))
 				}
 			}
 		case *EUnOp:
 			if inst, ok := unaryOps[node.Op.Value]; ok {
 				compileRec(node.Val)
-				c.Bytecode.Push(Bytecode{Inst: inst})
+				push(Bytecode{Inst: inst})
 			} else {
-				log.Panicf("Not implemented %v", node)
+				panic(fmt.Sprintf("Not implemented %v", node))
 			}
 		case *ECond:
 			// This places the condition val onto the stack.
@@ -156,14 +217,14 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 			// | 4   ---> Then clause
 			// | 5     --> ....
 			// Thus, we put the else clause first, and branch to the then clause if true
-			c.Bytecode.Push(Bytecode{
+			push(Bytecode{
 				Inst: OpBrIf,
 				// patch the val later on
 			})
 			firstJumpIdx := c.Bytecode.Len() - 1
 
 			compileRec(node.Second)
-			c.Bytecode.Push(Bytecode{
+			push(Bytecode{
 				Inst: OpBr,
 			})
 			secondJumpIdx := c.Bytecode.Len() - 1
@@ -190,22 +251,22 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 			if node.Base != nil {
 				compileRec(node.Base)
 				pos := seen.AddStr(val)
-				c.Bytecode.Push(Bytecode{
+				push(Bytecode{
 					Inst: OpConst,
 					Val:  pos,
 				})
-				c.Bytecode.Push(Bytecode{
+				push(Bytecode{
 					Inst: OpLoadAttr,
 				})
 			} else {
 				pos := seen.AddStr(val)
-				c.Bytecode.Push(Bytecode{
+				push(Bytecode{
 					Inst: OpLoad,
 					Val:  pos,
 				},
 				)
 			}
-			c.Bytecode.Push(
+			push(
 				Bytecode{
 					Inst: OpCall,
 					Val:  numParams,
@@ -216,25 +277,25 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 			compileRec(node.Base)
 			val := node.Field.Value
 			pos := seen.AddStr(val)
-			c.Bytecode.Push(
+			push(
 				Bytecode{
 					Inst: OpConst,
 					Val:  pos,
 				},
 			)
-			c.Bytecode.Push(
+			push(
 				Bytecode{Inst: OpLoadAttr},
 			)
 		// ------------------- Arrays ------------------------------
 		case *EArray:
 			// For simplicity, we're just going to dump them all on the stack in reverse order and evaluate them for now
 			// Future optimization may make it such that integers are not dumped on stack
-			n := len(*node)
+			n := len(node.Exprs)
 			for i := n - 1; i >= 0; i-- {
-				expr := (*node)[i]
+				expr := node.Exprs[i]
 				compileRec(expr)
 			}
-			c.Bytecode.Push(
+			push(
 				Bytecode{
 					Inst: OpNewArray,
 					Val:  n,
@@ -243,9 +304,9 @@ func (c *Compilation) compileToBytecode(expr Expr) {
 		case *EIdxAccess:
 			compileRec(node.Base)
 			compileRec(node.Index)
-			c.Bytecode.Push(Bytecode{Inst: OpLoadSubscript})
+			push(Bytecode{Inst: OpLoadSubscript})
 		default:
-			log.Panicf("Not implemented %v", node)
+			panic(fmt.Sprintf("Not implemented %v", node))
 		}
 	}
 	compileRec(expr)
@@ -297,21 +358,16 @@ func getPosOfConstExpr(expr Expr, seen *seenConstants) int {
 	case *EValue:
 		panic("No more EValues at this point")
 	case *EInt:
-		val := int64(*node)
-		pos = seen.AddInt(val)
+		pos = seen.AddInt(node.Val)
 	case *EFloat:
-		val := float64(*node)
-		pos = seen.AddFloat(val)
+		pos = seen.AddFloat(node.Val)
 	case *EStr:
-		val := string(*node)
-		pos = seen.AddStr(val)
+		pos = seen.AddStr(node.Val)
 	case *EIdent:
-		val := string(*node)
-		pos = seen.AddStr(val)
+		pos = seen.AddStr(node.Val)
 	case *EBool:
-		val := bool(*node)
 		pos = falseConstPos
-		if val {
+		if node.Val {
 			pos = trueConstPos
 		}
 	default:
@@ -325,6 +381,12 @@ type Compilation struct {
 	Bytecode  ByteCodes
 	Constants []BVal
 	Errors    []CompileError
+	// Spans[pc] is the part of Source that instruction pc was compiled from, used to point at the source of
+	// runtime errors. Spans can be invalid, see Span.IsValid
+	Spans []Span
+	// The expression that was compiled. Only set by CompileString, set it yourself when calling Compile
+	// directly to get the source in runtime errors
+	Source string
 }
 
 // Helper class to aid in constructing the constant table
@@ -388,20 +450,14 @@ func (seen *seenConstants) AddStr(x string) int {
 	return pos
 }
 
-type CompileError struct {
-	Err   error
-	Start *lexer.Token
-	End   *lexer.Token
-}
-
-func (c CompileError) Error() string {
-	return c.Err.Error()
-}
-
-func (c CompileError) IsErr() bool {
-	return c.Err != nil
-}
-
 type Params struct {
 	Debug bool
+	// If set, the expression is type checked against the schema, and identifiers that aren't in it are errors
+	Schema Schema
+	// If set, the expression is type checked, and its result must be of this type. See CompileExpecting
+	Expect types.Type
+	// The methods that the host registered on the VM, keyed by typename and then name, like vm.MethodTable.
+	// They override the builtin methods, so the compiler makes no assumptions about them, and the type checker
+	// allows calling them on objects
+	Methods map[string]map[string]BFunc
 }
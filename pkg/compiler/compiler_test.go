@@ -0,0 +1,365 @@
+package compiler_test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/compiler"
+	"github.com/thomastay/expression_language/pkg/parser"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/types"
+)
+
+func TestCompileReportsAllErrors(t *testing.T) {
+	// The rest of an expression is still compiled when part of it has a syntax error
+	compilation := compiler.CompileString("f(1 +, 99999999999999999999)")
+	if len(compilation.Errors) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", compilation.Errors)
+	}
+	var syntaxErr *parser.SyntaxError
+	if !errors.As(compilation.Errors[0].Err, &syntaxErr) || compilation.Errors[0].Start.Pos.Column != 6 {
+		t.Errorf("Expected a syntax error at column 6, got %v", compilation.Errors[0])
+	}
+	if !errors.Is(compilation.Errors[1].Err, strconv.ErrRange) || compilation.Errors[1].Start.Pos.Column != 8 {
+		t.Errorf("Expected an out of range error at column 8, got %v", compilation.Errors[1])
+	}
+
+	// Format strings and types are checked too
+	schema := compiler.Schema{"a": types.Int}
+	compilation = compiler.CompileStringParams("[1 +, '%d %d' % 1, a - 'x']", compiler.Params{Schema: schema})
+	codes := make([]string, len(compilation.Errors))
+	for i, err := range compilation.Errors {
+		codes[i] = err.Code
+	}
+	if got, expected := strings.Join(codes, " "), "E0001 E0005 E0003"; got != expected {
+		t.Errorf("Expected errors %v, got %v", expected, compilation.Errors)
+	}
+}
+
+func TestFormatStringCompileErrors(t *testing.T) {
+	// format() is only known to be the stdlib's if the schema says so
+	schema := compiler.Schema{"a": types.Any, "b": types.Any}.WithBuiltins(stdlib.Latest)
+	tests := []string{
+		"'%d %d' % [a]",
+		"'%d' % [a, b]",
+		"'%q' % a",
+		"'%' % a",
+		"'%d' % 'a'",
+		"format('{} {}', a)",
+		"format('{', a)",
+		"format('{0} {}', a, b)",
+		"'{:z}'.format(a)",
+		"'{:.}'.format(a)",
+		"'%99999d' % a",
+	}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			compilation := compiler.CompileStringParams(tt, compiler.Params{Schema: schema})
+			if len(compilation.Errors) == 0 {
+				t.Fatal("Expected a compile error, got none")
+			}
+		})
+	}
+	hostFormat := bytecode.BFunc{Name: "format", NumArgs: 1, Variadic: true, Fn: func(args []bytecode.BVal) (bytecode.BVal, error) {
+		return args[0], nil
+	}}
+	okTests := []struct {
+		in     string
+		params compiler.Params
+	}{
+		// Formats that aren't literals can only be checked at runtime
+		{"fizz % a", compiler.Params{}},
+		// format could be anything in the env
+		{"format('{', a)", compiler.Params{}},
+		{"format('{', a)", compiler.Params{Schema: compiler.Schema{
+			"a":      types.Any,
+			"format": types.Func(types.String, types.String, types.Any),
+		}.WithBuiltins(stdlib.Latest)}},
+		// The host overrides the method
+		{"'{'.format(a)", compiler.Params{Methods: map[string]map[string]bytecode.BFunc{
+			"string": {"format": hostFormat},
+		}}},
+	}
+	for _, tt := range okTests {
+		compilation := compiler.CompileStringParams(tt.in, tt.params)
+		if len(compilation.Errors) > 0 {
+			t.Errorf("%s: unexpected errors %v", tt.in, compilation.Errors)
+		}
+	}
+}
+
+func TestFormatDiagnostics(t *testing.T) {
+	src := "1 // 0 +\n  -'a'"
+	compilation := compiler.CompileString(src)
+	expected := `error[E0004]: ArithmeticError: Divided by zero in //
+ | 1 // 0 +
+ | ^^^^^^---
+
+error[E0003]: TypeError: bad operand type for unary -: string
+ |   -'a'
+ |   ^^^^---
+`
+	if got := compiler.FormatDiagnostics(src, compilation.Errors); got != expected {
+		t.Errorf("Expected diagnostics\n%s\ngot\n%s", expected, got)
+	}
+
+	// Every error has a span, even after ParseValue and ConstFold have replaced the nodes
+	for _, in := range []string{"99999999999999999999", "+'x'", "-[1]", "'%d %d' % 1", "'{} {}'.format(1)", "1 +"} {
+		compilation := compiler.CompileString(in)
+		if len(compilation.Errors) == 0 {
+			t.Fatalf("%s: expected an error", in)
+		}
+		for _, compileErr := range compilation.Errors {
+			if !compileErr.Span().IsValid() || compileErr.Code == "" {
+				t.Errorf("%s: expected a span and a code, got %#v", in, compileErr)
+			}
+		}
+	}
+}
+
+func TestTypeCheck(t *testing.T) {
+	schema := compiler.Schema{
+		"radius": types.Int,
+		"scale":  types.Float,
+		"name":   types.String,
+		"tags":   types.Array{Elem: types.String},
+		"user":   types.Object{"name": types.String, "age": types.Int, "greet": types.Func(types.String, types.String)},
+		"area":   types.Func(types.Float, types.Float),
+		"concat": types.VariadicFunc(types.String, types.String),
+		"host":   types.Any,
+	}.WithBuiltins(stdlib.V1)
+	valid := []string{
+		"radius * 2 + scale",
+		"area(radius) > 10 and name == 'circle'",
+		"tags[0] + user.name",
+		"user.greet(name).upper()",
+		"concat() + concat('a', 'b', 'c')",
+		"'%s is %d' % [user.name, user.age]",
+		"radius > 1 ? 'big' : 'small'",
+		"len(tags) + host.anything(1, 2)",
+		"json.stringify(tags)",
+		"[1, 2] * radius + [3]",
+		"-true + +radius",
+		"name * true + (tags * (radius > 1))[0]",
+		"user.describe() + user.name",
+	}
+	describe := bytecode.BFunc{Name: "describe", NumArgs: 1, Fn: func(args []bytecode.BVal) (bytecode.BVal, error) {
+		return bytecode.BStr("an object"), nil
+	}}
+	methods := map[string]map[string]bytecode.BFunc{"object": {"describe": describe}}
+	for _, in := range valid {
+		compilation := compiler.CompileStringParams(in, compiler.Params{Schema: schema, Methods: methods})
+		if len(compilation.Errors) > 0 {
+			t.Errorf("%s: unexpected errors %v", in, compilation.Errors)
+		}
+	}
+
+	invalid := []struct {
+		in     string
+		errMsg string
+		code   string
+		// The part of the expression that the error points at
+		span string
+	}{
+		{"radius + name", "TypeError: unsupported operand type(s) for +: int and string", compiler.CodeType, "radius + name"},
+		{"1 + (tags < 3)", "TypeError: unsupported operand type(s) for <: array and int", compiler.CodeType, "tags < 3"},
+		{"-name", "TypeError: bad operand type for unary -: string", compiler.CodeType, "-name"},
+		{"radius + raduis", "NameError: name raduis is not defined", compiler.CodeName, "raduis"},
+		{"nope(1)", "NameError: name nope is not defined", compiler.CodeName, "nope"},
+		{"user.email", "AttributeError: object object has no attribute email", compiler.CodeAttribute, "user.email"},
+		{"area(1, 2)", "TypeError: function area passed wrong number of args, expected 1, got 2", compiler.CodeType, "area(1, 2)"},
+		{"user.greet()", "TypeError: function greet passed wrong number of args, expected 1, got 0", compiler.CodeType, "user.greet()"},
+		{"area(name)", "TypeError: area() argument 0 must be float, not string", compiler.CodeType, "name"},
+		{"concat('a', 1)", "TypeError: concat() argument 1 must be string, not int", compiler.CodeType, "1"},
+		{"tags['a']", "TypeError: array indices must be integers, not string", compiler.CodeType, "tags['a']"},
+		{"radius[0]", "TypeError: int object is not subscriptable", compiler.CodeType, "radius[0]"},
+		{"name(1)", "TypeError: string object is not callable", compiler.CodeType, "name(1)"},
+		{"user.describe(1)", "TypeError: function describe passed wrong number of args, expected 0, got 1", compiler.CodeType, "user.describe(1)"},
+		{"user.summary()", "AttributeError: object object has no attribute summary", compiler.CodeAttribute, "user.summary()"},
+	}
+	for _, tt := range invalid {
+		compilation := compiler.CompileStringParams(tt.in, compiler.Params{Schema: schema, Methods: methods})
+		if len(compilation.Errors) != 1 {
+			t.Errorf("%s: expected one error, got %v", tt.in, compilation.Errors)
+			continue
+		}
+		compileErr := compilation.Errors[0]
+		span := compileErr.Span()
+		if !span.IsValid() {
+			t.Errorf("%s: expected the error to have a span", tt.in)
+			continue
+		}
+		got := tt.in[span.Start.Pos.Offset : span.End.Pos.Offset+len(span.End.Value)]
+		if compileErr.Error() != tt.errMsg || compileErr.Code != tt.code || got != tt.span {
+			t.Errorf("%s: expected %s (%s) at %q, got %s (%s) at %q", tt.in, tt.errMsg, tt.code, tt.span, compileErr, compileErr.Code, got)
+		}
+	}
+
+	// All errors are reported at once
+	compilation := compiler.CompileStringParams("a + b", compiler.Params{Schema: compiler.Schema{}})
+	if len(compilation.Errors) != 2 {
+		t.Errorf("Expected both names to be reported, got %v", compilation.Errors)
+	}
+}
+
+func TestInferType(t *testing.T) {
+	schema := compiler.Schema{
+		"radius": types.Int,
+		"scale":  types.Float,
+		"tags":   types.Array{Elem: types.String},
+		"user":   types.Object{"name": types.String, "email": types.Nullable(types.String)},
+		"mixed":  types.UnionOf(types.Int, types.String),
+	}
+	tests := []struct {
+		in       string
+		expected types.Type
+	}{
+		{"radius * 2", types.Int},
+		{"radius * scale", types.Float},
+		{"radius / 2", types.Float},
+		{"radius ** 2", types.UnionOf(types.Int, types.Float)},
+		{"radius > 1 and scale < 2", types.Bool},
+		{"tags[0] + '!'", types.String},
+		{"radius > 1 ? 'big' : 0", types.UnionOf(types.String, types.Int)},
+		{"radius > 1 ? [1] : ['a']", types.Array{Elem: types.UnionOf(types.Int, types.String)}},
+		{"user.email", types.Nullable(types.String)},
+		// Optional fields can be used once they're checked
+		{"user.email ? user.email + '!' : ''", types.String},
+		{"not user.email ? 'none' : user.email * 2", types.String},
+		{"user.email and user.email + '!'", types.Nullable(types.String)},
+		{"user.email or user.name", types.String},
+		{"mixed * 2", types.UnionOf(types.Int, types.String)},
+		{"-radius", types.Int},
+	}
+	for _, tt := range tests {
+		expr, err := parser.ParseString(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, errs := compiler.InferType(expr, schema)
+		if len(errs) > 0 {
+			t.Errorf("%s: unexpected errors %v", tt.in, errs)
+			continue
+		}
+		if !types.Identical(got, tt.expected) {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, got)
+		}
+	}
+
+	invalid := []struct {
+		in     string
+		errMsg string
+	}{
+		{"user.email + '!'", "TypeError: unsupported operand type(s) for +: null and string"},
+		{"user.email.upper()", "AttributeError: null object has no attribute upper"},
+		{"mixed - 1", "TypeError: unsupported operand type(s) for -: string and int"},
+		{"radius > 1 ? user.email + '!' : ''", "TypeError: unsupported operand type(s) for +: null and string"},
+	}
+	for _, tt := range invalid {
+		expr, err := parser.ParseString(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, errs := compiler.InferType(expr, schema)
+		if len(errs) != 1 || errs[0].Error() != tt.errMsg {
+			t.Errorf("%s: expected %s, got %v", tt.in, tt.errMsg, errs)
+		}
+	}
+
+	// Without a schema, variables can be anything
+	expr, _ := parser.ParseString("a < b")
+	if got, errs := compiler.InferType(expr, nil); len(errs) > 0 || got != types.Bool {
+		t.Errorf("Expected a bool without errors, got %s %v", got, errs)
+	}
+}
+
+func TestCompileExpecting(t *testing.T) {
+	schema := compiler.Schema{"age": types.Int, "name": types.Nullable(types.String)}
+	tests := []struct {
+		in       string
+		expected types.Type
+		errMsg   string
+	}{
+		{"age >= 18", types.Bool, ""},
+		{"age * 2", types.Float, ""},
+		{"name or 'anonymous'", types.String, ""},
+		{"age > 18 ? 'adult' : 'minor'", types.String, ""},
+		{"age + 1", types.Bool, "TypeError: expected the expression to be bool, got int"},
+		{"name", types.String, "TypeError: expected the expression to be string, got string | null"},
+		{"age > 18 ? 'adult' : 0", types.String, "TypeError: expected the expression to be string, got string | int"},
+	}
+	for _, tt := range tests {
+		compilation := compiler.CompileExpecting(tt.in, tt.expected, schema)
+		switch {
+		case tt.errMsg == "" && len(compilation.Errors) > 0:
+			t.Errorf("%s: unexpected errors %v", tt.in, compilation.Errors)
+		case tt.errMsg != "" && (len(compilation.Errors) != 1 || compilation.Errors[0].Error() != tt.errMsg):
+			t.Errorf("%s: expected %s, got %v", tt.in, tt.errMsg, compilation.Errors)
+		}
+	}
+
+	// Anything can be a bool if the schema is unknown, but a literal of the wrong type can't
+	if errs := compiler.CompileExpecting("a and b", types.Bool, nil).Errors; len(errs) > 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+	if errs := compiler.CompileExpecting("'yes'", types.Bool, nil).Errors; len(errs) != 1 {
+		t.Errorf("Expected an error, got %v", errs)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	expr, err := parser.ParseString("contains(zips, user.address.zip) ? len(user.name) : user.address.format(sep) or default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := compiler.References(expr)
+	names := func(refs []compiler.Reference) string {
+		var result []string
+		for _, ref := range refs {
+			name := ref.Name
+			if ref.Conditional {
+				name += "?"
+			}
+			result = append(result, name)
+		}
+		return strings.Join(result, " ")
+	}
+	if got := names(refs.Variables); got != "zips user sep? default?" {
+		t.Errorf("Unexpected variables %s", got)
+	}
+	if got := names(refs.Fields); got != "user.address.zip user.name? user.address?" {
+		t.Errorf("Unexpected fields %s", got)
+	}
+	if got := names(refs.Functions); got != "contains len?" {
+		t.Errorf("Unexpected functions %s", got)
+	}
+	if got := names(refs.Methods); got != "user.address.format?" {
+		t.Errorf("Unexpected methods %s", got)
+	}
+	if len(refs.Variables[1].Spans) != 3 || refs.Variables[1].Spans[1].Start.Pos.Column != 40 {
+		t.Errorf("Expected every use of user to have a span, got %v", refs.Variables[1].Spans)
+	}
+
+	// A reference is only conditional if all of its uses are
+	expr, _ = parser.ParseString("a and b or b.c + f(x)[0].y + json.parse(x).z")
+	refs = compiler.References(expr)
+	if got := names(refs.Variables); got != "a b? x? json?" {
+		t.Errorf("Unexpected variables %s", got)
+	}
+	if got := names(refs.Fields); got != "b.c?" {
+		t.Errorf("Unexpected fields %s", got)
+	}
+	if got := names(refs.Methods); got != "json.parse?" {
+		t.Errorf("Unexpected methods %s", got)
+	}
+
+	// Compiled expressions have the same references
+	compiled, _ := parser.ParseString("a.b + c")
+	compiler.Compile(compiled, compiler.Params{})
+	if got := names(compiler.References(compiled).Variables); got != "a c" {
+		t.Errorf("Unexpected variables %s", got)
+	}
+}
@@ -1,7 +1,124 @@
 package compiler
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	. "github.com/thomastay/expression_language/pkg/ast"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+// Reported for the parts of an expression that couldn't be parsed, see ast.EBad
+var errSyntax = errors.New("SyntaxError: invalid expression")
 
 func errUnaryType(op, typename string) error {
-	return fmt.Errorf("TypeError: bad operand type for unary %s: %s", op, typename)
+	return &runtime.TypeError{Op: "unary " + op, Operands: []string{typename}}
+}
+
+// How bad a CompileError is. Every error the compiler reports stops the expression from compiling, so
+// SeverityError is the only severity for now.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+)
+
+func (s Severity) String() string {
+	return "error"
+}
+
+// Stable codes for each kind of CompileError, so that tools can match on them without parsing the message
+const (
+	CodeSyntax        = "E0001"
+	CodeInvalidNumber = "E0002"
+	CodeType          = "E0003"
+	CodeArithmetic    = "E0004"
+	CodeFormat        = "E0005"
+	CodeName          = "E0006"
+	CodeAttribute     = "E0007"
+	CodeInternal      = "E9999"
+)
+
+type CompileError struct {
+	Err   error
+	Start *lexer.Token
+	End   *lexer.Token
+	// The zero value is SeverityError
+	Severity Severity
+	// One of the Code constants, or empty if unknown
+	Code string
+}
+
+func newCompileError(err error, code string, span Span) CompileError {
+	return CompileError{Err: err, Start: span.Start, End: span.End, Code: code}
+}
+
+// The code for an error returned by the runtime while folding constants
+func errorCode(err error) string {
+	var typeErr *runtime.TypeError
+	var arithErr *runtime.ArithmeticError
+	switch {
+	case errors.As(err, &typeErr):
+		return CodeType
+	case errors.As(err, &arithErr):
+		return CodeArithmetic
+	}
+	return ""
+}
+
+func (c CompileError) Error() string {
+	return c.Err.Error()
+}
+
+func (c CompileError) IsErr() bool {
+	return c.Err != nil
+}
+
+func (c CompileError) Span() Span {
+	return Span{Start: c.Start, End: c.End}
+}
+
+// Renders errs as a report for humans, with the part of src that each error points at underlined:
+//
+//	error[E0003]: TypeError: bad operand type for unary -: string
+//	 | -'a' + 1
+//	 | ^^^^---
+//
+// Errors without a position are rendered without the source.
+func FormatDiagnostics(src string, errs []CompileError) string {
+	var sb strings.Builder
+	for i, err := range errs {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(err.Severity.String())
+		if err.Code != "" {
+			fmt.Fprintf(&sb, "[%s]", err.Code)
+		}
+		sb.WriteString(": ")
+		sb.WriteString(err.Error())
+		sb.WriteString("\n")
+		sb.WriteString(err.Span().Underline(src))
+	}
+	return sb.String()
+}
+
+// Returned by vm.EvalString and friends when an expression fails to compile. Error renders every error with
+// FormatDiagnostics, while errors.Is and errors.As see the first error.
+type Diagnostics struct {
+	Source string
+	Errs   []CompileError
+}
+
+func (d *Diagnostics) Error() string {
+	return strings.TrimSuffix(FormatDiagnostics(d.Source, d.Errs), "\n")
+}
+
+func (d *Diagnostics) Unwrap() error {
+	if len(d.Errs) == 0 {
+		return nil
+	}
+	return d.Errs[0].Err
 }
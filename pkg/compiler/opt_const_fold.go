@@ -1,6 +1,8 @@
 package compiler
 
 import (
+	"errors"
+
 	. "github.com/thomastay/expression_language/pkg/ast"
 	. "github.com/thomastay/expression_language/pkg/bytecode"
 	"github.com/thomastay/expression_language/pkg/runtime"
@@ -32,22 +34,15 @@ func ConstFold(ptrToExpr *Expr) walkError {
 			case *EBool:
 				// create an int node
 				boolVal := int64(0)
-				if *inner {
+				if inner.Val {
 					boolVal = 1
 				}
-				*ptrToExpr = (*EInt)(&boolVal)
+				span := node.Span()
+				*ptrToExpr = &EInt{Val: boolVal, Start: span.Start, End: span.End}
 			case *EStr:
-				errs = append(errs, CompileError{
-					Err:   errUnaryType("+", "string"),
-					Start: node.Op,
-					End:   node.Op,
-				})
+				errs = append(errs, newCompileError(errUnaryType("+", "string"), CodeType, node.Span()))
 			case *EArray:
-				errs = append(errs, CompileError{
-					Err:   errUnaryType("+", "array"),
-					Start: node.Op,
-					End:   node.Op,
-				})
+				errs = append(errs, newCompileError(errUnaryType("+", "array"), CodeType, node.Span()))
 			default:
 				// do nothing, fallthrough
 			}
@@ -57,20 +52,12 @@ func ConstFold(ptrToExpr *Expr) walkError {
 				bVal := toBVal(node.Val)
 				result, err := runtime.Negate(bVal)
 				if err != nil {
-					errs = append(errs, CompileError{
-						Err:   err,
-						Start: node.Op,
-						End:   node.Op,
-					})
+					errs = append(errs, newCompileError(err, errorCode(err), node.Span()))
 				} else {
-					*ptrToExpr = bValToNode(result)
+					*ptrToExpr = bValToNode(result, node.Span())
 				}
 			case *EArray:
-				errs = append(errs, CompileError{
-					Err:   errUnaryType("-", "array"),
-					Start: node.Op,
-					End:   node.Op,
-				})
+				errs = append(errs, newCompileError(errUnaryType("-", "array"), CodeType, node.Span()))
 			default:
 				// do nothing, fallthrough
 			}
@@ -78,12 +65,10 @@ func ConstFold(ptrToExpr *Expr) walkError {
 			switch inner := node.Val.(type) {
 			case *EInt, *EFloat, *EBool, *EStr:
 				bVal := toBVal(node.Val)
-				flip := !bVal.IsTruthy()
-				*ptrToExpr = (*EBool)(&flip)
+				*ptrToExpr = bValToNode(BBool(!bVal.IsTruthy()), node.Span())
 			case *EArray:
 				// special case this for now until const arrays
-				flip := len(*inner) == 0
-				*ptrToExpr = (*EBool)(&flip)
+				*ptrToExpr = bValToNode(BBool(len(inner.Exprs) == 0), node.Span())
 			default:
 				// do nothing, fallthrough
 			}
@@ -91,12 +76,10 @@ func ConstFold(ptrToExpr *Expr) walkError {
 	case *EBinOp:
 		if isConst(node.Left) && isConst(node.Right) {
 			newExpr, err := foldBinaryOpBothConst(node)
-			if err != nil {
-				errs = append(errs, CompileError{
-					Err:   err,
-					Start: node.Op,
-					End:   node.Op,
-				})
+			if errors.Is(err, runtime.ErrOOM) {
+				// Too big to store as a constant. Leave it to the VM, which has its own memory limit
+			} else if err != nil {
+				errs = append(errs, newCompileError(err, errorCode(err), node.Span()))
 			} else {
 				*ptrToExpr = newExpr
 			}
@@ -127,10 +110,8 @@ func ConstFold(ptrToExpr *Expr) walkError {
 				}
 			}
 		}
-		// else, swap
-		if _, ok := commutativeOps[node.Op.Value]; ok && isConst(node.Left) {
-			node.Left, node.Right = node.Right, node.Left
-		}
+		// Operands are never swapped, even for commutative ops, since + isn't commutative for strings and arrays,
+		// and operator hooks on host values are told which side they were on
 
 	case *ECond:
 		if isConst(node.Cond) {
@@ -154,7 +135,7 @@ func ConstFold(ptrToExpr *Expr) walkError {
 	return errs
 }
 
-// TODO
+// The largest string or array that the compiler will create by folding constants
 var compilerMemoryLimit = 100000
 
 // Helper function to fold a Binary operation with both children constant
@@ -186,32 +167,29 @@ func foldBinaryOpBothConst(node *EBinOp) (Expr, error) {
 		if err != nil {
 			return nil, err
 		}
-		b := runtime.OrdToBool(node.Op.Value, ord)
-		return (*EBool)(&b), nil
+		result = BBool(runtime.OrdToBool(node.Op.Value, ord))
 	case "==":
-		result := runtime.Eq(left, right)
-		return (*EBool)(&result), nil
+		result = BBool(runtime.Eq(left, right))
 	case "!=":
-		result := !runtime.Eq(left, right)
-		return (*EBool)(&result), nil
+		result = BBool(!runtime.Eq(left, right))
 	// Conditionals
 	case "and":
+		result = left
 		if right.IsTruthy() {
-			return bValToNode(right), nil
+			result = right
 		}
-		return bValToNode(left), nil
 	case "or":
+		result = right
 		if left.IsTruthy() {
-			return bValToNode(left), nil
+			result = left
 		}
-		return bValToNode(right), nil
 	default:
 		panic("not impl")
 	}
 	if err != nil {
 		return nil, err
 	}
-	return bValToNode(result), nil
+	return bValToNode(result, node.Span()), nil
 }
 
 func isConst(expr Expr) bool {
@@ -227,13 +205,13 @@ func isConst(expr Expr) bool {
 func toBVal(expr Expr) BVal {
 	switch inner := expr.(type) {
 	case *EInt:
-		return BInt(*inner)
+		return BInt(inner.Val)
 	case *EFloat:
-		return BFloat(*inner)
+		return BFloat(inner.Val)
 	case *EStr:
-		return BStr(*inner)
+		return BStr(inner.Val)
 	case *EBool:
-		return BBool(*inner)
+		return BBool(inner.Val)
 	// case *EArray:
 	// 	return BArray(*inner)
 	default:
@@ -241,24 +219,18 @@ func toBVal(expr Expr) BVal {
 	}
 }
 
-func bValToNode(val BVal) Expr {
+// Creates a constant node for val. span is the span of the node that it replaces
+func bValToNode(val BVal, span Span) Expr {
 	switch x := val.(type) {
 	case BBool:
-		return (*EBool)(&x)
+		return &EBool{Val: bool(x), Start: span.Start, End: span.End}
 	case BInt:
-		return (*EInt)(&x)
+		return &EInt{Val: int64(x), Start: span.Start, End: span.End}
 	case BFloat:
-		return (*EFloat)(&x)
+		return &EFloat{Val: float64(x), Start: span.Start, End: span.End}
 	case BStr:
-		return (*EStr)(&x)
+		return &EStr{Val: string(x), Start: span.Start, End: span.End}
 	default:
 		panic("no other bvals can be nodes (for now)")
 	}
 }
-
-var commutativeOps = map[string]struct{}{
-	// TODO - and /
-	"+":  {},
-	"*":  {},
-	"==": {},
-}
@@ -17,14 +17,17 @@ func ConstPushDown(ptrToExpr *Expr) walkError {
 		// numHours  24
 		//
 		// We go top down, so we first check if the two binOps are the same op, and if both are constant.
+		// Only * with numeric constants is rearranged. + isn't commutative for strings and arrays, and host
+		// values can overload it, so numHours + 1 + 2 might not be numHours + 3.
 		op := node.Op.Value
-		if _, ok := commutativeOps[op]; !ok {
+		if op != "*" {
 			return errs
 		}
 		if isConst(node.Left) {
-			panic("Should have been fixed before this")
+			// ConstFold leaves both sides constant only if the result was too big to fold
+			return errs
 		}
-		if !isConst(node.Right) {
+		if !isNumericConst(node.Right) {
 			return errs
 		}
 		if lNode, ok := node.Left.(*EBinOp); ok {
@@ -33,9 +36,10 @@ func ConstPushDown(ptrToExpr *Expr) walkError {
 				return errs
 			}
 			if isConst(lNode.Left) {
-				panic("Should have been fixed before this")
+				// Too big to fold, see above
+				return errs
 			}
-			if isConst(lNode.Right) {
+			if isNumericConst(lNode.Right) {
 				// jackpot! Fold
 				newBinOp := EBinOp{
 					Op:    node.Op,
@@ -44,11 +48,7 @@ func ConstPushDown(ptrToExpr *Expr) walkError {
 				}
 				newExpr, err := foldBinaryOpBothConst(&newBinOp)
 				if err != nil {
-					errs = append(errs, CompileError{
-						Err:   err,
-						Start: lNode.Op,
-						End:   node.Op,
-					})
+					errs = append(errs, newCompileError(err, errorCode(err), node.Span()))
 					return errs
 				}
 				// Rotate right
@@ -57,7 +57,7 @@ func ConstPushDown(ptrToExpr *Expr) walkError {
 				// Call again, in case we can push down again
 				cErrs := ConstPushDown(ptrToExpr)
 				errs = append(errs, cErrs...)
-			} else {
+			} else if !isConst(lNode.Right) {
 				// Else, we PUSH the constant down (hence the name)
 				lNode.Right, node.Right = node.Right, lNode.Right
 			}
@@ -65,3 +65,12 @@ func ConstPushDown(ptrToExpr *Expr) walkError {
 	}
 	return errs
 }
+
+func isNumericConst(expr Expr) bool {
+	switch expr.(type) {
+	case *EInt, *EFloat:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,7 +1,7 @@
 package compiler
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 
 	. "github.com/thomastay/expression_language/pkg/ast"
@@ -18,44 +18,33 @@ func ParseValue(ptrToExpr *Expr) walkError {
 			tok := node.Val
 			val, err := strconv.ParseInt(tok.Value, 0, 64)
 			if err != nil {
-				errs = append(errs, CompileError{
-					Err:   err,
-					Start: tok,
-					End:   tok,
-				})
+				errs = append(errs, newCompileError(err, CodeInvalidNumber, node.Span()))
 			}
 			// override node
-			*ptrToExpr = (*EInt)(&val)
+			*ptrToExpr = &EInt{Val: val, Start: tok, End: tok}
 		case parser.TokFloat:
 			tok := node.Val
 			val, err := strconv.ParseFloat(tok.Value, 64)
 			if err != nil {
-				errs = append(errs, CompileError{
-					Err:   err,
-					Start: tok,
-					End:   tok,
-				})
+				errs = append(errs, newCompileError(err, CodeInvalidNumber, node.Span()))
 			}
 			// override node
-			*ptrToExpr = (*EFloat)(&val)
+			*ptrToExpr = &EFloat{Val: val, Start: tok, End: tok}
 		case parser.TokSingleString:
-			val := node.Val.Value
+			tok := node.Val
+			val := tok.Value
 			val = val[1 : len(val)-1]
 			// override node
-			*ptrToExpr = (*EStr)(&val)
+			*ptrToExpr = &EStr{Val: val, Start: tok, End: tok}
 		case parser.TokIdent:
-			val := node.Val.Value
+			tok := node.Val
 			// override node
-			*ptrToExpr = (*EIdent)(&val)
+			*ptrToExpr = &EIdent{Val: tok.Value, Start: tok, End: tok}
 		case parser.TokBool:
-			val := node.Val.Value
-			boolVal := false
-			if val == "true" {
-				boolVal = true
-			}
-			*ptrToExpr = (*EBool)(&boolVal)
+			tok := node.Val
+			*ptrToExpr = &EBool{Val: tok.Value == "true", Start: tok, End: tok}
 		default:
-			log.Panicf("Token %s type %d not implemented", node.Val.Value, node.Val.Type)
+			panic(fmt.Sprintf("Token %s type %d not implemented", node.Val.Value, node.Val.Type))
 		}
 
 	// else do nothing
@@ -71,8 +60,11 @@ func ParseValue(ptrToExpr *Expr) walkError {
 	case *ECond:
 	case *ECall:
 	case *EArray:
+	case *EBad:
+		// The parser already reported the syntax error, but report it here too in case it was ignored
+		errs = append(errs, newCompileError(errSyntax, CodeSyntax, node.Span()))
 	default:
-		log.Panicf("AST type %T is not impl", expr)
+		panic(fmt.Sprintf("AST type %T is not impl", expr))
 	}
 
 	return errs
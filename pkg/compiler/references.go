@@ -0,0 +1,148 @@
+package compiler
+
+import (
+	"fmt"
+
+	. "github.com/thomastay/expression_language/pkg/ast"
+	"github.com/thomastay/expression_language/pkg/parser"
+)
+
+// What an expression uses from its env, see References
+type ReferenceSet struct {
+	// Variables loaded from the env, e.g. user and zips in user.address.zip in zips
+	Variables []Reference
+	// The longest field paths that are accessed, e.g. user.address.zip. Fields of values that aren't variables
+	// or fields, e.g. f(x).y, are left out, since they don't have a path.
+	Fields []Reference
+	// Functions that are called, e.g. len in len(x)
+	Functions []Reference
+	// Methods that are called on a variable or field, e.g. s.upper in s.upper() or json.parse in json.parse(s).
+	// These can be fields that are functions, or builtin methods of the value's type.
+	Methods []Reference
+}
+
+// A variable, field, function or method used by an expression.
+type Reference struct {
+	// The name, with the path to it for fields and methods, e.g. user.address.zip
+	Name string
+	// True if the reference might not be evaluated, because every use of it is in a branch of a ternary or on the
+	// right of and/or. For example, b is conditional in a ? b : c, but a isn't
+	Conditional bool
+	// Where each use of it is, in the order they appear in the expression
+	Spans []Span
+}
+
+// Lists the variables, fields, functions and methods that an expression references, in the order that they first
+// appear. This can be used to only fetch the data that an expression needs, or to find out which expressions
+// depend on each other. Each name is listed once.
+//
+// The expression can come straight from the parser, and isn't changed.
+func References(expr Expr) ReferenceSet {
+	r := referenceCollector{seen: make(map[string]int)}
+	r.collect(expr, false)
+	return r.refs
+}
+
+type referenceCollector struct {
+	refs ReferenceSet
+	// The index of each name in its list, keyed by the kind of reference and the name
+	seen map[string]int
+}
+
+func (r *referenceCollector) add(list *[]Reference, kind, name string, span Span, conditional bool) {
+	key := kind + " " + name
+	if i, ok := r.seen[key]; ok {
+		ref := &(*list)[i]
+		// It's unconditional if any use of it is
+		ref.Conditional = ref.Conditional && conditional
+		ref.Spans = append(ref.Spans, span)
+		return
+	}
+	r.seen[key] = len(*list)
+	*list = append(*list, Reference{Name: name, Conditional: conditional, Spans: []Span{span}})
+}
+
+func (r *referenceCollector) collect(expr Expr, conditional bool) {
+	switch node := expr.(type) {
+	case *EValue:
+		if node.Val.Type == parser.TokIdent {
+			r.add(&r.refs.Variables, "variable", node.Val.Value, node.Span(), conditional)
+		}
+	case *EIdent:
+		r.add(&r.refs.Variables, "variable", node.Val, node.Span(), conditional)
+	case *EInt, *EFloat, *EStr, *EBool, *EBad:
+	case *EUnOp:
+		r.collect(node.Val, conditional)
+	case *EBinOp:
+		r.collect(node.Left, conditional)
+		// The right side of and/or is short circuited
+		op := node.Op.Value
+		r.collect(node.Right, conditional || op == "and" || op == "or")
+	case *ECond:
+		r.collect(node.Cond, conditional)
+		r.collect(node.First, true)
+		r.collect(node.Second, true)
+	case *EFieldAccess:
+		if path, ok := pathOf(node); ok {
+			r.add(&r.refs.Fields, "field", path, node.Span(), conditional)
+			r.collectPathRoot(node, conditional)
+		} else {
+			r.collect(node.Base, conditional)
+		}
+	case *EIdxAccess:
+		r.collect(node.Base, conditional)
+		r.collect(node.Index, conditional)
+	case *ECall:
+		span := node.Span()
+		if node.Base == nil {
+			r.add(&r.refs.Functions, "function", node.Method.Value, span, conditional)
+		} else if path, ok := pathOf(node.Base); ok {
+			r.add(&r.refs.Methods, "method", path+"."+node.Method.Value, span, conditional)
+			// The base is a variable or field, which is listed as well
+			if _, isField := node.Base.(*EFieldAccess); isField {
+				r.add(&r.refs.Fields, "field", path, node.Base.Span(), conditional)
+			}
+			r.collectPathRoot(node.Base, conditional)
+		} else {
+			r.collect(node.Base, conditional)
+		}
+		for _, arg := range node.Exprs {
+			r.collect(arg, conditional)
+		}
+	case *EArray:
+		for _, x := range node.Exprs {
+			r.collect(x, conditional)
+		}
+	default:
+		panic(fmt.Sprintf("AST type %T is not impl", node))
+	}
+}
+
+// Adds the variable at the start of a path
+func (r *referenceCollector) collectPathRoot(expr Expr, conditional bool) {
+	for {
+		field, ok := expr.(*EFieldAccess)
+		if !ok {
+			break
+		}
+		expr = field.Base
+	}
+	r.collect(expr, conditional)
+}
+
+// The dotted path of a variable or field, e.g. user.address.zip. Returns false if expr isn't a path
+func pathOf(expr Expr) (string, bool) {
+	switch node := expr.(type) {
+	case *EValue:
+		if node.Val.Type == parser.TokIdent {
+			return node.Val.Value, true
+		}
+	case *EIdent:
+		return node.Val, true
+	case *EFieldAccess:
+		if base, ok := pathOf(node.Base); ok {
+			return base + "." + node.Field.Value, true
+		}
+	}
+	return "", false
+}
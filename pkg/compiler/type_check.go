@@ -0,0 +1,477 @@
+package compiler
+
+import (
+	"fmt"
+
+	. "github.com/thomastay/expression_language/pkg/ast"
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/types"
+)
+
+// The types of the variables and functions in the env that an expression is evaluated with.
+// Set Params.Schema to check expressions against it at compile time, instead of finding out about type errors
+// when they're evaluated.
+//
+//	schema := compiler.Schema{
+//		"radius": types.Int,
+//		"user":   types.Object{"name": types.String, "tags": types.Array{Elem: types.String}},
+//		"f":      types.Func(types.Float, types.Int),
+//	}
+type Schema map[string]types.Type
+
+// Returns a copy of the schema with the builtins of a version of the standard library added, see
+// stdlib.Builtins. Variables in the schema shadow builtins of the same name, like they do in the VM.
+func (s Schema) WithBuiltins(version int) Schema {
+	result := make(Schema, len(s))
+	for name, val := range stdlib.Builtins(version) {
+		result[name] = types.Of(val)
+	}
+	for name, t := range s {
+		result[name] = t
+	}
+	return result
+}
+
+// Infers the type of the result of expr, which must not have been compiled yet. Errors are reported like
+// Compile does, and the parts of expr with errors are assumed to be Any. A nil schema declares nothing, but unlike
+// an empty schema, identifiers that aren't declared are Any instead of errors.
+//
+// Like Compile, this replaces the values in expr with their parsed nodes, e.g. ast.EValue with ast.EInt.
+func InferType(expr Expr, schema Schema) (types.Type, []CompileError) {
+	errs := walk(&expr, ParseValue)
+	if len(errs) > 0 {
+		return types.Any, errs
+	}
+	tc := newTypeChecker(schema, nil)
+	errs = tc.check(&expr)
+	return tc.typeOf(expr), errs
+}
+
+// Compiles src with the schema, and reports an error if the result isn't of the expected type. For example,
+// to make sure that an expression is a condition:
+//
+//	compiler.CompileExpecting(src, types.Bool, schema)
+//
+// A nil schema can be used if the types of the variables aren't known, see InferType.
+func CompileExpecting(src string, expected types.Type, schema Schema) Compilation {
+	return CompileStringParams(src, Params{Schema: schema, Expect: expected})
+}
+
+// Infers the type of every node, reporting operations that would fail at runtime. Nothing is reported about
+// values of type Any, so the checker is only as strict as the schema.
+type typeChecker struct {
+	// nil if identifiers that aren't declared are Any
+	schema Schema
+	// Methods registered by the host, see Params.Methods
+	methods map[string]map[string]BFunc
+	types   map[Expr]types.Type
+	// Variables and fields that can't be null where they're used, since they were checked first, e.g. the
+	// second user.email in user.email ? user.email + '!' : ''
+	nonNull map[Expr]bool
+}
+
+func newTypeChecker(schema Schema, methods map[string]map[string]BFunc) *typeChecker {
+	return &typeChecker{
+		schema:  schema,
+		methods: methods,
+		types:   make(map[Expr]types.Type),
+		nonNull: make(map[Expr]bool),
+	}
+}
+
+func (tc *typeChecker) check(ptrToExpr *Expr) walkError {
+	walkTopDown(ptrToExpr, tc.narrow)
+	return walk(ptrToExpr, tc.visit)
+}
+
+// Reports an error if the result of expr isn't of type expected. Must be called after check
+func (tc *typeChecker) expect(expr Expr, expected types.Type) walkError {
+	t := tc.typeOf(expr)
+	if types.AssignableTo(t, expected) {
+		return nil
+	}
+	err := &runtime.TypeError{Reason: fmt.Sprintf("expected the expression to be %s, got %s", expected, t)}
+	return walkError{newCompileError(err, CodeType, expr.Span())}
+}
+
+// Marks the uses of a variable or field that are only evaluated if it's truthy, which means that it isn't null.
+// Must be used with walkTopDown, since it marks the nodes below the one visited
+func (tc *typeChecker) narrow(ptrToExpr *Expr) walkError {
+	switch node := (*ptrToExpr).(type) {
+	case *ECond:
+		// x ? then : else, or not x ? else : then
+		if not, ok := node.Cond.(*EUnOp); ok && not.Op.Value == "not" {
+			tc.markNonNull(not.Val, node.Second)
+		} else {
+			tc.markNonNull(node.Cond, node.First)
+		}
+	case *EBinOp:
+		if node.Op.Value == "and" {
+			tc.markNonNull(node.Left, node.Right)
+		}
+	}
+	return nil
+}
+
+func (tc *typeChecker) markNonNull(cond Expr, body Expr) {
+	path, ok := pathOf(cond)
+	if !ok {
+		return
+	}
+	walk(&body, func(ptrToExpr *Expr) walkError {
+		if nodePath, ok := pathOf(*ptrToExpr); ok && nodePath == path {
+			tc.nonNull[*ptrToExpr] = true
+		}
+		return nil
+	})
+}
+
+// The type of a node that has already been visited
+func (tc *typeChecker) typeOf(expr Expr) types.Type {
+	if t, ok := tc.types[expr]; ok {
+		return t
+	}
+	return types.Any
+}
+
+// Visits nodes after their children, so must be used with walk
+func (tc *typeChecker) visit(ptrToExpr *Expr) walkError {
+	var errs []CompileError
+	report := func(err error, code string, span Span) types.Type {
+		errs = append(errs, newCompileError(err, code, span))
+		// Errors aren't reported again for the nodes above this one
+		return types.Any
+	}
+	var t types.Type
+	switch node := (*ptrToExpr).(type) {
+	case *EValue:
+		panic("No more EValues after parsing")
+	case *EInt:
+		t = types.Int
+	case *EFloat:
+		t = types.Float
+	case *EStr:
+		t = types.String
+	case *EBool:
+		t = types.Bool
+	case *EIdent:
+		t = tc.lookup(node.Val, node.Span(), report)
+	case *EUnOp:
+		var members []types.Type
+		for _, operand := range types.Members(tc.typeOf(node.Val)) {
+			result, ok := unaryResult(node.Op.Value, operand)
+			if !ok {
+				members = nil
+				t = report(errUnaryType(node.Op.Value, types.Typename(operand)), CodeType, node.Span())
+				break
+			}
+			members = append(members, result)
+		}
+		if members != nil {
+			t = types.UnionOf(members...)
+		}
+	case *EBinOp:
+		var ok bool
+		t, ok = tc.binaryOp(node, report)
+		if !ok {
+			t = types.Any
+		}
+	case *ECond:
+		t = commonType(tc.typeOf(node.First), tc.typeOf(node.Second))
+	case *EArray:
+		if len(node.Exprs) == 0 {
+			t = types.Array{Elem: types.Any}
+			break
+		}
+		elem := tc.typeOf(node.Exprs[0])
+		for _, x := range node.Exprs[1:] {
+			elem = commonType(elem, tc.typeOf(x))
+		}
+		t = types.Array{Elem: elem}
+	case *EIdxAccess:
+		t = tc.index(node, report)
+	case *EFieldAccess:
+		t = tc.field(tc.typeOf(node.Base), node.Field.Value, node.Span(), report)
+	case *ECall:
+		var fn types.Type
+		if node.Base == nil {
+			fn = tc.lookup(node.Method.Value, Span{Start: node.Method, End: node.Method}, report)
+		} else {
+			fn = tc.field(tc.typeOf(node.Base), node.Method.Value, node.Span(), report)
+		}
+		t = tc.call(node, fn, report)
+	case *EBad:
+		t = types.Any
+	default:
+		panic(fmt.Sprintf("AST type %T is not impl", node))
+	}
+	if tc.nonNull[*ptrToExpr] {
+		t = types.NonNull(t)
+	}
+	tc.types[*ptrToExpr] = t
+	return errs
+}
+
+// The type of a variable or function
+func (tc *typeChecker) lookup(name string, span Span, report func(error, string, Span) types.Type) types.Type {
+	if tc.schema == nil {
+		return types.Any
+	}
+	t, ok := tc.schema[name]
+	if !ok {
+		return report(&runtime.NameError{Name: name}, CodeName, span)
+	}
+	return t
+}
+
+// The type of base.name
+func (tc *typeChecker) field(base types.Type, name string, span Span, report func(error, string, Span) types.Type) types.Type {
+	var members []types.Type
+	for _, member := range types.Members(base) {
+		switch member := member.(type) {
+		case types.Object:
+			if t, ok := member[name]; ok {
+				members = append(members, t)
+			} else if method, ok := tc.methods["object"][name]; ok {
+				// Fields shadow methods, like in the VM
+				members = append(members, boundMethodType(method))
+			} else {
+				return report(&runtime.AttributeError{Type: "object", Name: name}, CodeAttribute, span)
+			}
+		case types.Basic:
+			if member == types.Null {
+				// null has no fields or methods
+				return report(&runtime.AttributeError{Type: "null", Name: name}, CodeAttribute, span)
+			}
+			// Methods can be registered on any type with VMState.RegisterMethod, so they can't be checked
+			members = append(members, types.Any)
+		default:
+			members = append(members, types.Any)
+		}
+	}
+	return types.UnionOf(members...)
+}
+
+// The type of the result of a binary operator. Operators on unions must be defined for every member
+func (tc *typeChecker) binaryOp(node *EBinOp, report func(error, string, Span) types.Type) (types.Type, bool) {
+	op := node.Op.Value
+	left, right := tc.typeOf(node.Left), tc.typeOf(node.Right)
+	switch op {
+	case "==", "!=":
+		return types.Bool, true
+	case "and":
+		// a and b is a if a is falsy, else b
+		return commonType(left, right), true
+	case "or":
+		// a or b is a if a is truthy, else b. Null is never truthy
+		return commonType(types.NonNull(left), right), true
+	}
+	var members []types.Type
+	for _, l := range types.Members(left) {
+		for _, r := range types.Members(right) {
+			result, ok := binaryResult(op, l, r)
+			if !ok {
+				err := &runtime.TypeError{Op: op, Operands: []string{types.Typename(l), types.Typename(r)}}
+				report(err, CodeType, node.Span())
+				return nil, false
+			}
+			members = append(members, result)
+		}
+	}
+	return types.UnionOf(members...), true
+}
+
+// The type of base[index]
+func (tc *typeChecker) index(node *EIdxAccess, report func(error, string, Span) types.Type) types.Type {
+	index := tc.typeOf(node.Index)
+	var members []types.Type
+	for _, base := range types.Members(tc.typeOf(node.Base)) {
+		switch base := base.(type) {
+		case types.Array:
+			for _, i := range types.Members(index) {
+				if !isIndexType(i) {
+					err := &runtime.TypeError{Op: "[]", Operands: []string{"array", types.Typename(i)}}
+					return report(err, CodeType, node.Span())
+				}
+			}
+			members = append(members, elemType(base))
+		case types.Basic, types.Object, types.Function:
+			return report(&runtime.TypeError{Op: "[]", Operands: []string{types.Typename(base)}}, CodeType, node.Span())
+		default:
+			// Host values can overload indexing
+			return types.Any
+		}
+	}
+	return types.UnionOf(members...)
+}
+
+// The type returned by calling fn with the arguments of node
+func (tc *typeChecker) call(node *ECall, fn types.Type, report func(error, string, Span) types.Type) types.Type {
+	switch fn := fn.(type) {
+	case types.Function:
+		numArgs := len(node.Exprs)
+		if numArgs < fn.MinArgs() || (!fn.Variadic && numArgs > len(fn.Params)) {
+			expected := fmt.Sprintf("expected %d", len(fn.Params))
+			if fn.Variadic {
+				expected = fmt.Sprintf("expected at least %d", fn.MinArgs())
+			}
+			err := &runtime.TypeError{
+				Op:       "()",
+				Operands: []string{"function"},
+				Reason:   fmt.Sprintf("function %s passed wrong number of args, %s, got %d", node.Method.Value, expected, numArgs),
+			}
+			return report(err, CodeType, node.Span())
+		}
+		for i, arg := range node.Exprs {
+			argType := tc.typeOf(arg)
+			if param := fn.Param(i); !types.AssignableTo(argType, param) {
+				err := &runtime.TypeError{
+					Op:       "()",
+					Operands: []string{"function"},
+					Reason:   fmt.Sprintf("%s() argument %d must be %s, not %s", node.Method.Value, i, param, argType),
+				}
+				report(err, CodeType, arg.Span())
+			}
+		}
+		if fn.Result == nil {
+			return types.Any
+		}
+		return fn.Result
+	case types.Basic, types.Array, types.Object:
+		return report(&runtime.TypeError{Op: "()", Operands: []string{types.Typename(fn)}}, CodeType, node.Span())
+	case types.Union:
+		for _, member := range fn {
+			if _, ok := member.(types.Function); !ok {
+				return report(&runtime.TypeError{Op: "()", Operands: []string{types.Typename(member)}}, CodeType, node.Span())
+			}
+		}
+		// The members are all functions, but may take in different arguments
+		return types.Any
+	default:
+		return types.Any
+	}
+}
+
+func isNumber(t types.Type) bool {
+	// Bools are ints in arithmetic, see runtime.CastBoolToInt
+	return t == types.Int || t == types.Float || t == types.Bool
+}
+
+func isInt(t types.Type) bool {
+	return t == types.Int || t == types.Bool
+}
+
+func isIndexType(t types.Type) bool {
+	return t == types.Int || t == types.Bool || t == types.Any
+}
+
+// The type of the result of a unary operator, or false if it isn't defined for the operand
+func unaryResult(op string, operand types.Type) (types.Type, bool) {
+	if op == "not" {
+		return types.Bool, true
+	}
+	switch operand {
+	case types.Any:
+		return types.Any, true
+	case types.Int, types.Bool:
+		return types.Int, true
+	case types.Float:
+		return types.Float, true
+	}
+	return nil, false
+}
+
+// The type of the result of an arithmetic or comparison operator, or false if it isn't defined for the operands.
+// Neither operand can be a union. This follows the cases in runtime/generate/main.go
+func binaryResult(op string, left, right types.Type) (types.Type, bool) {
+	if op == "%" && left == types.String {
+		// printf style formatting, which takes anything
+		return types.String, true
+	}
+	if left == types.Any || right == types.Any {
+		switch op {
+		case "<", ">", "<=", ">=":
+			return types.Bool, true
+		case "/":
+			return types.Float, true
+		}
+		return types.Any, true
+	}
+	if isNumber(left) && isNumber(right) {
+		bothInts := left != types.Float && right != types.Float
+		switch op {
+		case "<", ">", "<=", ">=":
+			return types.Bool, true
+		case "/":
+			return types.Float, true
+		case "**":
+			if bothInts {
+				// Negative powers of ints are floats
+				return types.UnionOf(types.Int, types.Float), true
+			}
+			return types.Float, true
+		case "+", "-", "*", "//", "%":
+			if bothInts {
+				return types.Int, true
+			}
+			return types.Float, true
+		}
+		return nil, false
+	}
+	switch op {
+	case "+":
+		if left == types.String && right == types.String {
+			return types.String, true
+		}
+		leftArr, ok := left.(types.Array)
+		rightArr, ok2 := right.(types.Array)
+		if ok && ok2 {
+			return commonType(leftArr, rightArr), true
+		}
+	case "*":
+		// Repetition, e.g. 'ab' * 3. Bools are ints here too, so 'ab' * true is 'ab'
+		if isInt(left) && isRepeatable(right) {
+			return right, true
+		}
+		if isInt(right) && isRepeatable(left) {
+			return left, true
+		}
+	case "<", ">", "<=", ">=":
+		if left == types.String && right == types.String {
+			return types.Bool, true
+		}
+	}
+	return nil, false
+}
+
+func isRepeatable(t types.Type) bool {
+	_, isArray := t.(types.Array)
+	return t == types.String || isArray
+}
+
+// The type of a value that's either of type t or u. Arrays are merged, so that the type of [1, 'a'] is
+// array[int | string] and not array[int] | array[string]
+func commonType(t, u types.Type) types.Type {
+	if tArr, ok := t.(types.Array); ok {
+		if uArr, ok := u.(types.Array); ok {
+			return types.Array{Elem: types.UnionOf(elemType(tArr), elemType(uArr))}
+		}
+	}
+	return types.UnionOf(t, u)
+}
+
+// The type of a method once it's bound to its receiver, which is its first param
+func boundMethodType(method BFunc) types.Type {
+	fn := types.Of(method).(types.Function)
+	fn.Params = fn.Params[1:]
+	return fn
+}
+
+func elemType(t types.Array) types.Type {
+	if t.Elem == nil {
+		return types.Any
+	}
+	return t.Elem
+}
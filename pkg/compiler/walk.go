@@ -39,8 +39,8 @@ func walkInner(ptrToExpr *Expr, visit visitor, preorder bool) walkError {
 			walkAndAdd(&node.Exprs[i])
 		}
 	case *EArray:
-		for i := range *node {
-			walkAndAdd(&(*node)[i])
+		for i := range node.Exprs {
+			walkAndAdd(&node.Exprs[i])
 		}
 	}
 	if !preorder {
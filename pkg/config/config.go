@@ -0,0 +1,453 @@
+// Package config evaluates the expressions in a JSON document, like the one in the README:
+//
+//	{
+//	  "radius": 3,
+//	  "circumference": "=3.14158 * radius * 2",
+//	  "area": {"$expr": "3.14158 * radius * radius"}
+//	}
+//
+// Strings that start with = and objects with just an $expr key are expressions by default, see Convention.
+// Every expression is replaced by its result, and everything else is left as is.
+//
+// # Scoping
+//
+// Expressions can use the fields of the object they're in, and of every object that contains it, by name.
+// Fields of inner objects shadow fields of outer objects, which shadow the variables in Params.Env.
+// An expression never sees the field that it's in, so a field can refer to a field of the same name further out:
+//
+//	{
+//	  "timeout": 10,
+//	  "slow": {"timeout": "=timeout * 2"}
+//	}
+//
+// Expressions are evaluated when another expression needs them, so they can be written in any order. Getting a
+// field of an object, like a.b, only evaluates that field and not the rest of the object. When fields use each
+// other in a cycle, the field that closes the cycle fails with a *graph.CycleError, and the other fields in it
+// fail with graph.ErrDependencyFailed.
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/compiler"
+	"github.com/thomastay/expression_language/pkg/graph"
+	"github.com/thomastay/expression_language/pkg/parser"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/vm"
+)
+
+// Decides which values of a document are expressions
+type Convention interface {
+	// Returns the source of the expression if v is one. v was decoded from JSON, e.g. a string or map[string]any
+	Expr(v any) (src string, ok bool)
+}
+
+// Strings that start with the prefix are expressions, e.g. "=radius * 2" for Prefix("=")
+type Prefix string
+
+func (p Prefix) Expr(v any) (string, bool) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, string(p)) {
+		return "", false
+	}
+	return strings.TrimPrefix(s, string(p)), true
+}
+
+// Objects with only this key, and a string value, are expressions, e.g. {"$expr": "radius * 2"} for Wrapper("$expr")
+type Wrapper string
+
+func (w Wrapper) Expr(v any) (string, bool) {
+	obj, ok := v.(map[string]any)
+	if !ok || len(obj) != 1 {
+		return "", false
+	}
+	src, ok := obj[string(w)].(string)
+	return src, ok
+}
+
+// Values are expressions if any of the conventions say so
+type Conventions []Convention
+
+func (c Conventions) Expr(v any) (string, bool) {
+	for _, convention := range c {
+		if src, ok := convention.Expr(v); ok {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// Used if Params.Convention is nil
+var DefaultConvention = Conventions{Prefix("="), Wrapper("$expr")}
+
+type Params struct {
+	// Which values are expressions. Defaults to DefaultConvention
+	Convention Convention
+	// Variables that aren't fields of the document. Optional
+	Env vm.Resolver
+}
+
+// An error in the expression at Pointer, a JSON pointer (RFC 6901) to it, e.g. /servers/0/url
+type Error struct {
+	Pointer string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pointer, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Every expression that failed, in document order, except that the keys of each object are sorted
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Evaluates the expressions in a JSON document with m, and returns the document with the results in their place.
+// Numbers that are integers are ints in expressions. Returns Errors if any expression fails.
+func Eval(m *vm.VMState, doc []byte, params Params) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var val any
+	if err := decoder.Decode(&val); err != nil {
+		return nil, err
+	}
+	result, err := EvalValue(context.Background(), m, val, params)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// Like Eval, for a document that's already been decoded into maps, slices and values like encoding/json does.
+// doc isn't changed.
+func EvalValue(ctx context.Context, m *vm.VMState, doc any, params Params) (any, error) {
+	if params.Convention == nil {
+		params.Convention = DefaultConvention
+	}
+	e := &evaluator{ctx: ctx, m: m, params: params}
+	root := e.build(doc, "", nil)
+	for _, n := range e.exprs {
+		e.eval(n)
+	}
+	var errs Errors
+	for _, n := range e.exprs {
+		if n.err != nil {
+			errs = append(errs, &Error{Pointer: n.pointer, Err: n.err})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return e.output(root)
+}
+
+// A value in the document
+type node struct {
+	pointer string
+	parent  *node
+	// Set for objects, along with their keys in sorted order
+	fields map[string]*node
+	keys   []string
+	// Set for arrays
+	elems []*node
+	// Set for everything else
+	val any
+
+	// Set for expressions
+	isExpr  bool
+	program *vm.Program
+	result  BVal
+	err     error
+	done    bool
+	// Set if n needed an expression that was still being evaluated, which closed a cycle
+	cycle *graph.CycleError
+	// The variables and fields that the expression only gets fields of, see throughPaths
+	through map[string]bool
+}
+
+type evaluator struct {
+	ctx    context.Context
+	m      *vm.VMState
+	params Params
+	// Every expression, in the order they appear in the document
+	exprs []*node
+	// The expressions being evaluated, the innermost last
+	stack []*node
+}
+
+func (e *evaluator) build(val any, pointer string, parent *node) *node {
+	n := &node{pointer: pointer, parent: parent}
+	if src, ok := e.params.Convention.Expr(val); ok {
+		n.isExpr = true
+		n.program, n.err = e.m.Compile(src)
+		n.done = n.err != nil
+		if n.err == nil {
+			n.through = throughPaths(src)
+		}
+		e.exprs = append(e.exprs, n)
+		return n
+	}
+	switch val := val.(type) {
+	case map[string]any:
+		n.fields = make(map[string]*node, len(val))
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		// Sort, so that expressions are evaluated and reported in the same order every time
+		sort.Strings(keys)
+		n.keys = keys
+		for _, key := range keys {
+			n.fields[key] = e.build(val[key], pointer+"/"+escapePointer(key), n)
+		}
+	case []any:
+		n.elems = make([]*node, len(val))
+		for i, x := range val {
+			n.elems[i] = e.build(x, pointer+"/"+strconv.Itoa(i), n)
+		}
+	default:
+		n.val = val
+	}
+	return n
+}
+
+// Escapes a key for a JSON pointer, see RFC 6901
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func (e *evaluator) eval(n *node) {
+	if n.done {
+		return
+	}
+	e.stack = append(e.stack, n)
+	result, err := n.program.EvalContext(e.ctx, e.resolver(n))
+	e.stack = e.stack[:len(e.stack)-1]
+	if n.cycle != nil {
+		// Report the cycle itself, rather than the error from resolving the variable that closed it
+		err = n.cycle
+	}
+	n.result = result.Val
+	n.err = err
+	n.done = true
+}
+
+// Returns the cycle if n is being evaluated, so that the expression at the top of the stack can't need it
+func (e *evaluator) findCycle(n *node) *graph.CycleError {
+	for i, inProgress := range e.stack {
+		if inProgress == n {
+			path := make([]string, 0, len(e.stack)-i+1)
+			for _, x := range e.stack[i:] {
+				path = append(path, x.pointer)
+			}
+			return &graph.CycleError{Path: append(path, n.pointer)}
+		}
+	}
+	return nil
+}
+
+// Resolves variables to the fields of the objects that contain n, from the innermost out, and then to the env
+func (e *evaluator) resolver(n *node) vm.Resolver {
+	return vm.ResolverFunc(func(name string) (BVal, bool, error) {
+		for child, scope := n, n.parent; scope != nil; child, scope = scope, scope.parent {
+			field, ok := scope.fields[name]
+			if !ok || field == child {
+				continue
+			}
+			if n.through[name] && field.fields != nil {
+				return &lazyObject{e: e, n: field, path: name, through: n.through}, true, nil
+			}
+			val, err := e.value(field)
+			if err != nil {
+				return nil, false, err
+			}
+			return val, true, nil
+		}
+		if e.params.Env == nil {
+			return nil, false, nil
+		}
+		return e.params.Env.Resolve(name)
+	})
+}
+
+// The value of n as a BVal, evaluating the expressions in it first
+func (e *evaluator) value(n *node) (BVal, error) {
+	switch {
+	case n.isExpr:
+		if cycle := e.findCycle(n); cycle != nil {
+			e.stack[len(e.stack)-1].cycle = cycle
+			return nil, cycle
+		}
+		e.eval(n)
+		if n.err != nil {
+			return nil, fmt.Errorf("%s: %w", n.pointer, graph.ErrDependencyFailed)
+		}
+		return n.result, nil
+	case n.fields != nil:
+		obj := make(BObj, len(n.fields))
+		for _, key := range n.keys {
+			val, err := e.value(n.fields[key])
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = val
+		}
+		return obj, nil
+	case n.elems != nil:
+		arr := make(BArray, len(n.elems))
+		for i, elem := range n.elems {
+			val, err := e.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = val
+		}
+		return arr, nil
+	default:
+		return FromGo(n.val)
+	}
+}
+
+// An object in the document that an expression only gets fields of, like a in a.b.c. Unlike a BObj, the
+// expressions in it are only evaluated when their field is, so that a.b.c doesn't need every other field of a.
+// It never escapes into the expression, since all it's used for is getting fields.
+type lazyObject struct {
+	HostValue
+	e *evaluator
+	n *node
+	// The path from the variable to the object, e.g. a.b, and the through paths of the expression
+	path    string
+	through map[string]bool
+}
+
+func (o *lazyObject) String() string   { return "{...}" }
+func (o *lazyObject) Typename() string { return "object" }
+
+func (o *lazyObject) GetAttr(name string) (BVal, bool, error) {
+	field, ok := o.n.fields[name]
+	if !ok {
+		return nil, false, nil
+	}
+	path := o.path + "." + name
+	if o.through[path] && field.fields != nil {
+		return &lazyObject{e: o.e, n: field, path: path, through: o.through}, true, nil
+	}
+	val, err := o.e.value(field)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// Returns the variables and fields that the expression in src only gets fields of. For a.b.c + len(a.d), that's
+// a and a.b, but not a.d, which is used as a whole, or a.b.c, which is the value being fetched.
+// These can be resolved lazily, see lazyObject.
+func throughPaths(src string) map[string]bool {
+	expr, err := parser.ParseString(src)
+	if err != nil {
+		return nil
+	}
+	refs := compiler.References(expr)
+	// Each use of a variable in a field path, like a in a.b, is also a use of that field path
+	usesInPaths := make(map[string]int)
+	whole := make(map[string]bool)
+	through := make(map[string]bool)
+	for _, field := range refs.Fields {
+		whole[field.Name] = true
+		parts := strings.Split(field.Name, ".")
+		usesInPaths[parts[0]] += len(field.Spans)
+		for i := 1; i < len(parts); i++ {
+			through[strings.Join(parts[:i], ".")] = true
+		}
+	}
+	for _, variable := range refs.Variables {
+		if len(variable.Spans) > usesInPaths[variable.Name] {
+			whole[variable.Name] = true
+		}
+	}
+	for path := range whole {
+		delete(through, path)
+	}
+	return through
+}
+
+// The document with the results of its expressions, as values that encoding/json can encode
+func (e *evaluator) output(n *node) (any, error) {
+	switch {
+	case n.isExpr:
+		var result any
+		if err := ToGo(n.result, &result); err != nil {
+			return nil, Errors{{Pointer: n.pointer, Err: err}}
+		}
+		if typename, ok := notJSON(result); ok {
+			err := &runtime.TypeError{Reason: typename + " cannot be converted to JSON"}
+			return nil, Errors{{Pointer: n.pointer, Err: err}}
+		}
+		return result, nil
+	case n.fields != nil:
+		obj := make(map[string]any, len(n.fields))
+		for _, key := range n.keys {
+			val, err := e.output(n.fields[key])
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = val
+		}
+		return obj, nil
+	case n.elems != nil:
+		arr := make([]any, len(n.elems))
+		for i, elem := range n.elems {
+			val, err := e.output(elem)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = val
+		}
+		return arr, nil
+	default:
+		return n.val, nil
+	}
+}
+
+// Finds values that have no JSON equivalent, like functions, which ToGo leaves as BVals, and NaN
+func notJSON(val any) (string, bool) {
+	switch val := val.(type) {
+	case BVal:
+		return val.Typename(), true
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return strconv.FormatFloat(val, 'g', -1, 64), true
+		}
+	case map[string]any:
+		for _, x := range val {
+			if typename, ok := notJSON(x); ok {
+				return typename, true
+			}
+		}
+	case []any:
+		for _, x := range val {
+			if typename, ok := notJSON(x); ok {
+				return typename, true
+			}
+		}
+	}
+	return "", false
+}
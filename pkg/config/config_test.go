@@ -0,0 +1,176 @@
+package config_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/config"
+	"github.com/thomastay/expression_language/pkg/graph"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/vm"
+)
+
+func TestEval(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	tests := []struct {
+		doc, expected string
+	}{
+		{`{"radius": 3, "circumference": "=2 * radius * 3", "area": {"$expr": "radius * radius * 3"}}`,
+			`{"area":27,"circumference":18,"radius":3}`},
+		// Fields can use fields that come after them
+		{`{"b": "=a + 1", "a": "=1.5 * 2"}`, `{"a":3,"b":4}`},
+		// Inner fields shadow outer ones, and a field doesn't see itself
+		{`{"timeout": 10, "slow": {"timeout": "=timeout * 2", "retries": "=timeout // 5"}}`,
+			`{"slow":{"retries":4,"timeout":20},"timeout":10}`},
+		// Fields of ancestors are in scope through arrays
+		{`{"host": "db", "replicas": [{"url": "='{}-1'.format(host)"}, "=host + '-2'"]}`,
+			`{"host":"db","replicas":[{"url":"db-1"},"db-2"]}`},
+		// Siblings that are objects and arrays can be used, with their expressions evaluated
+		{`{"limits": {"cpu": "=2 * 2", "mem": 8}, "total": "=limits.cpu + limits.mem", "n": "=len(ports)", "ports": [80, "=80 + 363"]}`,
+			`{"limits":{"cpu":4,"mem":8},"n":2,"ports":[80,443],"total":12}`},
+		// Results are never evaluated again
+		{`{"s": "='=1 + 1'", "obj": "=json.parse('{\"a\": [1, null]}')"}`, `{"obj":{"a":[1,null]},"s":"=1 + 1"}`},
+		{`"=1 + 2"`, `3`},
+		{`{"$expr": "'a'", "other": 1}`, `{"$expr":"'a'","other":1}`},
+	}
+	for _, tt := range tests {
+		result, err := config.Eval(&m, []byte(tt.doc), config.Params{})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.doc, err)
+			continue
+		}
+		if string(result) != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.doc, tt.expected, result)
+		}
+	}
+}
+
+func TestEnvAndConvention(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	var doc any
+	if err := json.Unmarshal([]byte(`{"region": "eu", "url": "$ '{}.{}.example.com'.format(env, region)", "note": "=literal"}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.EvalValue(context.Background(), &m, doc, config.Params{
+		Convention: config.Prefix("$ "),
+		Env:        vm.VMEnv{"env": BStr("prod"), "region": BStr("us")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"region": "eu", "url": "prod.eu.example.com", "note": "=literal"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	_, err := config.Eval(&m, []byte(`{
+		"a": "=1 // zero",
+		"b": {"c/d": "=a + 1"},
+		"list": [1, "=(1", {"$expr": "missing"}],
+		"ok": "=2"
+	}`), config.Params{Env: vm.VMEnv{"zero": BInt(0)}})
+	var errs config.Errors
+	if !errors.As(err, &errs) || len(errs) != 4 {
+		t.Fatalf("Expected 4 errors, got %v", err)
+	}
+	pointers := make([]string, len(errs))
+	for i, err := range errs {
+		pointers[i] = err.Pointer
+	}
+	if expected := []string{"/a", "/b/c~1d", "/list/1", "/list/2"}; !reflect.DeepEqual(pointers, expected) {
+		t.Errorf("Expected errors at %v, got %v", expected, pointers)
+	}
+	if !errors.Is(errs[0], runtime.ErrDivByZero) {
+		t.Errorf("Expected /a to divide by zero, got %v", errs[0])
+	}
+	if !errors.Is(errs[1], graph.ErrDependencyFailed) {
+		t.Errorf("Expected /b/c~1d to fail because /a did, got %v", errs[1])
+	}
+	var nameErr *runtime.NameError
+	if !errors.As(errs[3], &nameErr) {
+		t.Errorf("Expected a NameError, got %v", errs[3])
+	}
+
+	_, err = config.Eval(&m, []byte(`{"f": "=len"}`), config.Params{})
+	if err == nil || err.Error() != "/f: TypeError: function cannot be converted to JSON" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	tests := []struct {
+		doc    string
+		closer string
+		path   []string
+	}{
+		{`{"a": "=a + 1"}`, "", nil},
+		{`{"a": "=b", "b": {"c": "=a"}}`, "/b/c", []string{"/a", "/b/c", "/a"}},
+		{`{"x": 1, "y": "=z + x", "z": "=y"}`, "/z", []string{"/y", "/z", "/y"}},
+		{`{"a": "=self", "self": "=a"}`, "/self", []string{"/a", "/self", "/a"}},
+		{`{"a": {"b": "=c"}, "c": "=a"}`, "/c", []string{"/a/b", "/c", "/a/b"}},
+	}
+	for _, tt := range tests {
+		_, err := config.Eval(&m, []byte(tt.doc), config.Params{})
+		var errs config.Errors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: expected errors, got %v", tt.doc, err)
+			continue
+		}
+		if tt.path == nil {
+			// A field doesn't see itself, so a is just undefined
+			var nameErr *runtime.NameError
+			if !errors.As(errs[0], &nameErr) {
+				t.Errorf("%s: expected a NameError, got %v", tt.doc, err)
+			}
+			continue
+		}
+		// Every field in the cycle fails, but only the one that closed it reports the cycle
+		if len(errs) != len(tt.path)-1 {
+			t.Errorf("%s: expected %d errors, got %v", tt.doc, len(tt.path)-1, err)
+		}
+		for _, err := range errs {
+			var cycleErr *graph.CycleError
+			if err.Pointer != tt.closer {
+				if !errors.Is(err, graph.ErrDependencyFailed) || errors.As(err, &cycleErr) {
+					t.Errorf("%s: expected %s to fail because of a dependency, got %v", tt.doc, err.Pointer, err)
+				}
+				continue
+			}
+			if !errors.As(err, &cycleErr) || !reflect.DeepEqual(cycleErr.Path, tt.path) {
+				t.Errorf("%s: expected a cycle %v, got %v", tt.doc, tt.path, err)
+			}
+		}
+	}
+
+	// Getting a field of an object only evaluates that field, so these aren't cycles
+	okTests := []struct {
+		doc      string
+		expected string
+	}{
+		{`{"a": {"x": "=b", "y": 1}, "b": "=a.y"}`, `{"a":{"x":1,"y":1},"b":1}`},
+		{`{"a": {"b": {"c": "=d", "e": 1}}, "d": "=a.b.e + 1"}`, `{"a":{"b":{"c":2,"e":1}},"d":2}`},
+		// Objects that are used as a whole are still evaluated first
+		{`{"a": {"x": "=1", "y": 2}, "n": "=len(a) + a.x"}`, `{"a":{"x":1,"y":2},"n":3}`},
+	}
+	for _, tt := range okTests {
+		out, err := config.Eval(&m, []byte(tt.doc), config.Params{})
+		if err != nil || string(out) != tt.expected {
+			t.Errorf("%s: expected %s, got %s, %v", tt.doc, tt.expected, out, err)
+		}
+	}
+	_, err := config.Eval(&m, []byte(`{"a": {"x": "=b", "y": 1}, "b": "=a.x + len(a)"}`), config.Params{})
+	var errs config.Errors
+	var cycleErr *graph.CycleError
+	if !errors.As(err, &errs) || len(errs) != 2 || !errors.As(errs[1], &cycleErr) {
+		t.Errorf("Expected a cycle when the whole object is used, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+// Package graph evaluates a set of named expressions that can refer to each other, like the fields of the
+// JSON object in the README:
+//
+//	results, err := graph.Eval(&m, map[string]string{
+//		"circumference": "3.14158 * radius * 2",
+//		"area":          "3.14158 * radius * radius",
+//		"ratio":         "area / circumference",
+//	}, vm.VMEnv{"radius": bytecode.BInt(3)})
+//
+// Each expression is evaluated after the expressions that it uses, and expressions that don't depend on each
+// other are evaluated in parallel.
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/compiler"
+	"github.com/thomastay/expression_language/pkg/parser"
+	"github.com/thomastay/expression_language/pkg/vm"
+)
+
+// Returned for expressions that weren't evaluated because an expression they use failed
+var ErrDependencyFailed = errors.New("a dependency failed")
+
+// Returned by New if expressions depend on each other in a cycle
+type CycleError struct {
+	// The names in the cycle, starting and ending with the same name, e.g. [a b a]
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return "CycleError: " + strings.Join(e.Path, " -> ")
+}
+
+// An error in one of the expressions
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// Every expression that failed to compile or evaluate, sorted by key
+type Errors []*KeyError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// A compiled set of named expressions. It is safe to evaluate from many goroutines at once
+type Graph struct {
+	// The most expressions evaluated at once. Defaults to runtime.GOMAXPROCS(0)
+	Parallelism int
+	keys        []string
+	nodes       map[string]*node
+}
+
+type node struct {
+	program *vm.Program
+	// The other expressions that this one uses, sorted
+	deps []string
+}
+
+// Compiles the expressions with m, and works out which ones use each other. Expressions use each other by name,
+// and their names shadow the variables in the env that the graph is evaluated with.
+// Returns Errors if any expression fails to compile, or a *CycleError if the expressions depend on each other
+// in a cycle.
+func New(m *vm.VMState, exprs map[string]string) (*Graph, error) {
+	g := &Graph{nodes: make(map[string]*node, len(exprs))}
+	for key := range exprs {
+		g.keys = append(g.keys, key)
+	}
+	sort.Strings(g.keys)
+
+	var errs Errors
+	for _, key := range g.keys {
+		program, err := m.Compile(exprs[key])
+		if err != nil {
+			errs = append(errs, &KeyError{Key: key, Err: err})
+			continue
+		}
+		// The expression compiled, so it parses too
+		expr, err := parser.ParseString(exprs[key])
+		if err != nil {
+			errs = append(errs, &KeyError{Key: key, Err: err})
+			continue
+		}
+		n := &node{program: program}
+		for _, ref := range compiler.References(expr).Variables {
+			if _, ok := exprs[ref.Name]; ok {
+				n.deps = append(n.deps, ref.Name)
+			}
+		}
+		sort.Strings(n.deps)
+		g.nodes[key] = n
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, &CycleError{Path: cycle}
+	}
+	return g, nil
+}
+
+// Returns the first cycle found, or nil if there are none
+func (g *Graph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(g.keys))
+	var path []string
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		switch state[key] {
+		case visited:
+			return nil
+		case visiting:
+			// key is on the path, so the cycle is from there to here
+			for i, k := range path {
+				if k == key {
+					return append(append([]string(nil), path[i:]...), key)
+				}
+			}
+		}
+		state[key] = visiting
+		path = append(path, key)
+		for _, dep := range g.nodes[key].deps {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = visited
+		return nil
+	}
+	for _, key := range g.keys {
+		if cycle := visit(key); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// The names of the expressions, sorted
+func (g *Graph) Keys() []string {
+	return append([]string(nil), g.keys...)
+}
+
+// The names of the other expressions that an expression uses, sorted
+func (g *Graph) Deps(key string) []string {
+	n, ok := g.nodes[key]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), n.deps...)
+}
+
+// Evaluates every expression with env, after the expressions that it uses. Returns the results of the
+// expressions that succeeded, and Errors for the ones that didn't. Expressions that use one that failed
+// aren't evaluated, and fail with ErrDependencyFailed.
+//
+// env is used from many goroutines at once, so it must be safe to use concurrently.
+func (g *Graph) Eval(ctx context.Context, env vm.Resolver) (map[string]BVal, error) {
+	parallelism := g.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	sem := make(chan struct{}, parallelism)
+
+	var mu sync.Mutex
+	results := make(map[string]BVal, len(g.keys))
+	var errs Errors
+	done := make(map[string]chan struct{}, len(g.keys))
+	for _, key := range g.keys {
+		done[key] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range g.keys {
+		wg.Add(1)
+		go func(key string, n *node) {
+			defer wg.Done()
+			defer close(done[key])
+			for _, dep := range n.deps {
+				<-done[dep]
+			}
+
+			mu.Lock()
+			var failed bool
+			for _, dep := range n.deps {
+				if _, ok := results[dep]; !ok {
+					failed = true
+				}
+			}
+			if failed {
+				errs = append(errs, &KeyError{Key: key, Err: ErrDependencyFailed})
+			}
+			mu.Unlock()
+			if failed {
+				return
+			}
+
+			sem <- struct{}{}
+			result, err := n.program.EvalContext(ctx, g.resolver(env, results, &mu))
+			<-sem
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, &KeyError{Key: key, Err: err})
+				return
+			}
+			results[key] = result.Val
+		}(key, g.nodes[key])
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+		return results, errs
+	}
+	return results, nil
+}
+
+// Resolves the names of expressions to their results, and everything else with env
+func (g *Graph) resolver(env vm.Resolver, results map[string]BVal, mu *sync.Mutex) vm.Resolver {
+	return vm.ResolverFunc(func(name string) (BVal, bool, error) {
+		if _, ok := g.nodes[name]; ok {
+			mu.Lock()
+			defer mu.Unlock()
+			val, ok := results[name]
+			return val, ok, nil
+		}
+		if env == nil {
+			return nil, false, nil
+		}
+		return env.Resolve(name)
+	})
+}
+
+// Compiles and evaluates exprs, see New and Graph.Eval
+func Eval(m *vm.VMState, exprs map[string]string, env vm.Resolver) (map[string]BVal, error) {
+	g, err := New(m, exprs)
+	if err != nil {
+		return nil, err
+	}
+	return g.Eval(context.Background(), env)
+}
@@ -0,0 +1,161 @@
+package graph_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/graph"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/vm"
+)
+
+func TestEval(t *testing.T) {
+	m := vm.New(vm.Params{})
+	results, err := graph.Eval(&m, map[string]string{
+		"circumference": "2 * radius * 3",
+		"area":          "radius * radius * 3",
+		"ratio":         "area // circumference",
+		"label":         "ratio > 0 ? 'big' : 'small'",
+		// Expressions shadow the env
+		"shadowed": "1",
+		"uses":     "shadowed + 1",
+	}, vm.VMEnv{"radius": BInt(4), "shadowed": BInt(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]BVal{
+		"circumference": BInt(24),
+		"area":          BInt(48),
+		"ratio":         BInt(2),
+		"label":         BStr("big"),
+		"shadowed":      BInt(1),
+		"uses":          BInt(2),
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestDeps(t *testing.T) {
+	m := vm.New(vm.Params{})
+	g, err := graph.New(&m, map[string]string{
+		"a": "b + c.d + x",
+		"b": "c.d",
+		"c": "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := g.Deps("a"); !reflect.DeepEqual(deps, []string{"b", "c"}) {
+		t.Errorf("Unexpected deps %v", deps)
+	}
+	if deps := g.Deps("c"); len(deps) != 0 {
+		t.Errorf("Unexpected deps %v", deps)
+	}
+	if keys := g.Keys(); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	m := vm.New(vm.Params{})
+	tests := []struct {
+		exprs map[string]string
+		path  []string
+	}{
+		{map[string]string{"a": "a + 1"}, []string{"a", "a"}},
+		{map[string]string{"a": "b", "b": "c ? 1 : d", "c": "true", "d": "a"}, []string{"a", "b", "d", "a"}},
+		{map[string]string{"x": "1", "y": "z + x", "z": "y"}, []string{"y", "z", "y"}},
+	}
+	for _, tt := range tests {
+		_, err := graph.New(&m, tt.exprs)
+		var cycleErr *graph.CycleError
+		if !errors.As(err, &cycleErr) || !reflect.DeepEqual(cycleErr.Path, tt.path) {
+			t.Errorf("%v: expected a cycle %v, got %v", tt.exprs, tt.path, err)
+		}
+	}
+	_, err := graph.New(&m, map[string]string{"a": "b", "b": "a"})
+	if err == nil || err.Error() != "CycleError: a -> b -> a" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	m := vm.New(vm.Params{})
+	_, err := graph.New(&m, map[string]string{"a": "1 +", "b": "2", "c": "(1"})
+	var errs graph.Errors
+	if !errors.As(err, &errs) || len(errs) != 2 || errs[0].Key != "a" || errs[1].Key != "c" {
+		t.Fatalf("Expected compile errors in a and c, got %v", err)
+	}
+
+	results, err := graph.Eval(&m, map[string]string{
+		"a": "1 // zero",
+		"b": "a + 1",
+		"c": "b + 1",
+		"d": "2",
+	}, vm.VMEnv{"zero": BInt(0)})
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", err)
+	}
+	if errs[0].Key != "a" || !errors.Is(errs[0], runtime.ErrDivByZero) {
+		t.Errorf("Expected a to divide by zero, got %v", errs[0])
+	}
+	if errs[1].Key != "b" || !errors.Is(errs[1], graph.ErrDependencyFailed) || errs[2].Key != "c" {
+		t.Errorf("Expected b and c to be skipped, got %v", errs)
+	}
+	if !reflect.DeepEqual(results, map[string]BVal{"d": BInt(2)}) {
+		t.Errorf("Expected the results that succeeded, got %v", results)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var running, maxRunning int32
+	slow := vm.WrapFn("slow", func(x int) int {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return x
+	})
+	exprs := map[string]string{
+		"a":   "slow(1)",
+		"b":   "slow(2)",
+		"c":   "slow(3)",
+		"sum": "slow(a + b + c)",
+	}
+	m := vm.New(vm.Params{})
+	g, err := graph.New(&m, exprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Parallelism = 3
+	results, err := g.Eval(context.Background(), vm.VMEnv{"slow": slow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results["sum"] != BInt(6) {
+		t.Errorf("Expected 6, got %v", results["sum"])
+	}
+	if maxRunning != 3 {
+		t.Errorf("Expected a, b and c to run at once, got %d at most", maxRunning)
+	}
+
+	g.Parallelism = 1
+	atomic.StoreInt32(&maxRunning, 0)
+	if _, err := g.Eval(context.Background(), vm.VMEnv{"slow": slow}); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning != 1 {
+		t.Errorf("Expected one expression at a time, got %d at most", maxRunning)
+	}
+}
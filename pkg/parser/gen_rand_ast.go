@@ -143,11 +143,11 @@ func genRandomASTRec(rand *Rand, depthLeft uint) Expr {
 		}
 	case 7:
 		arrLen := rand.randU32() % uint32(maxArraySize)
-		arr := make([]Expr, arrLen)
+		arr := make(ExprList, arrLen)
 		for i := 0; i < int(arrLen); i++ {
 			arr[i] = genRandomASTRec(rand, depthLeft-1)
 		}
-		return (*EArray)(&arr)
+		return &EArray{Exprs: arr}
 	}
 	panic("Not impl")
 }
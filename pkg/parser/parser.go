@@ -4,15 +4,56 @@ package parser
 // https://matklad.github.io/2020/04/13/simple-but-powerful-pratt-parsing.html
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
-	"errors"
-
 	"github.com/alecthomas/participle/v2/lexer"
 	. "github.com/thomastay/expression_language/pkg/ast"
 )
 
+// A syntax error that the parser found at Token
+type SyntaxError struct {
+	Msg   string
+	Token *lexer.Token
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// Returned by ParseString. Lists every syntax error in Source, in the order they were found
+type SyntaxErrors struct {
+	Source string
+	Errs   []*SyntaxError
+}
+
+// Points at each error in the source, e.g.
+//
+//	Infix operator must have an expression in RHS
+//	 | f(1 +, 2)
+//	 |      ^---
+func (e *SyntaxErrors) Error() string {
+	lines := strings.Split(e.Source, "\n")
+	var b strings.Builder
+	for _, err := range e.Errs {
+		pos := err.Token.Pos
+		line := e.Source
+		if pos.Line >= 1 && pos.Line <= len(lines) {
+			line = lines[pos.Line-1]
+		}
+		indent := ""
+		if pos.Column > 1 {
+			indent = strings.Repeat(" ", pos.Column-1)
+		}
+		fmt.Fprintf(&b, "%s\n | %s\n | %s^---\n", err.Msg, line, indent)
+	}
+	return b.String()
+}
+
+// Parses an expression. If it has syntax errors, ParseString keeps going after each one where it can, so that it
+// can report all of them at once as a *SyntaxErrors. The parts of the expression that couldn't be parsed are
+// replaced by EBad nodes in the returned tree, which can be nil if the parser couldn't recover.
 func ParseString(s string) (Expr, error) {
 	genLexer, err := Lexer.Lex("memory", strings.NewReader(s))
 	if err != nil {
@@ -20,66 +61,130 @@ func ParseString(s string) (Expr, error) {
 	}
 	peekLexer, err := lexer.Upgrade(genLexer, Lexer.Symbols()["whitespace"])
 	if err != nil {
+		// Implemented by the errors of participle and its lexers
+		var lexErr interface {
+			error
+			Message() string
+			Position() lexer.Position
+		}
+		if errors.As(err, &lexErr) {
+			syntaxErr := &SyntaxError{Msg: lexErr.Message(), Token: &lexer.Token{Pos: lexErr.Position()}}
+			return nil, &SyntaxErrors{Source: s, Errs: []*SyntaxError{syntaxErr}}
+		}
 		return nil, err
 	}
-	sexpr, err := parseExpr(peekLexer, 0)
+	p := parser{lex: peekLexer}
+	sexpr, err := p.parseExpr(0)
 	if err != nil {
-		return sexpr, fmt.Errorf(`%w
- | %s
- | %s^--- Parser stopped here
-`, err, s, strings.Repeat(" ", peekLexer.Peek().Pos.Column-1))
+		p.report(err)
+	} else if t := p.lex.Peek(); t.Type != lexer.EOF {
+		// Possible that exprBP doesn't parse all the string, so check that we've fully consumed everything
+		p.report(p.errorf(t, "Unparsed character %s at end of Parse.", t))
 	}
+	if len(p.errs) > 0 {
+		return sexpr, &SyntaxErrors{Source: s, Errs: p.errs}
+	}
+	return sexpr, nil
+}
 
-	// Possible that exprBP doesn't parse all the string, so check that we've fully consumed everything
-	t := peekLexer.Peek()
-	switch t.Type {
-	case lexer.EOF:
-		return sexpr, nil
-	default:
-		return sexpr, errors.New(fmt.Sprintf(`Unparsed character %s at end of Parse.
- | %s
- | %s^--- Parser stopped here
-`, t, s, strings.Repeat(" ", t.Pos.Column-1)))
+type parser struct {
+	lex *lexer.PeekingLexer
+	// Syntax errors that the parser recovered from
+	errs []*SyntaxError
+}
+
+func (p *parser) errorf(tok *lexer.Token, format string, xs ...any) *SyntaxError {
+	return &SyntaxError{Msg: fmt.Sprintf(format, xs...), Token: tok}
+}
+
+// An error at the next token
+func (p *parser) errorHere(format string, xs ...any) *SyntaxError {
+	return p.errorf(p.lex.Peek(), format, xs...)
+}
+
+func (p *parser) report(err error) {
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		syntaxErr = p.errorHere("%s", err)
+	}
+	p.errs = append(p.errs, syntaxErr)
+}
+
+// Recovers from a syntax error by skipping ahead to the next delimiter that isn't nested in brackets.
+// If that's one of delims, the error is reported and an EBad for the skipped tokens is returned,
+// leaving the delimiter as the next token. Otherwise the error should be returned to the enclosing
+// expression, which can try to recover at its own delimiters.
+// Commas and closing brackets always end the search, since they can't be skipped without
+// taking away a delimiter from the enclosing expression.
+func (p *parser) recoverAt(err error, delims ...string) (*EBad, bool) {
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		syntaxErr = p.errorHere("%s", err)
+	}
+	bad := &EBad{Start: syntaxErr.Token, End: syntaxErr.Token}
+	depth := 0
+	for {
+		t := p.lex.Peek()
+		if t.Type == lexer.EOF {
+			return nil, false
+		}
+		isOpen := t.Type == TokSquareOpen || (t.Type == TokOp && t.Value == "(")
+		isClose := t.Type == TokSquareClose || (t.Type == TokEndExpr && t.Value == ")")
+		isDelim := isClose || t.Value == "," || t.Value == ":"
+		if depth == 0 && isDelim {
+			for _, delim := range delims {
+				if t.Value == delim {
+					p.report(syntaxErr)
+					return bad, true
+				}
+			}
+			if t.Value != ":" {
+				return nil, false
+			}
+		}
+		if isOpen {
+			depth++
+		} else if isClose {
+			depth--
+		}
+		bad.End = p.lex.Next()
 	}
 }
 
 // Parsing
-func parseExpr(lex *lexer.PeekingLexer, minBP int) (Expr, error) {
+func (p *parser) parseExpr(minBP int) (Expr, error) {
 	var lhs Expr
 	var err error
-	firstVal := lex.Peek()
+	firstVal := p.lex.Peek()
 	switch firstVal.Type {
 	case TokEndExpr, TokSquareClose:
 		return nil, nil
 	case TokSquareOpen:
 		// Probably an array. Note: we assign it a different name to be able to
 		// check for nil (since typed nils are NOT nil)
-		arr, err := parseArray(lex, firstVal)
+		arr, err := p.parseArray()
 		if err != nil {
 			return lhs, err
 		}
-		if arr == nil {
-			return nil, errors.New("Array index operator must have an expression inside")
-		}
 		lhs = arr
 	case TokOp:
-		lhs, err = parsePrefix(lex, firstVal)
+		lhs, err = p.parsePrefix(firstVal)
 		if err != nil {
 			return lhs, err
 		}
 	// Note that we don't do any parsing of these tokens to validate or strconv them
 	// We do this later on in the semantic analysis, which lets us do things like limit the size of integers, etc
-	// Also lets us report multiple errors. Fundamentally our assumption is that the parser only returns one error
+	// Also lets us report multiple errors. The parser recovers from syntax errors at delimiters, see recoverAt
 	case TokIdent, TokInt, TokHexInt, TokBinInt, TokOctInt, TokFloat, TokBool, TokSingleString:
-		lex.Next()
+		p.lex.Next()
 		lhs = &EValue{Val: firstVal}
 	default:
-		return nil, fmt.Errorf("Unrecognized token %s", firstVal)
+		return nil, p.errorHere("Unrecognized token %s", firstVal)
 	}
 
 Loop:
 	for {
-		op := lex.Peek()
+		op := p.lex.Peek()
 		switch op.Type {
 		case TokOp, TokSquareOpen:
 			// do nothing, continue
@@ -88,7 +193,7 @@ Loop:
 		case TokEndExpr, TokSquareClose:
 			break Loop
 		default:
-			return nil, fmt.Errorf("Unrecognized token %s", op)
+			return nil, p.errorHere("Unrecognized token %s", op)
 		}
 		// optional postfix op
 		if lp, ok := postFixBP[op.Value]; ok {
@@ -96,8 +201,8 @@ Loop:
 				break
 			}
 			// Skip the operator token
-			lex.Next()
-			lhs, err = parsePostfix(lhs, lex, op, firstVal)
+			p.lex.Next()
+			lhs, err = p.parsePostfix(lhs, op, firstVal)
 			if err != nil {
 				return lhs, err
 			}
@@ -111,8 +216,8 @@ Loop:
 				break
 			}
 			// Skip the operator token
-			lex.Next()
-			lhs, err = parseInfix(lhs, lex, op, rp)
+			p.lex.Next()
+			lhs, err = p.parseInfix(lhs, op, rp)
 			if err != nil {
 				return lhs, err
 			}
@@ -123,113 +228,122 @@ Loop:
 	return lhs, nil
 }
 
-func parsePrefix(lex *lexer.PeekingLexer, op *lexer.Token) (Expr, error) {
+func (p *parser) parsePrefix(op *lexer.Token) (Expr, error) {
 	var lhs Expr
 	var err error
 	if op.Value == "(" {
 		// Handle parenthesis
-		lex.Next()
-		lhs, err = parseExpr(lex, 0)
-		if err != nil {
-			return nil, err
+		p.lex.Next()
+		lhs, err = p.parseExpr(0)
+		if err == nil && lhs == nil {
+			err = p.errorHere("Prefix operator must have an expression after")
 		}
-		if lhs == nil {
-			return nil, errors.New("Prefix operator must have an expression after")
-		}
-		end := lex.Next()
-		switch end.Type {
-		case TokEndExpr:
-			if end.Value != ")" {
-				return lhs, errors.New("Unmatched (")
+		if err != nil {
+			bad, ok := p.recoverAt(err, ")")
+			if !ok {
+				return nil, err
 			}
-		default:
-			return lhs, errors.New("Unmatched (")
+			lhs = bad
 		}
+		end := p.lex.Peek()
+		if end.Type != TokEndExpr || end.Value != ")" {
+			return lhs, p.errorf(op, "Unmatched (")
+		}
+		p.lex.Next()
 	} else {
 		// general operator
 		if rp, ok := prefixBP[op.Value]; ok {
-			lex.Next()
-			rhs, err := parseExpr(lex, rp)
+			p.lex.Next()
+			rhs, err := p.parseExpr(rp)
 			if err != nil {
 				return nil, err
 			}
 			if rhs == nil {
-				return nil, errors.New("Prefix operator must have an expression after")
+				return nil, p.errorHere("Prefix operator must have an expression after")
 			}
 			lhs = &EUnOp{
 				Op:  op,
 				Val: rhs,
 			}
 		} else {
-			return lhs, fmt.Errorf("Unrecognized prefix operator %s", op.Value)
+			return lhs, p.errorHere("Unrecognized prefix operator %s", op.Value)
 		}
 	}
-	return lhs, err
+	return lhs, nil
 }
 
-func parseArray(lex *lexer.PeekingLexer, op *lexer.Token) (*EArray, error) {
-	var arr []Expr
-	lex.Next() // consume token
+func (p *parser) parseArray() (*EArray, error) {
+	var arr ExprList
+	open := p.lex.Next() // consume token
 	for {
-		param, err := parseExpr(lex, 0)
+		param, err := p.parseExpr(0)
 		if err != nil {
-			return nil, err
+			bad, ok := p.recoverAt(err, ",", "]")
+			if !ok {
+				return nil, err
+			}
+			param = bad
 		}
 		if param != nil {
 			arr = append(arr, param)
 		}
-		op := lex.Peek()
-		switch op.Type {
-		case TokSquareClose:
-			lex.Next()
-			return (*EArray)(&arr), nil
-		case TokEndExpr:
-			switch op.Value {
-			case ",":
-				lex.Next()
-				continue
-			default:
-				return nil, fmt.Errorf("Unrecognized end of expression in Array: %s", op)
-			}
+		op := p.lex.Peek()
+		switch {
+		case op.Type == TokSquareClose:
+			return &EArray{Exprs: arr, Open: open, Close: p.lex.Next()}, nil
+		case op.Type == TokEndExpr && op.Value == ",":
+			p.lex.Next()
+			continue
+		case op.Type == lexer.EOF:
+			return nil, p.errorf(open, "Unmatched [")
 		default:
-			return nil, fmt.Errorf("Unrecognized token in parsing param list: %s", op)
+			err := p.errorHere("Unrecognized token in Array: %s", op)
+			bad, ok := p.recoverAt(err, ",", "]")
+			if !ok {
+				return nil, err
+			}
+			arr = append(arr, bad)
 		}
 	}
 }
 
-func parsePostfix(lhs Expr, lex *lexer.PeekingLexer, op *lexer.Token, lhsIdent *lexer.Token) (Expr, error) {
+func (p *parser) parsePostfix(lhs Expr, op *lexer.Token, lhsIdent *lexer.Token) (Expr, error) {
 	switch op.Value {
 	case "[":
 		// Array indexing
-		inner, err := parseExpr(lex, 0)
-		if err != nil {
-			return nil, err
+		inner, err := p.parseExpr(0)
+		if err == nil && inner == nil {
+			err = p.errorHere("Array index operator must have an expression inside")
 		}
-		if inner == nil {
-			return nil, errors.New("Array index operator must have an expression inside")
+		if err != nil {
+			bad, ok := p.recoverAt(err, "]")
+			if !ok {
+				return nil, err
+			}
+			inner = bad
 		}
-		end := lex.Peek()
+		end := p.lex.Peek()
 		switch end.Type {
 		case TokSquareClose:
 			// Do nothing
 		default:
-			return lhs, errors.New("Unmatched [")
+			return lhs, p.errorf(op, "Unmatched [")
 		}
-		lex.Next()
 		lhs = &EIdxAccess{
 			Base:  lhs,
 			Index: inner,
+			Close: p.lex.Next(),
 		}
 	case ".":
 		var err error
 		// Call operator with a base
-		lhs, err = parseCallWithBaseOrFieldAccess(lhs, lex)
+		lhs, err = p.parseCallWithBaseOrFieldAccess(lhs)
 		if err != nil {
 			return nil, err
 		}
 	case "(":
 		// Method call
-		exprList, err := parseExprList(lex)
+		exprList, end, err := p.parseExprList(op)
 		if err != nil {
 			return nil, err
 		}
@@ -237,39 +351,39 @@ func parsePostfix(lhs Expr, lex *lexer.PeekingLexer, op *lexer.Token, lhsIdent *
 			Base:   nil, // No base
 			Method: lhsIdent,
 			Exprs:  exprList,
+			Close:  end,
 		}
 	default:
-		return nil, fmt.Errorf("No other postfix operators %s", op)
+		return nil, p.errorf(op, "No other postfix operators %s", op)
 	}
 	return lhs, nil
 }
 
-func parseInfix(lhs Expr, lex *lexer.PeekingLexer, op *lexer.Token, rp int) (Expr, error) {
+func (p *parser) parseInfix(lhs Expr, op *lexer.Token, rp int) (Expr, error) {
 	if op.Value == "?" {
 		// special case ternaries
-		inner, err := parseExpr(lex, 0)
-		if err != nil {
-			return nil, err
+		inner, err := p.parseExpr(0)
+		if err == nil && inner == nil {
+			err = p.errorHere("Ternary operator must have a then case")
 		}
-		if inner == nil {
-			return nil, errors.New("Ternary operator must have a then case")
-		}
-		end := lex.Peek()
-		switch end.Type {
-		case TokOp:
-			if end.Value != ":" {
-				return lhs, errors.New("Unmatched ?")
+		if err != nil {
+			bad, ok := p.recoverAt(err, ":")
+			if !ok {
+				return nil, err
 			}
-		default:
-			return lhs, errors.New("Unmatched ?")
+			inner = bad
+		}
+		end := p.lex.Peek()
+		if end.Type != TokOp || end.Value != ":" {
+			return lhs, p.errorf(op, "Unmatched ?")
 		}
-		lex.Next()
-		rhs, err := parseExpr(lex, rp)
+		p.lex.Next()
+		rhs, err := p.parseExpr(rp)
 		if err != nil {
 			return nil, err
 		}
 		if rhs == nil {
-			return nil, errors.New("Ternary operator must have an else case")
+			return nil, p.errorHere("Ternary operator must have an else case")
 		}
 		lhs = &ECond{
 			Cond:   lhs,
@@ -277,12 +391,12 @@ func parseInfix(lhs Expr, lex *lexer.PeekingLexer, op *lexer.Token, rp int) (Exp
 			Second: rhs,
 		}
 	} else {
-		rhs, err := parseExpr(lex, rp)
+		rhs, err := p.parseExpr(rp)
 		if err != nil {
 			return nil, err
 		}
 		if rhs == nil {
-			return nil, errors.New("Infix operator must have an expression in RHS")
+			return nil, p.errorHere("Infix operator must have an expression in RHS")
 		}
 		lhs = &EBinOp{
 			Op:    op,
@@ -293,23 +407,21 @@ func parseInfix(lhs Expr, lex *lexer.PeekingLexer, op *lexer.Token, rp int) (Exp
 	return lhs, nil
 }
 
-func parseCallWithBaseOrFieldAccess(base Expr, lex *lexer.PeekingLexer) (Expr, error) {
-	ident := lex.Peek()
+func (p *parser) parseCallWithBaseOrFieldAccess(base Expr) (Expr, error) {
+	ident := p.lex.Peek()
 	switch ident.Type {
 	case TokIdent:
 		// possibly a field access. check if ident is followed by a (
 		// If not, then it's a field access. If so, it's a method call.
 		// A method call is a base.ident, then followed by possible expression list.
-		var exprList ExprList
-		lex.Next()
-		next := lex.Peek()
+		p.lex.Next()
+		next := p.lex.Peek()
 		switch next.Type {
 		case TokOp:
 			if next.Value == "(" {
 				// It is an expression list. Start to parse.
-				lex.Next()
-				var err error
-				exprList, err = parseExprList(lex)
+				p.lex.Next()
+				exprList, end, err := p.parseExprList(next)
 				if err != nil {
 					return nil, err
 				}
@@ -317,6 +429,7 @@ func parseCallWithBaseOrFieldAccess(base Expr, lex *lexer.PeekingLexer) (Expr, e
 					Base:   base,
 					Method: ident,
 					Exprs:  exprList,
+					Close:  end,
 				}, nil
 			}
 			fallthrough
@@ -328,35 +441,41 @@ func parseCallWithBaseOrFieldAccess(base Expr, lex *lexer.PeekingLexer) (Expr, e
 			// fallthrough, do nothing here.
 		}
 	default:
-		return nil, fmt.Errorf("Only identifiers can be used for a method call, found %s", ident)
+		return nil, p.errorHere("Only identifiers can be used for a method call, found %s", ident)
 	}
 }
 
-func parseExprList(lex *lexer.PeekingLexer) (ExprList, error) {
+// Parses the arguments of a call, after the opening paren. Also returns the closing paren
+func (p *parser) parseExprList(open *lexer.Token) (ExprList, *lexer.Token, error) {
 	var exprList ExprList
 	for {
-		param, err := parseExpr(lex, 0)
+		param, err := p.parseExpr(0)
 		if err != nil {
-			return nil, err
+			bad, ok := p.recoverAt(err, ",", ")")
+			if !ok {
+				return nil, nil, err
+			}
+			param = bad
 		}
 		if param != nil {
 			exprList = append(exprList, param)
 		}
-		op := lex.Peek()
-		switch op.Type {
-		case TokEndExpr:
-			switch op.Value {
-			case ",":
-				lex.Next()
-				continue
-			case ")":
-				lex.Next()
-				return exprList, nil
-			default:
-				return nil, fmt.Errorf("Unrecognized end of expression in param list: %s", op)
-			}
+		op := p.lex.Peek()
+		switch {
+		case op.Type == TokEndExpr && op.Value == ",":
+			p.lex.Next()
+			continue
+		case op.Type == TokEndExpr && op.Value == ")":
+			return exprList, p.lex.Next(), nil
+		case op.Type == lexer.EOF:
+			return nil, nil, p.errorf(open, "Unmatched (")
 		default:
-			return nil, fmt.Errorf("Unrecognized token in parsing param list: %s", op)
+			err := p.errorHere("Unrecognized token in parsing param list: %s", op)
+			bad, ok := p.recoverAt(err, ",", ")")
+			if !ok {
+				return nil, nil, err
+			}
+			exprList = append(exprList, bad)
 		}
 	}
 }
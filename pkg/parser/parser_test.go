@@ -1,6 +1,7 @@
 package parser_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -113,3 +114,59 @@ func TestInvalidStrings(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorRecovery(t *testing.T) {
+	type diagnostic struct {
+		msg    string
+		column int
+	}
+	tests := []struct {
+		in   string
+		tree string
+		errs []diagnostic
+	}{
+		{"f(1 +, 2 * , 3)", "f(<bad expression>, <bad expression>, 3)", []diagnostic{
+			{"Infix operator must have an expression in RHS", 6},
+			{"Infix operator must have an expression in RHS", 12},
+		}},
+		{"[1, 2 +, (3 *)]", "[1, <bad expression>, <bad expression>]", []diagnostic{
+			{"Infix operator must have an expression in RHS", 8},
+			{"Infix operator must have an expression in RHS", 14},
+		}},
+		{"x[1 +] + y[2 *]", "(x[<bad expression>] + y[<bad expression>])", []diagnostic{
+			{"Infix operator must have an expression in RHS", 6},
+			{"Infix operator must have an expression in RHS", 15},
+		}},
+		{"a ? b c : d", "(a ? <bad expression> : d)", []diagnostic{
+			{"Unrecognized token c", 7},
+		}},
+		// The ternary can't recover at the comma, so the call does instead
+		{"f(a ? b c, d)", "f(<bad expression>, d)", []diagnostic{
+			{"Unrecognized token c", 9},
+		}},
+		// Errors that can't be recovered from are reported last
+		{"g(1 +, 2) + [1, 2", "", []diagnostic{
+			{"Infix operator must have an expression in RHS", 6},
+			{"Unmatched [", 13},
+		}},
+	}
+	for _, tt := range tests {
+		expr, err := parser.ParseString(tt.in)
+		var syntaxErrs *parser.SyntaxErrors
+		if !errors.As(err, &syntaxErrs) {
+			t.Fatalf("%s: expected SyntaxErrors, got %v", tt.in, err)
+		}
+		if tt.tree != "" && (expr == nil || expr.String() != tt.tree) {
+			t.Errorf("%s: expected the partial tree %s, got %v", tt.in, tt.tree, expr)
+		}
+		if len(syntaxErrs.Errs) != len(tt.errs) {
+			t.Fatalf("%s: expected %d errors, got %d:\n%s", tt.in, len(tt.errs), len(syntaxErrs.Errs), err)
+		}
+		for i, want := range tt.errs {
+			got := syntaxErrs.Errs[i]
+			if got.Msg != want.msg || got.Token.Pos.Column != want.column {
+				t.Errorf("%s: expected error %q at column %d, got %q at column %d", tt.in, want.msg, want.column, got.Msg, got.Token.Pos.Column)
+			}
+		}
+	}
+}
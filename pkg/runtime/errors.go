@@ -3,16 +3,169 @@ package runtime
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/thomastay/expression_language/pkg/bytecode"
 )
 
-// Cache some common errors
-// var errNotEnoughStackValues = errors.New("VMError: Not enough values on stack")
-var errOverflow = errors.New("ArithmeticError: Overflow")
-var errDivByZero = errors.New("ArithmeticError: Divided by zero")
 var ErrOOM = errors.New("Out of Memory")
 
+// Wrapped by ArithmeticError, check for them with errors.Is
+var ErrOverflow = errors.New("Overflow")
+var ErrDivByZero = errors.New("Divided by zero")
+
+// The errors below are returned by the runtime and the VM. Check for them with errors.As:
+//
+//	var typeErr *runtime.TypeError
+//	if errors.As(err, &typeErr) {
+//		fmt.Println(typeErr.Op, typeErr.Operands)
+//	}
+
+// Returned when an operator is applied to values of the wrong type, e.g. 1 + 'a'
+type TypeError struct {
+	// The operator, e.g. "+", "cmp" or "unary -". Subscripts are "[]" and calls are "()"
+	Op string
+	// The types of the operands, from left to right
+	Operands []string
+	// Explains the error if it isn't about the types of the operands, e.g. when a function is passed the wrong
+	// number of arguments
+	Reason string
+}
+
+func (e *TypeError) Error() string {
+	switch {
+	case e.Reason != "":
+		return "TypeError: " + e.Reason
+	case e.Op == "[]" && len(e.Operands) == 2:
+		return fmt.Sprintf("TypeError: %s indices must be integers, not %s", e.Operands[0], e.Operands[1])
+	case e.Op == "[]":
+		return fmt.Sprintf("TypeError: %s object is not subscriptable", strings.Join(e.Operands, ", "))
+	case e.Op == "()":
+		return fmt.Sprintf("TypeError: %s object is not callable", strings.Join(e.Operands, ", "))
+	case len(e.Operands) == 1:
+		return fmt.Sprintf("TypeError: bad operand type for %s: %s", e.Op, e.Operands[0])
+	default:
+		return fmt.Sprintf("TypeError: unsupported operand type(s) for %s: %s", e.Op, strings.Join(e.Operands, " and "))
+	}
+}
+
 func errTypeMismatch(op string, v1 bytecode.BVal, v2 bytecode.BVal) error {
-	return fmt.Errorf("TypeError: unsupported operand type(s) for %s: %s and %s", op, v1.Typename(), v2.Typename())
+	return &TypeError{Op: op, Operands: []string{v1.Typename(), v2.Typename()}}
+}
+
+// Returned when a value has the right type but an invalid value, e.g. sqrt(-1), or a malformed format string
+type ValueError struct {
+	// The function that failed, or "" if the error isn't from a function, e.g. for the % operator
+	Fn     string
+	Reason string
+	// Optionally, an error to check for with errors.Is, e.g. stdlib.ErrEmptyArray
+	Err error
+}
+
+func (e *ValueError) Error() string {
+	if e.Fn == "" {
+		return "ValueError: " + e.Reason
+	}
+	return fmt.Sprintf("ValueError: %s() %s", e.Fn, e.Reason)
+}
+
+func (e *ValueError) Unwrap() error {
+	return e.Err
+}
+
+// Returned when a variable isn't in the env, nor a builtin
+type NameError struct {
+	Name string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("NameError: name %s is not defined", e.Name)
+}
+
+// Returned when a value doesn't have an attribute or method
+type AttributeError struct {
+	// The typename of the value
+	Type string
+	Name string
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("AttributeError: %s object has no attribute %s", e.Type, e.Name)
+}
+
+// Returned when an array index is out of range
+type IndexError struct {
+	Index int
+	Len   int
+	// Explains the error if it isn't about an array, e.g. when a format string uses more arguments than it's given
+	Reason string
+}
+
+func (e *IndexError) Error() string {
+	if e.Reason != "" {
+		return "IndexError: " + e.Reason
+	}
+	return fmt.Sprintf("IndexError: array index %d out of range (len %d)", e.Index, e.Len)
+}
+
+// Returned when an operation overflows or divides by zero. Err is ErrOverflow or ErrDivByZero
+type ArithmeticError struct {
+	// The operator, or the name of the function that failed
+	Op  string
+	Err error
+}
+
+func (e *ArithmeticError) Error() string {
+	return fmt.Sprintf("ArithmeticError: %s in %s", e.Err, e.Op)
+}
+
+func (e *ArithmeticError) Unwrap() error {
+	return e.Err
+}
+
+func errOverflow(op string) error {
+	return &ArithmeticError{Op: op, Err: ErrOverflow}
+}
+
+func errDivByZero(op string) error {
+	return &ArithmeticError{Op: op, Err: ErrDivByZero}
+}
+
+// Wraps errors returned by host functions
+type HostError struct {
+	// The name of the function
+	Fn  string
+	Err error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("RuntimeError: %s", e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// Returned instead of panicking when the compiler or the VM hits a bug, e.g. an AST node or instruction that
+// it doesn't handle. Please report these, along with the expression that caused them.
+type InternalError struct {
+	// The value that was passed to panic
+	Value any
+	// The stack trace of the panic
+	Stack string
+	// The instruction that the VM was executing, or -1 if the panic happened while compiling
+	Pc int
+}
+
+func (e *InternalError) Error() string {
+	if e.Pc < 0 {
+		return fmt.Sprintf("InternalError: %v", e.Value)
+	}
+	return fmt.Sprintf("InternalError: %v at pc %d", e.Value, e.Pc)
+}
+
+// Unwraps the value passed to panic, if it's an error
+func (e *InternalError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
 }
@@ -0,0 +1,592 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+// String formatting, in two flavours borrowed from Python:
+//
+//	'%d items, %.2f each' % [n, price]   printf style, through the % operator
+//	format('{} items, {:.2f} each', n, price)
+//
+// Both share the same set of conversions:
+//
+//	d          int (bools are treated as ints)
+//	x X o b    int in hex, octal or binary. The # flag adds a 0x, 0o or 0b prefix
+//	f F e E g G %   int or float, with a default precision of 6
+//	s          any value, the same as str(x)
+//	r          any value, the same as how the REPL prints it
+//
+// As well as a width, a precision, + and space signs, and 0 padding. Brace fields additionally accept
+// a fill character and alignment (<, >, ^ or =) and a ',' thousands separator, just like Python.
+
+// Widths and precisions larger than this are rejected, so that a tiny format string can't use lots of memory
+const maxFormatWidth = 10000
+
+type fmtSpec struct {
+	fill      rune
+	align     byte // one of '<', '>', '^', '=' or 0 for the default
+	sign      byte // one of '+', ' ', or 0 for the default
+	alt       bool // '#'
+	zero      bool // '0'
+	width     int
+	comma     bool
+	precision int  // -1 for the default
+	typ       byte // 0 for the default
+}
+
+// A format string is parsed into pieces, which are either literal text or fields to be replaced
+type formatPiece struct {
+	literal string
+	isField bool
+	arg     int
+	spec    fmtSpec
+}
+
+func errFormat(format string, xs ...any) error {
+	return &ValueError{Reason: fmt.Sprintf(format, xs...)}
+}
+
+// Converts a value to a string the way str(x) does. Unlike BVal.String(), strings aren't quoted and
+// floats are printed in their shortest representation
+func ToString(val BVal) string {
+	switch v := val.(type) {
+	case BStr:
+		return string(v)
+	case BFloat:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	default:
+		return val.String()
+	}
+}
+
+// ----------------printf style------------------
+
+// Formats a string with the % operator. If args is an array, its elements are the arguments,
+// otherwise args is the only argument.
+func FormatPercent(format string, args BVal) (BVal, error) {
+	pieces, err := parsePercentFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	argList, ok := args.(BArray)
+	if !ok {
+		argList = BArray{args}
+	}
+	numFields := countFields(pieces)
+	if numFields > len(argList) {
+		return nil, errFormatArgs("not enough arguments for format string, expected %d, got %d", numFields, len(argList))
+	}
+	if numFields < len(argList) {
+		return nil, errFormatArgs("not all arguments converted during string formatting, expected %d, got %d", numFields, len(argList))
+	}
+	s, err := applyFormat(pieces, argList)
+	if err != nil {
+		return nil, err
+	}
+	return BStr(s), nil
+}
+
+// Checks a format string for the % operator, without formatting anything.
+// If numArgs is -1, the number of arguments isn't checked.
+func CheckPercentFormat(format string, numArgs int) error {
+	pieces, err := parsePercentFormat(format)
+	if err != nil {
+		return err
+	}
+	numFields := countFields(pieces)
+	if numArgs >= 0 && numArgs != numFields {
+		return errFormatArgs("format string expects %d arguments, got %d", numFields, numArgs)
+	}
+	return nil
+}
+
+func parsePercentFormat(format string) ([]formatPiece, error) {
+	var pieces []formatPiece
+	var literal strings.Builder
+	numFields := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			literal.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return nil, errFormat("incomplete format, %% at end of string")
+		}
+		if format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		spec := fmtSpec{fill: ' ', align: '>', precision: -1}
+		// flags
+	Flags:
+		for ; i < len(format); i++ {
+			switch format[i] {
+			case '-':
+				spec.align = '<'
+			case '+', ' ':
+				if spec.sign != '+' {
+					spec.sign = format[i]
+				}
+			case '0':
+				spec.zero = true
+			case '#':
+				spec.alt = true
+			default:
+				break Flags
+			}
+		}
+		var err error
+		spec.width, i, err = parseFormatInt(format, i)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(format) && format[i] == '.' {
+			spec.precision, i, err = parseFormatInt(format, i+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i >= len(format) {
+			return nil, errFormat("incomplete format")
+		}
+		switch format[i] {
+		case 'd', 'i', 'u':
+			spec.typ = 'd'
+		case 'x', 'X', 'o', 'f', 'F', 'e', 'E', 'g', 'G', 's', 'r':
+			spec.typ = format[i]
+		default:
+			return nil, errFormat("unsupported format character '%c' at index %d", format[i], i)
+		}
+		if spec.zero && spec.align != '<' {
+			// Python ignores 0 if - is also given
+			spec.align = '='
+			spec.fill = '0'
+		}
+		if literal.Len() > 0 {
+			pieces = append(pieces, formatPiece{literal: literal.String()})
+			literal.Reset()
+		}
+		pieces = append(pieces, formatPiece{isField: true, arg: numFields, spec: spec})
+		numFields++
+	}
+	if literal.Len() > 0 {
+		pieces = append(pieces, formatPiece{literal: literal.String()})
+	}
+	return pieces, nil
+}
+
+// ----------------Brace style------------------
+
+// Formats a string with {} fields, like Python's str.format.
+// Fields are either all automatically numbered {} or all manually numbered {0}, and can have a
+// format spec after a colon, e.g. {:>10.2f}. Use {{ and }} for literal braces.
+func FormatBraces(format string, args []BVal) (BVal, error) {
+	pieces, err := parseBraceFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if maxArg := maxFieldArg(pieces); maxArg >= len(args) {
+		return nil, errFormatIndex(maxArg, len(args))
+	}
+	s, err := applyFormat(pieces, args)
+	if err != nil {
+		return nil, err
+	}
+	return BStr(s), nil
+}
+
+// Checks a format string for format(), without formatting anything.
+// If numArgs is -1, the number of arguments isn't checked.
+func CheckBraceFormat(format string, numArgs int) error {
+	pieces, err := parseBraceFormat(format)
+	if err != nil {
+		return err
+	}
+	if maxArg := maxFieldArg(pieces); numArgs >= 0 && maxArg >= numArgs {
+		return errFormatIndex(maxArg, numArgs)
+	}
+	return nil
+}
+
+func parseBraceFormat(format string) ([]formatPiece, error) {
+	var pieces []formatPiece
+	var literal strings.Builder
+	autoNumber, manualNumber := 0, false
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c == '}' {
+			if i+1 < len(format) && format[i+1] == '}' {
+				literal.WriteByte('}')
+				i++
+				continue
+			}
+			return nil, errFormat("single '}' encountered in format string at index %d", i)
+		}
+		if c != '{' {
+			literal.WriteByte(c)
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '{' {
+			literal.WriteByte('{')
+			i++
+			continue
+		}
+		end := strings.IndexByte(format[i:], '}')
+		if end == -1 {
+			return nil, errFormat("single '{' encountered in format string at index %d", i)
+		}
+		field := format[i+1 : i+end]
+		i += end
+		argStr, specStr, _ := strings.Cut(field, ":")
+		var arg int
+		if argStr == "" {
+			if manualNumber {
+				return nil, errFormat("cannot switch from manual field numbering to automatic field numbering")
+			}
+			arg = autoNumber
+			autoNumber++
+		} else {
+			if autoNumber > 0 {
+				return nil, errFormat("cannot switch from automatic field numbering to manual field numbering")
+			}
+			manualNumber = true
+			var err error
+			arg, err = strconv.Atoi(argStr)
+			if err != nil || arg < 0 {
+				return nil, errFormat("invalid field %q, only positional fields are supported", argStr)
+			}
+		}
+		spec, err := parseBraceSpec(specStr)
+		if err != nil {
+			return nil, err
+		}
+		if literal.Len() > 0 {
+			pieces = append(pieces, formatPiece{literal: literal.String()})
+			literal.Reset()
+		}
+		pieces = append(pieces, formatPiece{isField: true, arg: arg, spec: spec})
+	}
+	if literal.Len() > 0 {
+		pieces = append(pieces, formatPiece{literal: literal.String()})
+	}
+	return pieces, nil
+}
+
+// Parses Python's format spec mini language: [[fill]align][sign][#][0][width][,][.precision][type]
+func parseBraceSpec(s string) (fmtSpec, error) {
+	spec := fmtSpec{fill: ' ', precision: -1}
+	i := 0
+	isAlign := func(c byte) bool { return c == '<' || c == '>' || c == '^' || c == '=' }
+	if r, size := utf8.DecodeRuneInString(s); size > 0 && size < len(s) && isAlign(s[size]) {
+		spec.fill = r
+		spec.align = s[size]
+		i = size + 1
+	} else if len(s) > 0 && isAlign(s[0]) {
+		spec.align = s[0]
+		i = 1
+	}
+	if i < len(s) && (s[i] == '+' || s[i] == '-' || s[i] == ' ') {
+		if s[i] != '-' {
+			spec.sign = s[i]
+		}
+		i++
+	}
+	if i < len(s) && s[i] == '#' {
+		spec.alt = true
+		i++
+	}
+	if i < len(s) && s[i] == '0' {
+		spec.zero = true
+		if spec.align == 0 {
+			spec.align = '='
+			spec.fill = '0'
+		}
+		i++
+	}
+	var err error
+	spec.width, i, err = parseFormatInt(s, i)
+	if err != nil {
+		return spec, err
+	}
+	if i < len(s) && s[i] == ',' {
+		spec.comma = true
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		start := i + 1
+		spec.precision, i, err = parseFormatInt(s, start)
+		if err != nil {
+			return spec, err
+		}
+		if i == start {
+			return spec, errFormat("format specifier missing precision")
+		}
+	}
+	if i < len(s) {
+		switch s[i] {
+		case 'd', 'x', 'X', 'o', 'b', 'f', 'F', 'e', 'E', 'g', 'G', '%', 's', 'r':
+			spec.typ = s[i]
+		default:
+			return spec, errFormat("unknown format code '%c'", s[i])
+		}
+		i++
+	}
+	if i < len(s) {
+		return spec, errFormat("invalid format specifier %q", s)
+	}
+	return spec, nil
+}
+
+// ----------------Shared------------------
+
+// Parses an optional unsigned integer starting at s[i]. Returns 0 if there isn't one
+func parseFormatInt(s string, i int) (n int, next int, err error) {
+	start := i
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == start {
+		return 0, i, nil
+	}
+	n, err = strconv.Atoi(s[start:i])
+	if err != nil || n > maxFormatWidth {
+		return 0, i, errFormat("width or precision %s is too large, the max is %d", s[start:i], maxFormatWidth)
+	}
+	return n, i, nil
+}
+
+func countFields(pieces []formatPiece) int {
+	n := 0
+	for _, p := range pieces {
+		if p.isField {
+			n++
+		}
+	}
+	return n
+}
+
+func maxFieldArg(pieces []formatPiece) int {
+	max := -1
+	for _, p := range pieces {
+		if p.isField && p.arg > max {
+			max = p.arg
+		}
+	}
+	return max
+}
+
+func applyFormat(pieces []formatPiece, args []BVal) (string, error) {
+	var b strings.Builder
+	for _, p := range pieces {
+		if !p.isField {
+			b.WriteString(p.literal)
+			continue
+		}
+		s, err := formatValue(p.spec, args[p.arg])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+	}
+	return b.String(), nil
+}
+
+// The % operator was given the wrong number of arguments
+func errFormatArgs(format string, xs ...any) error {
+	return &TypeError{Op: "%", Reason: fmt.Sprintf(format, xs...)}
+}
+
+func errFormatIndex(index, numArgs int) error {
+	return &IndexError{
+		Index:  index,
+		Len:    numArgs,
+		Reason: fmt.Sprintf("replacement index %d out of range for %d format arguments", index, numArgs),
+	}
+}
+
+func errFormatType(typ byte, val BVal) error {
+	return &TypeError{
+		Op:       "format",
+		Operands: []string{val.Typename()},
+		Reason:   fmt.Sprintf("format code '%c' is not supported for values of type %s", typ, val.Typename()),
+	}
+}
+
+// Formats a single value according to the spec
+func formatValue(spec fmtSpec, val BVal) (string, error) {
+	typ := spec.typ
+	if typ == 0 {
+		switch v := val.(type) {
+		case BInt:
+			typ = 'd'
+		case BFloat:
+			if spec.precision >= 0 {
+				typ = 'g'
+			} else {
+				// Format like str(x), but still apply signs and padding
+				return padNumber(spec, math.Signbit(float64(v)), "", strconv.FormatFloat(math.Abs(float64(v)), 'f', -1, 64)), nil
+			}
+		default:
+			typ = 's'
+		}
+	}
+	var neg bool
+	var prefix, body string
+	switch typ {
+	case 's', 'r':
+		s := ToString(val)
+		if typ == 'r' {
+			s = val.String()
+		}
+		if spec.precision >= 0 && utf8.RuneCountInString(s) > spec.precision {
+			s = string([]rune(s)[:spec.precision])
+		}
+		return pad(spec, '<', s), nil
+	case 'd', 'x', 'X', 'o', 'b':
+		i, ok := CastBoolToInt(val).(BInt)
+		if !ok {
+			return "", errFormatType(typ, val)
+		}
+		neg = i < 0
+		// Go through uint64 so that -MinInt64 doesn't overflow
+		abs := uint64(i)
+		if neg {
+			abs = -abs
+		}
+		switch typ {
+		case 'd':
+			body = strconv.FormatUint(abs, 10)
+			if spec.comma {
+				body = addThousands(body)
+			}
+		case 'x', 'X':
+			body = strconv.FormatUint(abs, 16)
+			prefix = "0x"
+			if typ == 'X' {
+				body = strings.ToUpper(body)
+				prefix = "0X"
+			}
+		case 'o':
+			body = strconv.FormatUint(abs, 8)
+			prefix = "0o"
+		case 'b':
+			body = strconv.FormatUint(abs, 2)
+			prefix = "0b"
+		}
+		if !spec.alt {
+			prefix = ""
+		}
+	case 'f', 'F', 'e', 'E', 'g', 'G', '%':
+		var f float64
+		switch v := CastBoolToInt(val).(type) {
+		case BInt:
+			f = float64(v)
+		case BFloat:
+			f = float64(v)
+		default:
+			return "", errFormatType(typ, val)
+		}
+		precision := spec.precision
+		if precision < 0 {
+			precision = 6
+		}
+		neg = math.Signbit(f) && !math.IsNaN(f)
+		f = math.Abs(f)
+		suffix := ""
+		goTyp := typ
+		if typ == '%' {
+			f *= 100
+			goTyp = 'f'
+			suffix = "%"
+		}
+		switch {
+		case math.IsNaN(f):
+			body = "nan"
+		case math.IsInf(f, 0):
+			body = "inf"
+		default:
+			body = strconv.FormatFloat(f, goTyp, precision, 64)
+			if spec.comma {
+				intPart, frac, hasFrac := strings.Cut(body, ".")
+				body = addThousands(intPart)
+				if hasFrac {
+					body += "." + frac
+				}
+			}
+		}
+		if typ == 'F' || typ == 'E' || typ == 'G' {
+			body = strings.ToUpper(body)
+		}
+		body += suffix
+	default:
+		return "", errFormat("unknown format code '%c'", typ)
+	}
+	return padNumber(spec, neg, prefix, body), nil
+}
+
+func padNumber(spec fmtSpec, neg bool, prefix, body string) string {
+	sign := ""
+	if neg {
+		sign = "-"
+	} else if spec.sign != 0 {
+		sign = string(spec.sign)
+	}
+	if spec.align == '=' {
+		n := spec.width - utf8.RuneCountInString(sign+prefix+body)
+		if n > 0 {
+			body = strings.Repeat(string(spec.fill), n) + body
+		}
+		return sign + prefix + body
+	}
+	return pad(spec, '>', sign+prefix+body)
+}
+
+// Pads s up to the spec's width, using defaultAlign if the spec doesn't specify one
+func pad(spec fmtSpec, defaultAlign byte, s string) string {
+	n := spec.width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s
+	}
+	align := spec.align
+	if align == 0 || align == '=' {
+		align = defaultAlign
+	}
+	fill := string(spec.fill)
+	switch align {
+	case '<':
+		return s + strings.Repeat(fill, n)
+	case '^':
+		left := n / 2
+		return strings.Repeat(fill, left) + s + strings.Repeat(fill, n-left)
+	default:
+		return strings.Repeat(fill, n) + s
+	}
+}
+
+// Inserts a comma every 3 digits, e.g. 1234567 -> 1,234,567
+func addThousands(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+	var b strings.Builder
+	first := len(digits) % 3
+	if first > 0 {
+		b.WriteString(digits[:first])
+	}
+	for i := first; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
@@ -14,26 +14,28 @@ var allowedCases = map[Case]CaseResult{
 	// Add
 	{"+", "BInt", "BInt"}: {
 		s: `result, ok := overflow.Add64(int64(a), int64(b))
-			if !ok { return nil, errOverflow }`},
+			if !ok { return nil, errOverflow("+") }`},
 	{"+", "BInt", "BFloat"}:   defaultFloat("+"),
 	{"+", "BFloat", "BInt"}:   defaultFloat("+"),
 	{"+", "BFloat", "BFloat"}: defaultFloat("+"),
 	{"+", "BStr", "BStr"}:     defaultOp("+", "BStr"),
 	{"+", "BArray", "BArray"}: {
-		s:  "result := append([]BVal(a), []BVal(b)...)",
+		// Copy, since appending to a could write into a backing array that's shared with other values
+		s: `result := make([]BVal, 0, len(a)+len(b))
+			result = append(append(result, a...), b...)`,
 		tp: "BArray",
 	},
 	// Sub
 	{"-", "BInt", "BInt"}: {
 		s: `result, ok := overflow.Sub64(int64(a), int64(b))
-			if !ok { return nil, errOverflow }`},
+			if !ok { return nil, errOverflow("-") }`},
 	{"-", "BInt", "BFloat"}:   defaultFloat("-"),
 	{"-", "BFloat", "BInt"}:   defaultFloat("-"),
 	{"-", "BFloat", "BFloat"}: defaultFloat("-"),
 	// Mul
 	{"*", "BInt", "BInt"}: {
 		s: `result, ok := overflow.Mul64(int64(a), int64(b))
-			if !ok { return nil, errOverflow }`},
+			if !ok { return nil, errOverflow("*") }`},
 	{"*", "BInt", "BFloat"}:   defaultFloat("*"),
 	{"*", "BFloat", "BInt"}:   defaultFloat("*"),
 	{"*", "BFloat", "BFloat"}: defaultFloat("*"),
@@ -44,7 +46,7 @@ var allowedCases = map[Case]CaseResult{
 	// Power
 	{"**", "BInt", "BInt"}: {
 		s: `result, ok := intPow(a, b)
-			if !ok { return nil, errOverflow }`},
+			if !ok { return nil, errOverflow("**") }`},
 	{"**", "BInt", "BFloat"}:   defaultExp,
 	{"**", "BFloat", "BInt"}:   defaultExp,
 	{"**", "BFloat", "BFloat"}: defaultExp,
@@ -77,6 +79,11 @@ func cases(op string) string {
 	echoMain := func(s string, xs ...interface{}) {
 		out += fmt.Sprintf(s, xs...) + "\n"
 	}
+	// Operations that aren't defined between builtin types fall back to the operator hooks of host values
+	fallback := fmt.Sprintf("return opFallback(\"%s\", aVal, bVal)", op)
+	if op == "cmp" {
+		fallback = "return cmpFallback(aVal, bVal, op)"
+	}
 	for _, aType := range types {
 		echoMain("case %s:", aType)
 		// write to bOut, if turns out that it's all blank, don't use bOut and use default.
@@ -91,16 +98,12 @@ func cases(op string) string {
 				echo("case %s:", bType)
 				result, ok := allowedCases[Case{op, aType, bType}]
 				if !ok {
-					if op == "cmp" {
-						echo("return 0, errTypeMismatch(\"%s\", aVal, bVal)", op)
-					} else {
-						echo("return nil, errTypeMismatch(\"%s\", aVal, bVal)", op)
-					}
+					echo("%s", fallback)
 				} else {
 					hasAnyCase = true
 					if op == "%" || op == "/" || op == "//" {
 						// div by zero
-						echo(`if b == 0 { return nil, errDivByZero }`)
+						echo(`if b == 0 { return nil, errDivByZero("%s") }`, op)
 					}
 					echo(result.s)
 					if result.tp == "" {
@@ -116,18 +119,18 @@ func cases(op string) string {
 					}
 				}
 			}
+			echo("default:")
+			echo("%s", fallback)
 		}
 		if hasAnyCase {
 			out += bOut
 			echoMain("}")
 		} else {
-			if op == "cmp" {
-				echoMain("return 0, errTypeMismatch(\"%s\", aVal, bVal)", op)
-			} else {
-				echoMain("return nil, errTypeMismatch(\"%s\", aVal, bVal)", op)
-			}
+			echoMain("%s", fallback)
 		}
 	}
+	echoMain("default:")
+	echoMain("%s", fallback)
 	return out
 }
 
@@ -210,7 +213,7 @@ var mulIntStrTemplateStr = `var result string
 		}`
 var mulIntArrTemplateStr = `var result []BVal
 		if int({{.IntName}}) > 0 && len({{.StrName}}) > 0 {
-			memoryUsed, ok := overflow.Mul(len({{.StrName}}), int({{.IntName}}))
+			memoryUsed, ok := overflow.Mul(len({{.StrName}})*ValueBytes, int({{.IntName}}))
 			if !ok || memoryUsed >= memoryLimit {
 				return nil, ErrOOM
 			}
@@ -270,7 +273,6 @@ func defaultCmp(tp string) CaseResult {
 const helpers = `// Code generated by runtime/generate/main.go. DO NOT EDIT.
 package runtime
 import (
-	"fmt"
 	"math"
 	"strings"
 
@@ -284,7 +286,6 @@ func Add(aVal, bVal BVal) (BVal, error) {
 	switch a := aVal.(type) {
 	{{ cases "+" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation between %s and %s: %s + %s", aVal.Typename(), bVal.Typename(), aVal, bVal))
 }
 func Sub(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -292,15 +293,14 @@ func Sub(aVal, bVal BVal) (BVal, error) {
 	switch a := aVal.(type) {
 	{{ cases "-" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) - %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
+// memoryLimit is the number of bytes that the result may use, see AllocBytes
 func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
 	switch a := aVal.(type) {
 	{{ cases "*" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) * %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Div(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -308,7 +308,6 @@ func Div(aVal, bVal BVal) (BVal, error) {
 	switch a := aVal.(type) {
 	{{ cases "/" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) / %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func FloorDiv(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -316,7 +315,6 @@ func FloorDiv(aVal, bVal BVal) (BVal, error) {
 	switch a := aVal.(type) {
 	{{ cases "//" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) // %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Pow(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -324,25 +322,26 @@ func Pow(aVal, bVal BVal) (BVal, error) {
 	switch a := aVal.(type) {
 	{{ cases "**" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) ** %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Modulo(aVal, bVal BVal) (BVal, error) {
+	if format, ok := aVal.(BStr); ok {
+		// printf style string formatting, e.g. '%d items' % n
+		return FormatPercent(string(format), bVal)
+	}
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
 	switch a := aVal.(type) {
 	{{ cases "%" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) %% %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 
 // Returns -1 if a < b, 0 if a == b, 1 if a > b
-// op is only used for debugging
+// op is only used for error messages
 func Cmp(aVal, bVal BVal, op string) (int, error) {
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
 	switch a := aVal.(type) {
 	{{ cases "cmp" }}
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) %s %s(%s)", aVal, aVal.Typename(), op, bVal, bVal.Typename()))
 }
 `
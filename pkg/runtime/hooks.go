@@ -0,0 +1,91 @@
+package runtime
+
+import (
+	"errors"
+	"reflect"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+// Operator hooks for host values, see bytecode.Adder and friends.
+
+// Called by the generated operators when an operation isn't defined between two builtin types.
+// Tries the hooks of the left operand, then the right operand, before giving up with a TypeError
+func opFallback(op string, aVal, bVal BVal) (BVal, error) {
+	var result BVal
+	err := ErrNotImplemented
+	switch op {
+	case "+":
+		if a, ok := aVal.(Adder); ok {
+			result, err = a.Add(bVal, false)
+		}
+		if b, ok := bVal.(Adder); ok && errors.Is(err, ErrNotImplemented) {
+			result, err = b.Add(aVal, true)
+		}
+	case "-":
+		if a, ok := aVal.(Subtracter); ok {
+			result, err = a.Sub(bVal, false)
+		}
+		if b, ok := bVal.(Subtracter); ok && errors.Is(err, ErrNotImplemented) {
+			result, err = b.Sub(aVal, true)
+		}
+	}
+	if errors.Is(err, ErrNotImplemented) {
+		return nil, errTypeMismatch(op, aVal, bVal)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = BNull{}
+	}
+	return result, nil
+}
+
+// Like opFallback, for comparisons
+func cmpFallback(aVal, bVal BVal, op string) (int, error) {
+	var result int
+	err := ErrNotImplemented
+	if a, ok := aVal.(Comparer); ok {
+		result, err = a.Cmp(bVal)
+	}
+	if b, ok := bVal.(Comparer); ok && errors.Is(err, ErrNotImplemented) {
+		result, err = b.Cmp(aVal)
+		result = -result
+	}
+	if errors.Is(err, ErrNotImplemented) {
+		return 0, errTypeMismatch(op, aVal, bVal)
+	}
+	return result, err
+}
+
+// Host values without an Eq hook are only equal to themselves
+func isSameHostValue(aVal, bVal BVal) (same bool) {
+	aType := reflect.TypeOf(aVal)
+	if aType != reflect.TypeOf(bVal) || !aType.Comparable() {
+		return false
+	}
+	// Structs with interface fields are comparable, but == still panics if the fields hold e.g. slices
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return aVal == bVal
+}
+
+// Implements a[i] for host values
+func Index(aVal, idx BVal) (BVal, bool, error) {
+	indexer, ok := aVal.(Indexer)
+	if !ok {
+		return nil, false, nil
+	}
+	result, err := indexer.Index(idx)
+	if err != nil {
+		return nil, true, err
+	}
+	if result == nil {
+		result = BNull{}
+	}
+	return result, true, nil
+}
@@ -2,7 +2,6 @@
 package runtime
 
 import (
-	"fmt"
 	"math"
 	"strings"
 
@@ -19,22 +18,24 @@ func Add(aVal, bVal BVal) (BVal, error) {
 		case BInt:
 			result, ok := overflow.Add64(int64(a), int64(b))
 			if !ok {
-				return nil, errOverflow
+				return nil, errOverflow("+")
 			}
 			return BInt(result), nil
 		case BFloat:
 			result := float64(a) + float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
+		default:
+			return opFallback("+", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
@@ -45,61 +46,69 @@ func Add(aVal, bVal BVal) (BVal, error) {
 			result := float64(a) + float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
+		default:
+			return opFallback("+", aVal, bVal)
 		}
 	case BStr:
 		switch b := bVal.(type) {
 		case BInt:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFloat:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BStr:
 			result := BStr(a) + BStr(b)
 			return BStr(result), nil
 		case BObj:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
+		default:
+			return opFallback("+", aVal, bVal)
 		}
 	case BObj:
-		return nil, errTypeMismatch("+", aVal, bVal)
+		return opFallback("+", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("+", aVal, bVal)
+		return opFallback("+", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("+", aVal, bVal)
+		return opFallback("+", aVal, bVal)
 	case BArray:
 		switch b := bVal.(type) {
 		case BInt:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFloat:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BStr:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("+", aVal, bVal)
+			return opFallback("+", aVal, bVal)
 		case BArray:
-			result := append([]BVal(a), []BVal(b)...)
+			result := make([]BVal, 0, len(a)+len(b))
+			result = append(append(result, a...), b...)
 			return BArray(result), nil
+		default:
+			return opFallback("+", aVal, bVal)
 		}
+	default:
+		return opFallback("+", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation between %s and %s: %s + %s", aVal.Typename(), bVal.Typename(), aVal, bVal))
 }
 func Sub(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -110,22 +119,24 @@ func Sub(aVal, bVal BVal) (BVal, error) {
 		case BInt:
 			result, ok := overflow.Sub64(int64(a), int64(b))
 			if !ok {
-				return nil, errOverflow
+				return nil, errOverflow("-")
 			}
 			return BInt(result), nil
 		case BFloat:
 			result := float64(a) - float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
+		default:
+			return opFallback("-", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
@@ -136,30 +147,35 @@ func Sub(aVal, bVal BVal) (BVal, error) {
 			result := float64(a) - float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("-", aVal, bVal)
+			return opFallback("-", aVal, bVal)
+		default:
+			return opFallback("-", aVal, bVal)
 		}
 	case BStr:
-		return nil, errTypeMismatch("-", aVal, bVal)
+		return opFallback("-", aVal, bVal)
 	case BObj:
-		return nil, errTypeMismatch("-", aVal, bVal)
+		return opFallback("-", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("-", aVal, bVal)
+		return opFallback("-", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("-", aVal, bVal)
+		return opFallback("-", aVal, bVal)
 	case BArray:
-		return nil, errTypeMismatch("-", aVal, bVal)
+		return opFallback("-", aVal, bVal)
+	default:
+		return opFallback("-", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) - %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
+
+// memoryLimit is the number of bytes that the result may use, see AllocBytes
 func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
@@ -169,7 +185,7 @@ func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 		case BInt:
 			result, ok := overflow.Mul64(int64(a), int64(b))
 			if !ok {
-				return nil, errOverflow
+				return nil, errOverflow("*")
 			}
 			return BInt(result), nil
 		case BFloat:
@@ -188,21 +204,23 @@ func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 			}
 			return BStr(result), nil
 		case BObj:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BArray:
 			var result []BVal
 			if int(a) > 0 && len(b) > 0 {
-				memoryUsed, ok := overflow.Mul(len(b), int(a))
+				memoryUsed, ok := overflow.Mul(len(b)*ValueBytes, int(a))
 				if !ok || memoryUsed >= memoryLimit {
 					return nil, ErrOOM
 				}
 				result = repeatArr([]BVal(b), int(a))
 			}
 			return BArray(result), nil
+		default:
+			return opFallback("*", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
@@ -213,15 +231,17 @@ func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 			result := float64(a) * float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
+		default:
+			return opFallback("*", aVal, bVal)
 		}
 	case BStr:
 		switch b := bVal.(type) {
@@ -238,30 +258,32 @@ func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 			}
 			return BStr(result), nil
 		case BFloat:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BStr:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
+		default:
+			return opFallback("*", aVal, bVal)
 		}
 	case BObj:
-		return nil, errTypeMismatch("*", aVal, bVal)
+		return opFallback("*", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("*", aVal, bVal)
+		return opFallback("*", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("*", aVal, bVal)
+		return opFallback("*", aVal, bVal)
 	case BArray:
 		switch b := bVal.(type) {
 		case BInt:
 			var result []BVal
 			if int(b) > 0 && len(a) > 0 {
-				memoryUsed, ok := overflow.Mul(len(a), int(b))
+				memoryUsed, ok := overflow.Mul(len(a)*ValueBytes, int(b))
 				if !ok || memoryUsed >= memoryLimit {
 					return nil, ErrOOM
 				}
@@ -269,21 +291,24 @@ func Mul(aVal, bVal BVal, memoryLimit int) (BVal, error) {
 			}
 			return BArray(result), nil
 		case BFloat:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BStr:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("*", aVal, bVal)
+			return opFallback("*", aVal, bVal)
+		default:
+			return opFallback("*", aVal, bVal)
 		}
+	default:
+		return opFallback("*", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) * %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Div(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -293,65 +318,70 @@ func Div(aVal, bVal BVal) (BVal, error) {
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("/")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("/")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
+		default:
+			return opFallback("/", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("/")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("/")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("/", aVal, bVal)
+			return opFallback("/", aVal, bVal)
+		default:
+			return opFallback("/", aVal, bVal)
 		}
 	case BStr:
-		return nil, errTypeMismatch("/", aVal, bVal)
+		return opFallback("/", aVal, bVal)
 	case BObj:
-		return nil, errTypeMismatch("/", aVal, bVal)
+		return opFallback("/", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("/", aVal, bVal)
+		return opFallback("/", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("/", aVal, bVal)
+		return opFallback("/", aVal, bVal)
 	case BArray:
-		return nil, errTypeMismatch("/", aVal, bVal)
+		return opFallback("/", aVal, bVal)
+	default:
+		return opFallback("/", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) / %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func FloorDiv(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -361,65 +391,70 @@ func FloorDiv(aVal, bVal BVal) (BVal, error) {
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("//")
 			}
 			result := BInt(a) / BInt(b)
 			return BInt(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("//")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
+		default:
+			return opFallback("//", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("//")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("//")
 			}
 			result := float64(a) / float64(b)
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("//", aVal, bVal)
+			return opFallback("//", aVal, bVal)
+		default:
+			return opFallback("//", aVal, bVal)
 		}
 	case BStr:
-		return nil, errTypeMismatch("//", aVal, bVal)
+		return opFallback("//", aVal, bVal)
 	case BObj:
-		return nil, errTypeMismatch("//", aVal, bVal)
+		return opFallback("//", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("//", aVal, bVal)
+		return opFallback("//", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("//", aVal, bVal)
+		return opFallback("//", aVal, bVal)
 	case BArray:
-		return nil, errTypeMismatch("//", aVal, bVal)
+		return opFallback("//", aVal, bVal)
+	default:
+		return opFallback("//", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) // %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Pow(aVal, bVal BVal) (BVal, error) {
 	aVal = CastBoolToInt(aVal)
@@ -430,22 +465,24 @@ func Pow(aVal, bVal BVal) (BVal, error) {
 		case BInt:
 			result, ok := intPow(a, b)
 			if !ok {
-				return nil, errOverflow
+				return nil, errOverflow("**")
 			}
 			return result, nil
 		case BFloat:
 			result := math.Pow(float64(a), float64(b))
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
+		default:
+			return opFallback("**", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
@@ -456,31 +493,38 @@ func Pow(aVal, bVal BVal) (BVal, error) {
 			result := math.Pow(float64(a), float64(b))
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("**", aVal, bVal)
+			return opFallback("**", aVal, bVal)
+		default:
+			return opFallback("**", aVal, bVal)
 		}
 	case BStr:
-		return nil, errTypeMismatch("**", aVal, bVal)
+		return opFallback("**", aVal, bVal)
 	case BObj:
-		return nil, errTypeMismatch("**", aVal, bVal)
+		return opFallback("**", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("**", aVal, bVal)
+		return opFallback("**", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("**", aVal, bVal)
+		return opFallback("**", aVal, bVal)
 	case BArray:
-		return nil, errTypeMismatch("**", aVal, bVal)
+		return opFallback("**", aVal, bVal)
+	default:
+		return opFallback("**", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) ** %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 func Modulo(aVal, bVal BVal) (BVal, error) {
+	if format, ok := aVal.(BStr); ok {
+		// printf style string formatting, e.g. '%d items' % n
+		return FormatPercent(string(format), bVal)
+	}
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
 	switch a := aVal.(type) {
@@ -488,69 +532,74 @@ func Modulo(aVal, bVal BVal) (BVal, error) {
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("%")
 			}
 			result := BInt(a) % BInt(b)
 			return BInt(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("%")
 			}
 			result := math.Mod(float64(a), float64(b))
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
+		default:
+			return opFallback("%", aVal, bVal)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
 		case BInt:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("%")
 			}
 			result := math.Mod(float64(a), float64(b))
 			return BFloat(result), nil
 		case BFloat:
 			if b == 0 {
-				return nil, errDivByZero
+				return nil, errDivByZero("%")
 			}
 			result := math.Mod(float64(a), float64(b))
 			return BFloat(result), nil
 		case BStr:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BObj:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BFunc:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BNull:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
 		case BArray:
-			return nil, errTypeMismatch("%", aVal, bVal)
+			return opFallback("%", aVal, bVal)
+		default:
+			return opFallback("%", aVal, bVal)
 		}
 	case BStr:
-		return nil, errTypeMismatch("%", aVal, bVal)
+		return opFallback("%", aVal, bVal)
 	case BObj:
-		return nil, errTypeMismatch("%", aVal, bVal)
+		return opFallback("%", aVal, bVal)
 	case BFunc:
-		return nil, errTypeMismatch("%", aVal, bVal)
+		return opFallback("%", aVal, bVal)
 	case BNull:
-		return nil, errTypeMismatch("%", aVal, bVal)
+		return opFallback("%", aVal, bVal)
 	case BArray:
-		return nil, errTypeMismatch("%", aVal, bVal)
+		return opFallback("%", aVal, bVal)
+	default:
+		return opFallback("%", aVal, bVal)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) %% %s(%s)", aVal, aVal.Typename(), bVal, bVal.Typename()))
 }
 
 // Returns -1 if a < b, 0 if a == b, 1 if a > b
-// op is only used for debugging
+// op is only used for error messages
 func Cmp(aVal, bVal BVal, op string) (int, error) {
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
@@ -574,15 +623,17 @@ func Cmp(aVal, bVal BVal, op string) (int, error) {
 			}
 			return 1, nil
 		case BStr:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BObj:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BFunc:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BNull:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BArray:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
+		default:
+			return cmpFallback(aVal, bVal, op)
 		}
 	case BFloat:
 		switch b := bVal.(type) {
@@ -603,22 +654,24 @@ func Cmp(aVal, bVal BVal, op string) (int, error) {
 			}
 			return 1, nil
 		case BStr:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BObj:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BFunc:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BNull:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BArray:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
+		default:
+			return cmpFallback(aVal, bVal, op)
 		}
 	case BStr:
 		switch b := bVal.(type) {
 		case BInt:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BFloat:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BStr:
 			aa, bb := BStr(a), BStr(b)
 			if aa < bb {
@@ -628,23 +681,26 @@ func Cmp(aVal, bVal BVal, op string) (int, error) {
 			}
 			return 1, nil
 		case BObj:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BFunc:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BNull:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
 		case BArray:
-			return 0, errTypeMismatch("cmp", aVal, bVal)
+			return cmpFallback(aVal, bVal, op)
+		default:
+			return cmpFallback(aVal, bVal, op)
 		}
 	case BObj:
-		return 0, errTypeMismatch("cmp", aVal, bVal)
+		return cmpFallback(aVal, bVal, op)
 	case BFunc:
-		return 0, errTypeMismatch("cmp", aVal, bVal)
+		return cmpFallback(aVal, bVal, op)
 	case BNull:
-		return 0, errTypeMismatch("cmp", aVal, bVal)
+		return cmpFallback(aVal, bVal, op)
 	case BArray:
-		return 0, errTypeMismatch("cmp", aVal, bVal)
+		return cmpFallback(aVal, bVal, op)
+	default:
+		return cmpFallback(aVal, bVal, op)
 
 	}
-	panic(fmt.Sprintf("Unhandled operation: %s(%s) %s %s(%s)", aVal, aVal.Typename(), op, bVal, bVal.Typename()))
 }
@@ -1,7 +1,6 @@
 package runtime
 
 import (
-	"fmt"
 	"math"
 
 	"github.com/johncgriffin/overflow"
@@ -15,6 +14,13 @@ import (
 func Eq(aVal BVal, bVal BVal) bool {
 	aVal = CastBoolToInt(aVal)
 	bVal = CastBoolToInt(bVal)
+	// Host values can overload ==, see bytecode.Equaler
+	if eq, ok := aVal.(Equaler); ok {
+		return eq.Eq(bVal)
+	}
+	if eq, ok := bVal.(Equaler); ok {
+		return eq.Eq(aVal)
+	}
 	// For want of a MATCH, the happiness was lost...
 	switch a := aVal.(type) {
 	case BInt:
@@ -97,7 +103,7 @@ func Eq(aVal BVal, bVal BVal) bool {
 		}
 		return true
 	default:
-		panic("Not impl")
+		return isSameHostValue(aVal, bVal)
 	}
 }
 
@@ -219,6 +225,6 @@ func Negate(val BVal) (BVal, error) {
 	case BBool:
 		return BInt(-BoolToInt(a)), nil
 	default:
-		return nil, fmt.Errorf("TypeError: bad operand type for unary -: %s", a.Typename())
+		return nil, &TypeError{Op: "unary -", Operands: []string{a.Typename()}}
 	}
 }
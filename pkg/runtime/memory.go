@@ -0,0 +1,189 @@
+package runtime
+
+import (
+	"reflect"
+	"unsafe"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+// The cost model for the VM's memory limit, in bytes. These roughly follow how Go lays out each value:
+// every BVal is an interface value, which points at its string, slice or map.
+const (
+	// An interface value. Also the whole cost of scalars like ints and floats
+	ValueBytes        = 16
+	stringHeaderBytes = 16
+	sliceHeaderBytes  = 24
+	mapHeaderBytes    = 48
+	funcBytes         = 64
+)
+
+// Optionally implemented by host values that know how much memory they use.
+// Host values that don't implement it cost ValueBytes.
+type Sizer interface {
+	SizeInBytes() int
+}
+
+// Returns the number of bytes that val uses, including the values it contains.
+// This is charged for values that come from outside the VM, e.g. the env.
+func SizeInBytes(val BVal) int {
+	switch v := val.(type) {
+	case BStr:
+		return ValueBytes + stringHeaderBytes + len(v)
+	case BArray:
+		size := ValueBytes + sliceHeaderBytes
+		for _, x := range v {
+			size += SizeInBytes(x)
+		}
+		return size
+	case BObj:
+		size := ValueBytes + mapHeaderBytes
+		for k, x := range v {
+			size += stringHeaderBytes + len(k) + SizeInBytes(x)
+		}
+		return size
+	case BFunc:
+		return funcBytes
+	case Sizer:
+		return v.SizeInBytes()
+	default:
+		return ValueBytes
+	}
+}
+
+// Returns the number of bytes allocated to create val, not counting the values it contains,
+// which are shared with the values it was created from. e.g. for arr + arr, only the new slice is allocated.
+// This is charged for strings and arrays created by operators.
+func AllocBytes(val BVal) int {
+	switch v := val.(type) {
+	case BStr:
+		return ValueBytes + stringHeaderBytes + len(v)
+	case BArray:
+		return ArrayAllocBytes(len(v))
+	default:
+		return 0
+	}
+}
+
+// The bytes allocated by creating an array of n elements
+func ArrayAllocBytes(n int) int {
+	return ValueBytes + sliceHeaderBytes + n*ValueBytes
+}
+
+// The bytes that Add(a, b) would allocate, so that the VM can check it before doing the work
+func AddAllocBytes(aVal, bVal BVal) int {
+	switch a := aVal.(type) {
+	case BStr:
+		if b, ok := bVal.(BStr); ok {
+			return ValueBytes + stringHeaderBytes + len(a) + len(b)
+		}
+	case BArray:
+		if b, ok := bVal.(BArray); ok {
+			return ArrayAllocBytes(len(a) + len(b))
+		}
+	}
+	return 0
+}
+
+// Returns the number of bytes that a host function allocated to return val, i.e. SizeInBytes(val) without the
+// strings, arrays and objects that it shares with args. So returning one of the arguments costs nothing, and
+// returning a new array of their elements only costs the array. Like for operators, scalars cost nothing.
+// Only the args and the values directly in them count as shared, so that this doesn't walk everything that was
+// passed in. Values nested deeper in args are charged as if they were new.
+func ResultBytes(val BVal, args []BVal) int {
+	switch val.(type) {
+	case BNull, BBool, BInt, BFloat:
+		return 0
+	case BStr, BArray, BObj:
+		shared := make(map[identity]bool)
+		for _, arg := range args {
+			addIdentities(arg, shared)
+		}
+		if id, ok := identityOf(val); ok && shared[id] {
+			return 0
+		}
+		return unsharedBytes(val, shared)
+	}
+	for _, arg := range args {
+		if isSameHostValue(val, arg) {
+			return 0
+		}
+	}
+	return SizeInBytes(val)
+}
+
+// The memory backing a string, array or object
+type identity struct {
+	kind reflect.Kind
+	ptr  uintptr
+	len  int
+}
+
+// Returns false for values that don't have any memory of their own, like empty strings
+func identityOf(val BVal) (identity, bool) {
+	switch v := val.(type) {
+	case BStr:
+		if len(v) == 0 {
+			return identity{}, false
+		}
+		return identity{kind: reflect.String, ptr: (*reflect.StringHeader)(unsafe.Pointer(&v)).Data, len: len(v)}, true
+	case BArray:
+		if len(v) == 0 {
+			return identity{}, false
+		}
+		return identity{kind: reflect.Slice, ptr: reflect.ValueOf(v).Pointer(), len: len(v)}, true
+	case BObj:
+		if v == nil {
+			return identity{}, false
+		}
+		return identity{kind: reflect.Map, ptr: reflect.ValueOf(v).Pointer()}, true
+	default:
+		return identity{}, false
+	}
+}
+
+// Adds val and the values directly in it to shared
+func addIdentities(val BVal, shared map[identity]bool) {
+	id, ok := identityOf(val)
+	if !ok || shared[id] {
+		return
+	}
+	shared[id] = true
+	switch v := val.(type) {
+	case BArray:
+		for _, x := range v {
+			if id, ok := identityOf(x); ok {
+				shared[id] = true
+			}
+		}
+	case BObj:
+		for _, x := range v {
+			if id, ok := identityOf(x); ok {
+				shared[id] = true
+			}
+		}
+	}
+}
+
+// Like SizeInBytes, but shared values only cost the interface value that points to them
+func unsharedBytes(val BVal, shared map[identity]bool) int {
+	if id, ok := identityOf(val); ok && shared[id] {
+		return ValueBytes
+	}
+	switch v := val.(type) {
+	case BArray:
+		size := ValueBytes + sliceHeaderBytes
+		for _, x := range v {
+			size += unsharedBytes(x, shared)
+		}
+		return size
+	case BObj:
+		size := ValueBytes + mapHeaderBytes
+		for k, x := range v {
+			size += stringHeaderBytes + len(k) + unsharedBytes(x, shared)
+		}
+		return size
+	default:
+		return SizeInBytes(val)
+	}
+}
@@ -0,0 +1,135 @@
+package stdlib
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+// ----------------Arrays------------------
+
+var Len = newFn("len", 1, func(args []BVal) (BVal, error) {
+	switch x := args[0].(type) {
+	case BStr:
+		return BInt(len(x)), nil
+	case BArray:
+		return BInt(len(x)), nil
+	case BObj:
+		return BInt(len(x)), nil
+	default:
+		return nil, errArgType("len", "x", "a string, array or object", x)
+	}
+})
+
+var Contains = newFn("contains", 2, func(args []BVal) (BVal, error) {
+	switch x := args[0].(type) {
+	case BStr:
+		sub, err := strArg("contains", "v", args[1])
+		if err != nil {
+			return nil, err
+		}
+		return BBool(strings.Contains(string(x), sub)), nil
+	case BArray:
+		return BBool(arrIndexOf(x, args[1]) != -1), nil
+	case BObj:
+		key, err := strArg("contains", "v", args[1])
+		if err != nil {
+			return nil, err
+		}
+		_, ok := x[key]
+		return BBool(ok), nil
+	default:
+		return nil, errArgType("contains", "x", "a string, array or object", x)
+	}
+})
+
+var IndexOf = newFn("indexOf", 2, func(args []BVal) (BVal, error) {
+	switch x := args[0].(type) {
+	case BStr:
+		sub, err := strArg("indexOf", "v", args[1])
+		if err != nil {
+			return nil, err
+		}
+		return BInt(strings.Index(string(x), sub)), nil
+	case BArray:
+		return BInt(arrIndexOf(x, args[1])), nil
+	default:
+		return nil, errArgType("indexOf", "x", "a string or array", x)
+	}
+})
+
+func arrIndexOf(arr BArray, v BVal) int {
+	for i, x := range arr {
+		if runtime.Eq(x, v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ----------------Objects------------------
+
+func sortedKeys(obj BObj) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var Keys = newFn("keys", 1, func(args []BVal) (BVal, error) {
+	obj, err := objArg("keys", "obj", args[0])
+	if err != nil {
+		return nil, err
+	}
+	keys := sortedKeys(obj)
+	result := make(BArray, len(keys))
+	for i, k := range keys {
+		result[i] = BStr(k)
+	}
+	return result, nil
+})
+
+var Values = newFn("values", 1, func(args []BVal) (BVal, error) {
+	obj, err := objArg("values", "obj", args[0])
+	if err != nil {
+		return nil, err
+	}
+	keys := sortedKeys(obj)
+	result := make(BArray, len(keys))
+	for i, k := range keys {
+		result[i] = obj[k]
+	}
+	return result, nil
+})
+
+var Has = newFn("has", 2, func(args []BVal) (BVal, error) {
+	obj, err := objArg("has", "obj", args[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := strArg("has", "key", args[1])
+	if err != nil {
+		return nil, err
+	}
+	_, ok := obj[key]
+	return BBool(ok), nil
+})
+
+var Get = newFn("get", 3, func(args []BVal) (BVal, error) {
+	obj, err := objArg("get", "obj", args[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := strArg("get", "key", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := obj[key]; ok {
+		return val, nil
+	}
+	return args[2], nil
+})
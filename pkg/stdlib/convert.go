@@ -0,0 +1,61 @@
+package stdlib
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+var Int = newFn("int", 1, func(args []BVal) (BVal, error) {
+	switch x := runtime.CastBoolToInt(args[0]).(type) {
+	case BInt:
+		return x, nil
+	case BFloat:
+		f := math.Trunc(float64(x))
+		// float64(math.MaxInt64) rounds up to 2^63, which is out of range
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, errValue("int", "cannot convert %s to an int", x)
+		}
+		return BInt(f), nil
+	case BStr:
+		i, err := strconv.ParseInt(strings.TrimSpace(string(x)), 0, 64)
+		if err != nil {
+			return nil, errValue("int", "invalid literal %s", x)
+		}
+		return BInt(i), nil
+	default:
+		return nil, errArgType("int", "x", "a number or string", x)
+	}
+})
+
+var Float = newFn("float", 1, func(args []BVal) (BVal, error) {
+	switch x := runtime.CastBoolToInt(args[0]).(type) {
+	case BInt:
+		return BFloat(x), nil
+	case BFloat:
+		return x, nil
+	case BStr:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(x)), 64)
+		if err != nil {
+			return nil, errValue("float", "invalid literal %s", x)
+		}
+		return BFloat(f), nil
+	default:
+		return nil, errArgType("float", "x", "a number or string", x)
+	}
+})
+
+var Str = newFn("str", 1, func(args []BVal) (BVal, error) {
+	return BStr(runtime.ToString(args[0])), nil
+})
+
+var Bool = newFn("bool", 1, func(args []BVal) (BVal, error) {
+	return BBool(args[0].IsTruthy()), nil
+})
+
+var Type = newFn("type", 1, func(args []BVal) (BVal, error) {
+	return BStr(args[0].Typename()), nil
+})
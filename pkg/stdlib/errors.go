@@ -0,0 +1,92 @@
+package stdlib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+func errOverflow(fn string) error {
+	return &runtime.ArithmeticError{Op: fn + "()", Err: runtime.ErrOverflow}
+}
+
+// Returned (wrapped) by aggregate functions like sum() when passed an empty array. Check for it with errors.Is
+var ErrEmptyArray = errors.New("empty array")
+
+func errEmptyArray(fn string) error {
+	return &runtime.ValueError{Fn: fn, Reason: "empty array", Err: ErrEmptyArray}
+}
+
+// Returned by aggregate functions like sum() when an element of the array is not a number.
+// Check for it with errors.As
+type ElementTypeError struct {
+	Fn       string
+	Index    int
+	Typename string
+}
+
+func (e *ElementTypeError) Error() string {
+	return fmt.Sprintf("TypeError: %s() expected an array of numbers, found %s at index %d", e.Fn, e.Typename, e.Index)
+}
+
+// Lets errors.As convert the error to a *runtime.TypeError
+func (e *ElementTypeError) As(target any) bool {
+	typeErr, ok := target.(**runtime.TypeError)
+	if !ok {
+		return false
+	}
+	*typeErr = &runtime.TypeError{Op: "()", Reason: strings.TrimPrefix(e.Error(), "TypeError: ")}
+	return true
+}
+
+func errArgType(fn, param, expected string, got BVal) error {
+	return &runtime.TypeError{
+		Op:       "()",
+		Operands: []string{got.Typename()},
+		Reason:   fmt.Sprintf("%s() argument %s must be %s, not %s", fn, param, expected, got.Typename()),
+	}
+}
+
+func errValue(fn string, format string, xs ...any) error {
+	return &runtime.ValueError{Fn: fn, Reason: fmt.Sprintf(format, xs...)}
+}
+
+// Argument helpers. Booleans are treated as integers, like everywhere else in the language
+
+func strArg(fn, param string, val BVal) (string, error) {
+	s, ok := val.(BStr)
+	if !ok {
+		return "", errArgType(fn, param, "a string", val)
+	}
+	return string(s), nil
+}
+
+func arrArg(fn, param string, val BVal) (BArray, error) {
+	arr, ok := val.(BArray)
+	if !ok {
+		return nil, errArgType(fn, param, "an array", val)
+	}
+	return arr, nil
+}
+
+func objArg(fn, param string, val BVal) (BObj, error) {
+	obj, ok := val.(BObj)
+	if !ok {
+		return nil, errArgType(fn, param, "an object", val)
+	}
+	return obj, nil
+}
+
+// Returns either a BInt or a BFloat
+func numArg(fn, param string, val BVal) (BVal, error) {
+	val = runtime.CastBoolToInt(val)
+	switch val.(type) {
+	case BInt, BFloat:
+		return val, nil
+	default:
+		return nil, errArgType(fn, param, "a number", val)
+	}
+}
@@ -0,0 +1,151 @@
+package stdlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+// JSON is exposed to expressions as an object, so that they can call json.parse(s) and json.stringify(v)
+var JSON = BObj{
+	"parse":     JSONParse,
+	"stringify": JSONStringify,
+}
+
+// json.parse(s) converts JSON text into objects, arrays, strings, ints, floats, bools and null.
+// Numbers without a fraction or exponent that fit into an int are parsed as ints, and as floats otherwise.
+var JSONParse = newFn("json.parse", 1, func(args []BVal) (BVal, error) {
+	s, err := strArg("json.parse", "s", args[0])
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, errValue("json.parse", "invalid JSON: %s", err)
+	}
+	// Make sure there's nothing but whitespace after the value
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errValue("json.parse", "invalid JSON: unexpected data after top-level value")
+	}
+	return fromJSON(v), nil
+})
+
+func fromJSON(v any) BVal {
+	switch v := v.(type) {
+	case nil:
+		return BNull{}
+	case bool:
+		return BBool(v)
+	case string:
+		return BStr(v)
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return BInt(i)
+		}
+		// The decoder already validated the number, so the only possible error is a range error,
+		// in which case f is +-Inf.
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return BFloat(f)
+	case []any:
+		arr := make(BArray, len(v))
+		for i, x := range v {
+			arr[i] = fromJSON(x)
+		}
+		return arr
+	case map[string]any:
+		obj := make(BObj, len(v))
+		for k, x := range v {
+			obj[k] = fromJSON(x)
+		}
+		return obj
+	default:
+		panic("Unexpected type from encoding/json")
+	}
+}
+
+// json.stringify(v, sortKeys?) converts a value to JSON text.
+// If sortKeys is truthy, object keys are written in sorted order so the output is deterministic.
+// Otherwise, they're written in whatever order the object iterates in.
+var JSONStringify = BFunc{
+	Name:     "json.stringify",
+	NumArgs:  1,
+	Variadic: true,
+	Fn: func(args []BVal) (BVal, error) {
+		if len(args) > 2 {
+			return nil, errValue("json.stringify", "takes at most 2 arguments, got %d", len(args))
+		}
+		sortKeys := len(args) == 2 && args[1].IsTruthy()
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, args[0], sortKeys); err != nil {
+			return nil, err
+		}
+		return BStr(buf.String()), nil
+	},
+}
+
+var errJSONUnsupportedFloat = &runtime.ValueError{Fn: "json.stringify", Reason: "cannot represent NaN or Infinity"}
+
+func writeJSON(buf *bytes.Buffer, val BVal, sortKeys bool) error {
+	switch v := val.(type) {
+	case BNull:
+		buf.WriteString("null")
+	case BBool:
+		buf.WriteString(strconv.FormatBool(bool(v)))
+	case BInt:
+		buf.WriteString(strconv.FormatInt(int64(v), 10))
+	case BFloat:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return errJSONUnsupportedFloat
+		}
+		b, _ := json.Marshal(f)
+		buf.Write(b)
+	case BStr:
+		b, _ := json.Marshal(string(v))
+		buf.Write(b)
+	case BArray:
+		buf.WriteByte('[')
+		for i, x := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, x, sortKeys); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case BObj:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		if sortKeys {
+			sort.Strings(keys)
+		}
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			b, _ := json.Marshal(k)
+			buf.Write(b)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, v[k], sortKeys); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return errArgType("json.stringify", "v", "JSON serializable", val)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package stdlib
+
+import (
+	"math"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+var Abs = newFn("abs", 1, func(args []BVal) (BVal, error) {
+	x, err := numArg("abs", "x", args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case BInt:
+		if x == math.MinInt64 {
+			return nil, errOverflow("abs")
+		}
+		if x < 0 {
+			return -x, nil
+		}
+		return x, nil
+	default:
+		return BFloat(math.Abs(float64(x.(BFloat)))), nil
+	}
+})
+
+var Min = newFn("min", 2, func(args []BVal) (BVal, error) {
+	ord, err := runtime.Cmp(args[0], args[1], "min")
+	if err != nil {
+		return nil, err
+	}
+	if ord == 1 {
+		return args[1], nil
+	}
+	return args[0], nil
+})
+
+var Max = newFn("max", 2, func(args []BVal) (BVal, error) {
+	ord, err := runtime.Cmp(args[0], args[1], "max")
+	if err != nil {
+		return nil, err
+	}
+	if ord == -1 {
+		return args[1], nil
+	}
+	return args[0], nil
+})
+
+// Helper for floor, ceil and round. Ints are returned unchanged
+func roundingFn(name string, f func(float64) float64) BFunc {
+	return newFn(name, 1, func(args []BVal) (BVal, error) {
+		x, err := numArg(name, "x", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if x, ok := x.(BFloat); ok {
+			return BFloat(f(float64(x))), nil
+		}
+		return x, nil
+	})
+}
+
+var Floor = roundingFn("floor", math.Floor)
+var Ceil = roundingFn("ceil", math.Ceil)
+var Round = roundingFn("round", math.Round)
+
+var Sqrt = newFn("sqrt", 1, func(args []BVal) (BVal, error) {
+	x, err := numArg("sqrt", "x", args[0])
+	if err != nil {
+		return nil, err
+	}
+	f := toFloat(x)
+	if f < 0 {
+		return nil, errValue("sqrt", "math domain error")
+	}
+	return BFloat(math.Sqrt(f)), nil
+})
+
+// x must be a BInt or BFloat
+func toFloat(x BVal) float64 {
+	switch x := x.(type) {
+	case BInt:
+		return float64(x)
+	case BFloat:
+		return float64(x)
+	default:
+		panic("toFloat called on a non number")
+	}
+}
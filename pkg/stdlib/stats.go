@@ -0,0 +1,207 @@
+package stdlib
+
+import (
+	"math"
+	"sort"
+
+	"github.com/johncgriffin/overflow"
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+// Aggregate functions over arrays of numbers.
+// All of these reject empty arrays with ErrEmptyArray, and arrays containing anything other than ints and floats
+// (including NaN) with an *ElementTypeError. Each call costs one instruction per element of the array.
+
+// Helper to build an aggregate over the array passed in as the first argument
+func newAggregateFn(name string, numArgs int, fn VMFunc) BFunc {
+	f := newFn(name, numArgs, fn)
+	f.Cost = costOfArray
+	return f
+}
+
+func costOfArray(args []BVal) int {
+	if arr, ok := args[0].(BArray); ok {
+		return len(arr)
+	}
+	return 0
+}
+
+func withCost(f BFunc, cost func(args []BVal) int) BFunc {
+	f.Cost = cost
+	return f
+}
+
+// Checks that every element of arr is a number, and returns them as floats.
+// allInts is true if every element was an int
+func numbersArg(fn, param string, val BVal) (nums []float64, allInts bool, err error) {
+	arr, err := arrArg(fn, param, val)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(arr) == 0 {
+		return nil, false, errEmptyArray(fn)
+	}
+	nums = make([]float64, len(arr))
+	allInts = true
+	for i, x := range arr {
+		switch x := x.(type) {
+		case BInt:
+			nums[i] = float64(x)
+		case BFloat:
+			if math.IsNaN(float64(x)) {
+				return nil, false, &ElementTypeError{Fn: fn, Index: i, Typename: "NaN"}
+			}
+			nums[i] = float64(x)
+			allInts = false
+		default:
+			return nil, false, &ElementTypeError{Fn: fn, Index: i, Typename: x.Typename()}
+		}
+	}
+	return nums, allInts, nil
+}
+
+// Neumaier's variant of Kahan summation, which keeps the rounding error of adding
+// numbers of very different magnitudes bounded.
+func kahanSum(nums []float64) float64 {
+	sum, c := 0.0, 0.0
+	for _, x := range nums {
+		t := sum + x
+		if math.Abs(sum) >= math.Abs(x) {
+			c += (sum - t) + x
+		} else {
+			c += (x - t) + sum
+		}
+		sum = t
+	}
+	// Once the sum is infinite, the compensation is NaN, so leave it out
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return sum
+	}
+	return sum + c
+}
+
+var Sum = newAggregateFn("sum", 1, func(args []BVal) (BVal, error) {
+	nums, allInts, err := numbersArg("sum", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	if allInts {
+		// Sum as ints so we don't lose precision above 2^53
+		var sum int64
+		var ok bool
+		for _, x := range args[0].(BArray) {
+			sum, ok = overflow.Add64(sum, int64(x.(BInt)))
+			if !ok {
+				return nil, errOverflow("sum")
+			}
+		}
+		return BInt(sum), nil
+	}
+	return BFloat(kahanSum(nums)), nil
+})
+
+var Avg = newAggregateFn("avg", 1, func(args []BVal) (BVal, error) {
+	nums, _, err := numbersArg("avg", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return BFloat(mean(nums)), nil
+})
+
+func mean(nums []float64) float64 {
+	// Divide first so that the sum of large numbers doesn't overflow to Inf
+	n := float64(len(nums))
+	scaled := make([]float64, len(nums))
+	for i, x := range nums {
+		scaled[i] = x / n
+	}
+	return kahanSum(scaled)
+}
+
+var Stddev = newAggregateFn("stddev", 1, func(args []BVal) (BVal, error) {
+	nums, _, err := numbersArg("stddev", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	// Welford's online algorithm, which is stable even when the variance is small relative to the mean
+	var m, m2 float64
+	for i, x := range nums {
+		delta := x - m
+		m += delta / float64(i+1)
+		m2 += delta * (x - m)
+	}
+	return BFloat(math.Sqrt(m2 / float64(len(nums)))), nil
+})
+
+var Median = newAggregateFn("median", 1, func(args []BVal) (BVal, error) {
+	nums, _, err := numbersArg("median", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	sort.Float64s(nums)
+	return BFloat(percentileOfSorted(nums, 50)), nil
+})
+
+var Percentile = newAggregateFn("percentile", 2, func(args []BVal) (BVal, error) {
+	nums, _, err := numbersArg("percentile", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	pVal, err := numArg("percentile", "p", args[1])
+	if err != nil {
+		return nil, err
+	}
+	p := toFloat(pVal)
+	if !(p >= 0 && p <= 100) {
+		return nil, errValue("percentile", "p must be between 0 and 100, got %s", pVal)
+	}
+	sort.Float64s(nums)
+	return BFloat(percentileOfSorted(nums, p)), nil
+})
+
+// Linearly interpolates between the closest ranks, like numpy's default
+func percentileOfSorted(nums []float64, p float64) float64 {
+	rank := p / 100 * float64(len(nums)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo == hi {
+		return nums[lo]
+	}
+	frac := rank - float64(lo)
+	return nums[lo] + (nums[hi]-nums[lo])*frac
+}
+
+// histogram(arr, bounds) counts the elements of arr into len(bounds) + 1 buckets.
+// Bucket 0 counts x < bounds[0], bucket i counts bounds[i-1] <= x < bounds[i], and the last
+// bucket counts x >= bounds[len(bounds)-1]. bounds must be sorted in ascending order.
+// Each call costs one instruction per element of arr and of bounds.
+var Histogram = withCost(newAggregateFn("histogram", 2, func(args []BVal) (BVal, error) {
+	nums, _, err := numbersArg("histogram", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	bounds, _, err := numbersArg("histogram", "bounds", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return nil, errValue("histogram", "bounds must be sorted in ascending order")
+	}
+	counts := make([]int64, len(bounds)+1)
+	for _, x := range nums {
+		counts[sort.Search(len(bounds), func(i int) bool { return x < bounds[i] })]++
+	}
+	result := make(BArray, len(counts))
+	for i, c := range counts {
+		result[i] = BInt(c)
+	}
+	return result, nil
+}), costOfHistogram)
+
+func costOfHistogram(args []BVal) int {
+	cost := costOfArray(args)
+	if bounds, ok := args[1].(BArray); ok {
+		cost += len(bounds)
+	}
+	return cost
+}
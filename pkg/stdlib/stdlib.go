@@ -0,0 +1,148 @@
+// Package stdlib implements the standard library of builtin functions for the expression language.
+// These are pure functions that are available to expressions without the host having to register them,
+// once enabled with vm.Params.StdlibVersion. Host env entries always shadow builtins of the same name.
+//
+// The standard library is versioned so that upgrading this package never changes the meaning of an
+// existing expression. Functions are only ever added in a new version, never removed or changed.
+//
+// # Version 1
+//
+// Math:
+//
+//	abs(x)          absolute value of an int or float
+//	min(a, b)       the smaller of a and b (numbers or strings)
+//	max(a, b)       the larger of a and b (numbers or strings)
+//	floor(x)        rounds a float down, ints are returned as is
+//	ceil(x)         rounds a float up, ints are returned as is
+//	round(x)        rounds a float to the nearest integer, half away from zero
+//	sqrt(x)         square root, always returns a float
+//
+// Strings:
+//
+//	lower(s), upper(s), trim(s)
+//	split(s, sep)   splits a string into an array of strings
+//	join(arr, sep)  joins an array of strings
+//	startsWith(s, prefix), endsWith(s, suffix)
+//	replace(s, old, new)
+//	format(fmt, args...)  formats like Python's str.format, e.g. format('{:.2f} of {}', a, b)
+//
+// Strings can also be formatted printf style with the % operator, e.g. '%d items' % n.
+// See the runtime package for the conversions supported.
+//
+// Arrays:
+//
+//	len(x)           length of a string, array or object
+//	contains(x, v)   substring check for strings, element check for arrays, key check for objects
+//	indexOf(x, v)    index of v in a string or array, or -1
+//
+// Statistics, over arrays of ints and floats. These cost one instruction per element of the array:
+//
+//	sum(arr)              sum of the array, an int if all elements are ints
+//	avg(arr)              arithmetic mean
+//	median(arr)           same as percentile(arr, 50)
+//	percentile(arr, p)    the p-th percentile, 0 <= p <= 100, linearly interpolated between ranks
+//	stddev(arr)           population standard deviation
+//	histogram(arr, bounds) counts of arr in the buckets (-inf, b0), [b0, b1), ... [bn, inf)
+//
+// Objects:
+//
+//	keys(obj)              array of keys, in sorted order
+//	values(obj)            array of values, in the order of keys(obj)
+//	has(obj, key)          true if the key is in the object
+//	get(obj, key, default) obj.key if it exists, else default
+//
+// JSON:
+//
+//	json.parse(s)               parses JSON text. Every value created counts towards the VM's MaxMemory
+//	json.stringify(v, sortKeys) converts v to JSON text. sortKeys is optional, and if truthy, object
+//	                            keys are written in sorted order so the output is deterministic
+//
+// Type conversion:
+//
+//	int(x), float(x), str(x), bool(x)
+//	type(x)         the type name of x, e.g. 'int'
+package stdlib
+
+import (
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+const (
+	// Disables the standard library
+	None = 0
+	V1   = 1
+	// The latest version of the standard library
+	Latest = V1
+)
+
+type builtin struct {
+	// The version this builtin was added in
+	since int
+	val   BVal
+}
+
+var builtins = map[string]builtin{}
+
+func register(since int, name string, val BVal) {
+	if _, ok := builtins[name]; ok {
+		panic("Builtin " + name + " registered twice")
+	}
+	builtins[name] = builtin{since: since, val: val}
+}
+
+// Returns all builtins available in a version of the standard library, keyed by name.
+// A version of None returns nothing. The map returned is a fresh copy and can be modified by the caller.
+func Builtins(version int) map[string]BVal {
+	result := make(map[string]BVal)
+	if version <= None {
+		return result
+	}
+	for name, b := range builtins {
+		if b.since <= version {
+			result[name] = b.val
+		}
+	}
+	return result
+}
+
+func init() {
+	for _, fn := range []BFunc{
+		// math
+		Abs, Min, Max, Floor, Ceil, Round, Sqrt,
+		// strings
+		Lower, Upper, Trim, Split, Join, StartsWith, EndsWith, Replace, Format,
+		// arrays
+		Len, Contains, IndexOf,
+		// statistics
+		Sum, Avg, Median, Percentile, Stddev, Histogram,
+		// objects
+		Keys, Values, Has, Get,
+		// conversion
+		Int, Float, Str, Bool, Type,
+	} {
+		register(V1, fn.Name, fn)
+	}
+	register(V1, "json", JSON)
+}
+
+// Methods that can be called on values, e.g. s.upper(). These are always available, regardless of
+// the version of the standard library enabled. The receiver is passed in as the first argument.
+var Methods = map[string]map[string]BFunc{
+	"string": methodsOf(Len, Lower, Upper, Trim, Split, StartsWith, EndsWith, Contains, IndexOf, Replace, Format),
+	"array":  methodsOf(Len, Contains, IndexOf, Join),
+	"int":    methodsOf(Abs),
+	"float":  methodsOf(Abs, Floor, Ceil, Round),
+}
+
+func methodsOf(fns ...BFunc) map[string]BFunc {
+	result := make(map[string]BFunc, len(fns))
+	for _, fn := range fns {
+		result[fn.Name] = fn
+	}
+	return result
+}
+
+// Helper to build a builtin function
+func newFn(name string, numArgs int, fn VMFunc) BFunc {
+	return BFunc{Fn: fn, NumArgs: numArgs, Name: name}
+}
@@ -0,0 +1,288 @@
+package stdlib_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/vm"
+)
+
+var env = vm.VMEnv{
+	"i":   bytecode.BInt(-7),
+	"f":   bytecode.BFloat(2.5),
+	"s":   bytecode.BStr("  Hello, World  "),
+	"arr": bytecode.BArray{bytecode.BStr("a"), bytecode.BStr("b"), bytecode.BStr("c")},
+	"samples": bytecode.BArray{
+		bytecode.BInt(15), bytecode.BInt(20), bytecode.BInt(35), bytecode.BInt(40), bytecode.BInt(50),
+	},
+	"raw":   bytecode.BStr(`{"user": {"name": "ann", "tags": ["a", "b"]}, "n": 3, "x": 1.5, "ok": true, "nil": null}`),
+	"mixed": bytecode.BArray{bytecode.BInt(1), bytecode.BFloat(2.5), bytecode.BInt(3)},
+	"obj": bytecode.BObj{
+		"y": bytecode.BInt(2),
+		"x": bytecode.BInt(1),
+	},
+}
+
+var validStringsInOut = []struct {
+	in       string
+	expected bytecode.BVal
+}{
+	// math
+	{"abs(i)", bytecode.BInt(7)},
+	{"abs(0 - f)", bytecode.BFloat(2.5)},
+	{"min(i, f)", bytecode.BInt(-7)},
+	{"max(i, f)", bytecode.BFloat(2.5)},
+	{"min('b', 'a')", bytecode.BStr("a")},
+	{"floor(f)", bytecode.BFloat(2)},
+	{"ceil(f)", bytecode.BFloat(3)},
+	{"round(f)", bytecode.BFloat(3)},
+	{"round(i)", bytecode.BInt(-7)},
+	{"sqrt(16)", bytecode.BFloat(4)},
+	// strings
+	{"lower(trim(s))", bytecode.BStr("hello, world")},
+	{"upper('abc')", bytecode.BStr("ABC")},
+	{"split(trim(s), ', ')[1]", bytecode.BStr("World")},
+	{"join(arr, '-')", bytecode.BStr("a-b-c")},
+	{"startsWith(trim(s), 'Hello')", bytecode.BBool(true)},
+	{"endsWith(s, 'World')", bytecode.BBool(false)},
+	{"replace('aaa', 'a', 'b')", bytecode.BStr("bbb")},
+	{"format('{:.2f} of {}', f, i)", bytecode.BStr("2.50 of -7")},
+	{"format('{1}-{0}-{1}', 'a', 'b')", bytecode.BStr("b-a-b")},
+	{"format('{:>6}|{:<6}|{:^7}|{:*^7}', 'ab', 'ab', 'ab', 'ab')", bytecode.BStr("    ab|ab    |  ab   |**ab***")},
+	{"format('{:,}|{:,.2f}|{:08.3f}|{:+d}', 1234567, 1234.5, 0 - f, 5)", bytecode.BStr("1,234,567|1,234.50|-002.500|+5")},
+	{"format('{:.1%}|{:#x}|{:b}', 0.256, 255, 5)", bytecode.BStr("25.6%|0xff|101")},
+	{"format('{{}} {:.3}', 'abcdef')", bytecode.BStr("{} abc")},
+	{"format('{} {}', true, arr)", bytecode.BStr("true ['a', 'b', 'c']")},
+	// arrays
+	{"len(arr)", bytecode.BInt(3)},
+	{"len(s)", bytecode.BInt(16)},
+	{"len(obj)", bytecode.BInt(2)},
+	{"contains(arr, 'b')", bytecode.BBool(true)},
+	{"contains(s, 'xyz')", bytecode.BBool(false)},
+	{"contains(obj, 'x')", bytecode.BBool(true)},
+	{"indexOf(arr, 'c')", bytecode.BInt(2)},
+	{"indexOf(arr, 'z')", bytecode.BInt(-1)},
+	// statistics
+	{"sum(samples)", bytecode.BInt(160)},
+	{"sum(mixed)", bytecode.BFloat(6.5)},
+	{"sum([0.1, 0.2, 0.3]) == 0.6", bytecode.BBool(true)},
+	{"avg(samples)", bytecode.BFloat(32)},
+	{"median(samples)", bytecode.BFloat(35)},
+	{"median([1, 2, 3, 4])", bytecode.BFloat(2.5)},
+	{"percentile(samples, 0)", bytecode.BFloat(15)},
+	{"percentile(samples, 100)", bytecode.BFloat(50)},
+	{"percentile(samples, 40)", bytecode.BFloat(29)},
+	{"percentile(samples, 99) > 49", bytecode.BBool(true)},
+	{"stddev([2, 4, 4, 4, 5, 5, 7, 9])", bytecode.BFloat(2)},
+	{"stddev([1000000000.1, 1000000000.1])", bytecode.BFloat(0)},
+	{"histogram(samples, [20, 40])", bytecode.BArray{bytecode.BInt(1), bytecode.BInt(2), bytecode.BInt(2)}},
+	// objects
+	{"keys(obj)[0]", bytecode.BStr("x")},
+	{"values(obj)[1]", bytecode.BInt(2)},
+	{"has(obj, 'z')", bytecode.BBool(false)},
+	{"get(obj, 'z', 10)", bytecode.BInt(10)},
+	{"get(obj, 'y', 10)", bytecode.BInt(2)},
+	// json
+	{"json.parse(raw).user.name", bytecode.BStr("ann")},
+	{"json.parse(raw).user.tags[1]", bytecode.BStr("b")},
+	{"json.parse(raw).n + 1", bytecode.BInt(4)},
+	{"json.parse(raw).x", bytecode.BFloat(1.5)},
+	{"json.parse(raw).ok", bytecode.BBool(true)},
+	{"json.parse(raw).nil", bytecode.BNull{}},
+	{"json.parse('  [1, 2.0, 1e2]  ')", bytecode.BArray{bytecode.BInt(1), bytecode.BFloat(2), bytecode.BFloat(100)}},
+	{"json.stringify(obj, true)", bytecode.BStr(`{"x":1,"y":2}`)},
+	{"json.stringify([1, 2.5, 'a', true])", bytecode.BStr(`[1,2.5,"a",true]`)},
+	{"json.stringify(json.parse(raw), true)", bytecode.BStr(`{"n":3,"nil":null,"ok":true,"user":{"name":"ann","tags":["a","b"]},"x":1.5}`)},
+	// conversion
+	{"int('42') + 1", bytecode.BInt(43)},
+	{"int(f)", bytecode.BInt(2)},
+	{"int(true)", bytecode.BInt(1)},
+	{"float('1.5')", bytecode.BFloat(1.5)},
+	{"str(f) + '!'", bytecode.BStr("2.5!")},
+	{"str(i)", bytecode.BStr("-7")},
+	{"bool(arr)", bytecode.BBool(true)},
+	{"type(obj)", bytecode.BStr("object")},
+}
+
+func TestBuiltins(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	for _, tt := range validStringsInOut {
+		t.Run(tt.in, func(t *testing.T) {
+			result, err := m.EvalString(tt.in, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !runtime.Eq(tt.expected, result.Val) {
+				t.Errorf("Expected %s, got %s", tt.expected, result.Val)
+			}
+		})
+	}
+}
+
+var invalidStrings = []string{
+	"abs('a')",
+	"min(1, 'a')",
+	"sqrt(0 - 1)",
+	"lower(1)",
+	"join([1, 2], ',')",
+	"len(1)",
+	"keys(arr)",
+	"int('abc')",
+	"int(1.0e300)",
+	"float(arr)",
+	"sum([])",
+	"avg(arr)",
+	"percentile(samples, 101)",
+	"histogram(samples, [40, 20])",
+	"sum([9223372036854775807, 1])",
+	"json.parse('{')",
+	"json.parse('1 2')",
+	"json.parse(1)",
+	"json.stringify(len)",
+	"json.stringify(1, true, 2)",
+	"json.stringify()",
+	"format(1)",
+	"format('{} {}', 1)",
+	"format('{:d}', 'a')",
+}
+
+func TestInvalidBuiltins(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	for _, tt := range invalidStrings {
+		t.Run(tt, func(t *testing.T) {
+			_, err := m.EvalString(tt, env)
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	tests := []struct {
+		in     string
+		target any
+	}{
+		{"abs('a')", new(*runtime.TypeError)},
+		{"lower(1)", new(*runtime.TypeError)},
+		{"avg(arr)", new(*runtime.TypeError)},
+		{"format('{:d}', 'a')", new(*runtime.TypeError)},
+		{"'%d' % 'a'", new(*runtime.TypeError)},
+		{"'%d %d' % [i]", new(*runtime.TypeError)},
+		{"sqrt(0 - 1)", new(*runtime.ValueError)},
+		{"int('abc')", new(*runtime.ValueError)},
+		{"sum([])", new(*runtime.ValueError)},
+		{"json.parse('{')", new(*runtime.ValueError)},
+		{"'{:z}'.format(1)", new(*runtime.ValueError)},
+		{"format('{} {}', 1)", new(*runtime.IndexError)},
+	}
+	for _, tt := range tests {
+		_, err := m.EvalString(tt.in, env)
+		if !errors.As(err, tt.target) {
+			t.Errorf("%s: expected a %T, got %v", tt.in, tt.target, err)
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	_, err := m.EvalString("median([])", env)
+	if !errors.Is(err, stdlib.ErrEmptyArray) {
+		t.Errorf("Expected ErrEmptyArray, got %v", err)
+	}
+	_, err = m.EvalString("avg(mixed + ['a'])", env)
+	var typeErr *stdlib.ElementTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Expected an ElementTypeError, got %v", err)
+	}
+	if typeErr.Fn != "avg" || typeErr.Index != 3 || typeErr.Typename != "string" {
+		t.Errorf("Wrong error fields %+v", typeErr)
+	}
+}
+
+func TestAggregatesCountTowardsMaxInstructions(t *testing.T) {
+	big := make(bytecode.BArray, 2000)
+	for i := range big {
+		big[i] = bytecode.BInt(i)
+	}
+	bigEnv := vm.VMEnv{"big": big}
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest, MaxInstructions: 1000})
+	if _, err := m.EvalString("percentile(big, 99)", bigEnv); !errors.Is(err, vm.ErrBudgetExceeded) {
+		t.Errorf("Expected sorting 2000 elements to exceed 1000 instructions, got %v", err)
+	}
+	m = vm.New(vm.Params{StdlibVersion: stdlib.Latest, MaxInstructions: 3000})
+	if _, err := m.EvalString("percentile(big, 99)", bigEnv); err != nil {
+		t.Error(err)
+	}
+	// histogram is charged for the bounds too
+	m = vm.New(vm.Params{StdlibVersion: stdlib.Latest, MaxInstructions: 1000})
+	if _, err := m.EvalString("histogram([1], big)", bigEnv); !errors.Is(err, vm.ErrBudgetExceeded) {
+		t.Errorf("Expected 2000 bounds to exceed 1000 instructions, got %v", err)
+	}
+}
+
+func TestSumInfinity(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	infEnv := vm.VMEnv{"inf": bytecode.BFloat(math.Inf(1))}
+	tests := []struct {
+		in       string
+		expected bytecode.BVal
+	}{
+		{"sum([1.5, inf])", bytecode.BFloat(math.Inf(1))},
+		{"sum([inf, 1.5, 2])", bytecode.BFloat(math.Inf(1))},
+		{"sum([1.5, 0 - inf])", bytecode.BFloat(math.Inf(-1))},
+		{"avg([1.5, inf])", bytecode.BFloat(math.Inf(1))},
+	}
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, infEnv)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if result.Val != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, result.Val)
+		}
+	}
+	result, err := m.EvalString("sum([inf, 0 - inf])", infEnv)
+	if err != nil || !math.IsNaN(float64(result.Val.(bytecode.BFloat))) {
+		t.Errorf("Expected NaN, got %v, %v", result.Val, err)
+	}
+}
+
+func TestJSONParseCountsTowardsMaxMemory(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest, MaxMemory: 10})
+	if _, err := m.EvalString("json.parse('[1, 2, 3]')", env); err != nil {
+		t.Error(err)
+	}
+	if _, err := m.EvalString("json.parse('[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]')", env); err == nil {
+		t.Error("Expected an out of memory error, got nil")
+	}
+}
+
+func TestStdlibDisabledByDefault(t *testing.T) {
+	m := vm.New(vm.Params{})
+	_, err := m.EvalString("len(arr)", env)
+	if err == nil {
+		t.Fatal("Expected a NameError, got nil")
+	}
+}
+
+func TestEnvShadowsBuiltins(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	shadowed := vm.CloneEnv(env)
+	shadowed["len"] = vm.WrapFn("len", func(x bytecode.BVal) bytecode.BVal {
+		return bytecode.BInt(100)
+	})
+	result, err := m.EvalString("len(arr)", shadowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !runtime.Eq(bytecode.BInt(100), result.Val) {
+		t.Errorf("Expected 100, got %s", result.Val)
+	}
+}
@@ -0,0 +1,108 @@
+package stdlib
+
+import (
+	"strings"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+// Helper for functions of the form f(s) -> s
+func strToStrFn(name string, f func(string) string) BFunc {
+	return newFn(name, 1, func(args []BVal) (BVal, error) {
+		s, err := strArg(name, "s", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return BStr(f(s)), nil
+	})
+}
+
+var Lower = strToStrFn("lower", strings.ToLower)
+var Upper = strToStrFn("upper", strings.ToUpper)
+var Trim = strToStrFn("trim", strings.TrimSpace)
+
+var Split = newFn("split", 2, func(args []BVal) (BVal, error) {
+	s, err := strArg("split", "s", args[0])
+	if err != nil {
+		return nil, err
+	}
+	sep, err := strArg("split", "sep", args[1])
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(s, sep)
+	result := make(BArray, len(parts))
+	for i, part := range parts {
+		result[i] = BStr(part)
+	}
+	return result, nil
+})
+
+var Join = newFn("join", 2, func(args []BVal) (BVal, error) {
+	arr, err := arrArg("join", "arr", args[0])
+	if err != nil {
+		return nil, err
+	}
+	sep, err := strArg("join", "sep", args[1])
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(arr))
+	for i, x := range arr {
+		s, ok := x.(BStr)
+		if !ok {
+			return nil, errValue("join", "expected an array of strings, found %s at index %d", x.Typename(), i)
+		}
+		strs[i] = string(s)
+	}
+	return BStr(strings.Join(strs, sep)), nil
+})
+
+// Helper for functions of the form f(s, t) -> bool
+func strPredicateFn(name, param string, f func(string, string) bool) BFunc {
+	return newFn(name, 2, func(args []BVal) (BVal, error) {
+		s, err := strArg(name, "s", args[0])
+		if err != nil {
+			return nil, err
+		}
+		t, err := strArg(name, param, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return BBool(f(s, t)), nil
+	})
+}
+
+var StartsWith = strPredicateFn("startsWith", "prefix", strings.HasPrefix)
+var EndsWith = strPredicateFn("endsWith", "suffix", strings.HasSuffix)
+
+var Replace = newFn("replace", 3, func(args []BVal) (BVal, error) {
+	s, err := strArg("replace", "s", args[0])
+	if err != nil {
+		return nil, err
+	}
+	old, err := strArg("replace", "old", args[1])
+	if err != nil {
+		return nil, err
+	}
+	new, err := strArg("replace", "new", args[2])
+	if err != nil {
+		return nil, err
+	}
+	return BStr(strings.ReplaceAll(s, old, new)), nil
+})
+
+// format(fmt, args...) formats a string like Python's str.format, see runtime.FormatBraces
+var Format = BFunc{
+	Name:     "format",
+	NumArgs:  1,
+	Variadic: true,
+	Fn: func(args []BVal) (BVal, error) {
+		format, err := strArg("format", "fmt", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return runtime.FormatBraces(format, args[1:])
+	},
+}
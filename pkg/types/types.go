@@ -0,0 +1,364 @@
+// Package types describes the types of values in the expression language, so that expressions can be checked
+// before they're evaluated. See compiler.Schema.
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/thomastay/expression_language/pkg/bytecode"
+)
+
+type Type interface {
+	isType()
+	String() string
+}
+
+func (Basic) isType()    {}
+func (anyType) isType()  {}
+func (Array) isType()    {}
+func (Object) isType()   {}
+func (Function) isType() {}
+func (Union) isType()    {}
+
+// The primitive types. Their names are the same as BVal.Typename()
+type Basic string
+
+const (
+	Int    Basic = "int"
+	Float  Basic = "float"
+	String Basic = "string"
+	Bool   Basic = "bool"
+	Null   Basic = "null"
+)
+
+func (t Basic) String() string {
+	return string(t)
+}
+
+type anyType struct{}
+
+// Any value. Nothing is reported about values of type Any, so use it for variables whose type isn't known,
+// and for host values that overload operators.
+var Any Type = anyType{}
+
+func (anyType) String() string {
+	return "any"
+}
+
+// An array whose elements are all of type Elem. A nil Elem is the same as Any
+type Array struct {
+	Elem Type
+}
+
+func (t Array) String() string {
+	return fmt.Sprintf("array[%s]", elemOf(t))
+}
+
+func elemOf(t Array) Type {
+	if t.Elem == nil {
+		return Any
+	}
+	return t.Elem
+}
+
+// An object with known fields, like a BObj. Accessing a field that isn't declared is an error.
+//
+//	types.Object{"name": types.String, "age": types.Int}
+type Object map[string]Type
+
+func (t Object) String() string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = name + ": " + t[name].String()
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// A function, see Func
+type Function struct {
+	Params []Type
+	// If true, the last param can be passed any number of times, including zero
+	Variadic bool
+	Result   Type
+}
+
+// A function that takes in params and returns result, e.g. for func(x float64, n int) string
+//
+//	types.Func(types.String, types.Float, types.Int)
+func Func(result Type, params ...Type) Function {
+	return Function{Params: params, Result: result}
+}
+
+// Like Func, but the last param can be passed any number of times
+func VariadicFunc(result Type, params ...Type) Function {
+	return Function{Params: params, Variadic: true, Result: result}
+}
+
+func (t Function) String() string {
+	params := make([]string, len(t.Params))
+	for i, param := range t.Params {
+		params[i] = param.String()
+		if t.Variadic && i == len(t.Params)-1 {
+			params[i] = "..." + params[i]
+		}
+	}
+	return fmt.Sprintf("func(%s) %s", strings.Join(params, ", "), t.Result)
+}
+
+// The minimum number of arguments that the function must be called with
+func (t Function) MinArgs() int {
+	if t.Variadic {
+		return len(t.Params) - 1
+	}
+	return len(t.Params)
+}
+
+// The type of the i-th argument
+func (t Function) Param(i int) Type {
+	if t.Variadic && i >= len(t.Params)-1 {
+		return t.Params[len(t.Params)-1]
+	}
+	return t.Params[i]
+}
+
+// A value that can be of any of the types in the union, e.g. the result of a ternary whose branches have
+// different types. Create unions with UnionOf, which keeps them simple.
+type Union []Type
+
+// The union of ts. Nested unions are flattened and duplicates are removed, so a union of one type is just that
+// type. A union with Any is Any.
+func UnionOf(ts ...Type) Type {
+	var members Union
+	var add func(t Type) bool
+	add = func(t Type) bool {
+		switch t := t.(type) {
+		case nil:
+			return true
+		case anyType:
+			return false
+		case Union:
+			for _, member := range t {
+				if !add(member) {
+					return false
+				}
+			}
+			return true
+		}
+		if !containsIdentical(members, t) {
+			members = append(members, t)
+		}
+		return true
+	}
+	for _, t := range ts {
+		if !add(t) {
+			return Any
+		}
+	}
+	switch len(members) {
+	case 0:
+		return Any
+	case 1:
+		return members[0]
+	default:
+		return members
+	}
+}
+
+func containsIdentical(ts []Type, t Type) bool {
+	for _, u := range ts {
+		if Identical(u, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// A value of type t, or null. Use it for optional fields, e.g. types.Object{"email": types.Nullable(types.String)}
+func Nullable(t Type) Type {
+	return UnionOf(t, Null)
+}
+
+// t without null. Returns Any if t is Null
+func NonNull(t Type) Type {
+	var members []Type
+	for _, member := range Members(t) {
+		if member != Null {
+			members = append(members, member)
+		}
+	}
+	return UnionOf(members...)
+}
+
+// The types in a union, or just t if it isn't a union
+func Members(t Type) []Type {
+	if union, ok := t.(Union); ok {
+		return union
+	}
+	return []Type{t}
+}
+
+func (t Union) String() string {
+	members := make([]string, len(t))
+	for i, member := range t {
+		members[i] = member.String()
+	}
+	return strings.Join(members, " | ")
+}
+
+// What BVal.Typename() returns for values of type t, e.g. "array" for an Array, or "any" for Any
+func Typename(t Type) string {
+	switch t := t.(type) {
+	case Basic:
+		return string(t)
+	case Array:
+		return "array"
+	case Object:
+		return "object"
+	case Function:
+		return "function"
+	default:
+		return t.String()
+	}
+}
+
+// Reports whether a value of type t can be used where a value of type to is expected.
+// Ints can be used as floats, and objects can have more fields than expected. A union can be used if all of its
+// members can, and a value can be used as a union if it can be used as one of its members.
+func AssignableTo(t, to Type) bool {
+	if t == Any || to == Any {
+		return true
+	}
+	if union, ok := t.(Union); ok {
+		for _, member := range union {
+			if !AssignableTo(member, to) {
+				return false
+			}
+		}
+		return true
+	}
+	switch to := to.(type) {
+	case Union:
+		for _, member := range to {
+			if AssignableTo(t, member) {
+				return true
+			}
+		}
+		return false
+	case Basic:
+		return t == to || (t == Int && to == Float)
+	case Array:
+		arr, ok := t.(Array)
+		return ok && AssignableTo(elemOf(arr), elemOf(to))
+	case Object:
+		obj, ok := t.(Object)
+		if !ok {
+			return false
+		}
+		for name, fieldType := range to {
+			field, ok := obj[name]
+			if !ok || !AssignableTo(field, fieldType) {
+				return false
+			}
+		}
+		return true
+	case Function:
+		_, ok := t.(Function)
+		return ok
+	default:
+		return false
+	}
+}
+
+// Reports whether t and u are the same type
+func Identical(t, u Type) bool {
+	switch t := t.(type) {
+	case Array:
+		arr, ok := u.(Array)
+		return ok && Identical(elemOf(t), elemOf(arr))
+	case Object:
+		obj, ok := u.(Object)
+		if !ok || len(obj) != len(t) {
+			return false
+		}
+		for name, fieldType := range t {
+			field, ok := obj[name]
+			if !ok || !Identical(fieldType, field) {
+				return false
+			}
+		}
+		return true
+	case Function:
+		fn, ok := u.(Function)
+		if !ok || len(fn.Params) != len(t.Params) || fn.Variadic != t.Variadic || !Identical(t.Result, fn.Result) {
+			return false
+		}
+		for i := range t.Params {
+			if !Identical(t.Params[i], fn.Params[i]) {
+				return false
+			}
+		}
+		return true
+	case Union:
+		union, ok := u.(Union)
+		if !ok || len(union) != len(t) {
+			return false
+		}
+		// Unions have no duplicates, so they're identical if every member of t is in u
+		for _, member := range t {
+			if !containsIdentical(union, member) {
+				return false
+			}
+		}
+		return true
+	default:
+		return t == u
+	}
+}
+
+// The type of a value, e.g. to build a schema from an existing env. Functions take in and return Any, since
+// a BFunc doesn't know the types of its arguments. Host values are Any.
+func Of(val bytecode.BVal) Type {
+	switch val := val.(type) {
+	case bytecode.BInt:
+		return Int
+	case bytecode.BFloat:
+		return Float
+	case bytecode.BStr:
+		return String
+	case bytecode.BBool:
+		return Bool
+	case bytecode.BNull:
+		return Null
+	case bytecode.BArray:
+		elems := make([]Type, len(val))
+		for i, x := range val {
+			elems[i] = Of(x)
+		}
+		return Array{Elem: UnionOf(elems...)}
+	case bytecode.BObj:
+		obj := make(Object, len(val))
+		for name, field := range val {
+			obj[name] = Of(field)
+		}
+		return obj
+	case bytecode.BFunc:
+		numParams := val.NumArgs
+		if val.Variadic {
+			numParams++
+		}
+		params := make([]Type, numParams)
+		for i := range params {
+			params[i] = Any
+		}
+		return Function{Params: params, Variadic: val.Variadic, Result: Any}
+	default:
+		return Any
+	}
+}
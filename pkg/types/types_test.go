@@ -0,0 +1,103 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/thomastay/expression_language/pkg/bytecode"
+	. "github.com/thomastay/expression_language/pkg/types"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		t        Type
+		expected string
+	}{
+		{Int, "int"},
+		{Any, "any"},
+		{Array{Elem: String}, "array[string]"},
+		{Array{}, "array[any]"},
+		{Object{"b": Int, "a": Array{Elem: Bool}}, "{a: array[bool], b: int}"},
+		{Func(Float, Int, String), "func(int, string) float"},
+		{VariadicFunc(String, Int, String), "func(int, ...string) string"},
+		{Nullable(Array{Elem: UnionOf(Int, Float)}), "array[int | float] | null"},
+	}
+	for _, tt := range tests {
+		if got := tt.t.String(); got != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestAssignableTo(t *testing.T) {
+	tests := []struct {
+		t, to    Type
+		expected bool
+	}{
+		{Int, Int, true},
+		{Int, Float, true},
+		{Float, Int, false},
+		{Bool, Int, false},
+		{String, Any, true},
+		{Any, String, true},
+		{Array{Elem: Int}, Array{Elem: Float}, true},
+		{Array{Elem: String}, Array{Elem: Int}, false},
+		{Array{}, Array{Elem: Int}, true},
+		{Object{"a": Int, "b": String}, Object{"a": Float}, true},
+		{Object{"a": Int}, Object{"a": Int, "b": String}, false},
+		{Func(Int), Func(String, Int), true},
+		{Func(Int), Int, false},
+		{Int, Nullable(Float), true},
+		{Nullable(Int), Int, false},
+		{UnionOf(Int, Float), Float, true},
+		{UnionOf(Int, String), UnionOf(String, Bool, Int), true},
+	}
+	for _, tt := range tests {
+		if got := AssignableTo(tt.t, tt.to); got != tt.expected {
+			t.Errorf("AssignableTo(%s, %s): expected %v, got %v", tt.t, tt.to, tt.expected, got)
+		}
+	}
+}
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		val      bytecode.BVal
+		expected Type
+	}{
+		{bytecode.BInt(1), Int},
+		{bytecode.BNull{}, Null},
+		{bytecode.BArray{bytecode.BInt(1), bytecode.BInt(2)}, Array{Elem: Int}},
+		{bytecode.BArray{bytecode.BInt(1), bytecode.BStr("a")}, Array{Elem: UnionOf(Int, String)}},
+		{bytecode.BArray{}, Array{Elem: Any}},
+		{bytecode.BObj{"x": bytecode.BFloat(1)}, Object{"x": Float}},
+		{bytecode.BFunc{Name: "f", NumArgs: 2}, Func(Any, Any, Any)},
+		{bytecode.BFunc{Name: "f", NumArgs: 1, Variadic: true}, VariadicFunc(Any, Any, Any)},
+	}
+	for _, tt := range tests {
+		if got := Of(tt.val); !Identical(got, tt.expected) {
+			t.Errorf("Of(%v): expected %s, got %s", tt.val, tt.expected, got)
+		}
+	}
+}
+
+func TestUnionOf(t *testing.T) {
+	tests := []struct {
+		union    Type
+		expected Type
+	}{
+		{UnionOf(Int), Int},
+		{UnionOf(Int, Int), Int},
+		{UnionOf(Int, String, Any), Any},
+		{UnionOf(UnionOf(Int, Null), UnionOf(Null, String)), Union{Int, Null, String}},
+		{UnionOf(Array{Elem: Int}, Array{Elem: Int}), Array{Elem: Int}},
+		{NonNull(Nullable(String)), String},
+		{NonNull(Null), Any},
+	}
+	for _, tt := range tests {
+		if !Identical(tt.union, tt.expected) {
+			t.Errorf("Expected %s, got %s", tt.expected, tt.union)
+		}
+	}
+	if !Identical(UnionOf(Int, String), UnionOf(String, Int)) {
+		t.Errorf("Expected the order of a union not to matter")
+	}
+}
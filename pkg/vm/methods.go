@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"context"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+)
+
+// A table of methods that can be called on primitive values, e.g. s.upper()
+// The outer key is the typename of the receiver (see BVal.Typename()), the inner key is the method name.
+// The receiver is always passed in as the first argument, so a method like s.split(',') has NumArgs == 2
+type MethodTable map[string]map[string]BFunc
+
+// Registers a method on all values of a type, overriding any builtin method of the same name.
+// typename is what BVal.Typename() returns for that type, e.g. "string", "array", "int" or "float".
+// fn receives the receiver as its first argument, so it must take at least one argument.
+//
+//	m.RegisterMethod("string", "shout", vm.WrapFn("shout", func(s string) string {
+//		return s + "!"
+//	}))
+func (vm *VMState) RegisterMethod(typename, name string, fn BFunc) {
+	if fn.NumArgs < 1 {
+		panic("A method must take in its receiver as the first argument")
+	}
+	if vm.methods == nil {
+		vm.methods = make(MethodTable)
+	}
+	methods, ok := vm.methods[typename]
+	if !ok {
+		methods = make(map[string]BFunc)
+		vm.methods[typename] = methods
+	}
+	methods[name] = fn
+}
+
+// Looks up a method on a value, first in the methods registered on the VM, then in the builtins.
+// The method returned is bound to its receiver, so it can be called like a regular function.
+func (vm *VMState) lookupMethod(recv BVal, name string) (BFunc, bool) {
+	typename := recv.Typename()
+	method, ok := vm.methods[typename][name]
+	if !ok {
+		method, ok = stdlib.Methods[typename][name]
+		if !ok {
+			return BFunc{}, false
+		}
+	}
+	return bindMethod(recv, method), true
+}
+
+func bindMethod(recv BVal, method BFunc) BFunc {
+	withRecv := func(args []BVal) []BVal {
+		argsWithRecv := make([]BVal, 0, len(args)+1)
+		argsWithRecv = append(argsWithRecv, recv)
+		return append(argsWithRecv, args...)
+	}
+	bound := BFunc{
+		Fn: func(args []BVal) (BVal, error) {
+			return method.Fn(withRecv(args))
+		},
+		NumArgs:  method.NumArgs - 1,
+		Name:     recv.Typename() + "." + method.Name,
+		Variadic: method.Variadic,
+	}
+	if method.FnContext != nil {
+		bound.FnContext = func(ctx context.Context, args []BVal) (BVal, error) {
+			return method.FnContext(ctx, withRecv(args))
+		}
+	}
+	if method.Cost != nil {
+		bound.Cost = func(args []BVal) int {
+			return method.Cost(withRecv(args))
+		}
+	}
+	return bound
+}
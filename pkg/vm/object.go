@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
+)
+
+// Implements base.name. Looks in order at:
+//  1. The fields of a BObj, or the attributes of an Object
+//  1. The methods registered on the VM and the builtin methods, see lookupMethod
+//  1. The methods of a MethodCaller
+func (vm *VMState) loadAttr(base BVal, name string) (BVal, error) {
+	switch obj := base.(type) {
+	case BObj:
+		if val, ok := obj[name]; ok {
+			return val, nil
+		}
+	case Object:
+		val, ok, err := obj.GetAttr(name)
+		if err != nil {
+			return nil, &runtime.HostError{
+				Fn:  base.Typename() + "." + name,
+				Err: fmt.Errorf("could not get attribute %s of %s object: %w", name, base.Typename(), err),
+			}
+		}
+		if ok {
+			if val == nil {
+				val = BNull{}
+			}
+			return val, nil
+		}
+	}
+	// Not a field, so try the methods on the type of base
+	if method, ok := vm.lookupMethod(base, name); ok {
+		return method, nil
+	}
+	if caller, ok := base.(MethodCaller); ok {
+		return bindHostMethod(caller, name), nil
+	}
+	return nil, &runtime.AttributeError{Type: base.Typename(), Name: name}
+}
+
+// Returns a function that calls the method name on recv. Since we can't tell if the method exists
+// until it's called, a missing method is only reported when the function is called.
+func bindHostMethod(recv MethodCaller, name string) BFunc {
+	return BFunc{
+		Fn: func(args []BVal) (BVal, error) {
+			val, ok, err := recv.CallMethod(name, args)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, &runtime.AttributeError{Type: recv.Typename(), Name: name}
+			}
+			if val == nil {
+				val = BNull{}
+			}
+			return val, nil
+		},
+		NumArgs:  0,
+		Name:     recv.Typename() + "." + name,
+		Variadic: true,
+	}
+}
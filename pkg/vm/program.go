@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/compiler"
+)
+
+// A compiled expression that is safe to evaluate from many goroutines at once.
+// A VMState reuses its stack between evaluations, so it can only run one evaluation at a time.
+// A Program instead takes a VMState from a pool for every evaluation.
+//
+//	program, err := m.Compile("radius * 2")
+//	// ... from any goroutine
+//	result, err := program.Eval(env)
+//
+// Note that the env, and any host functions and values in it, must also be safe to use concurrently.
+type Program struct {
+	compilation compiler.Compilation
+	pool        sync.Pool
+}
+
+// Compiles s into a Program that uses this VM's params, builtins and methods.
+// Changes to the VM after this, like RegisterMethod, don't affect the Program.
+func (vm *VMState) Compile(s string) (*Program, error) {
+	comp, err := vm.compileString(s)
+	if err != nil {
+		return nil, err
+	}
+	return vm.NewProgram(comp)
+}
+
+// Like Compile, for an expression that has already been compiled.
+// Returns an error if the compilation has errors.
+func (vm *VMState) NewProgram(compilation compiler.Compilation) (*Program, error) {
+	if err := compileErrors(compilation); err != nil {
+		return nil, err
+	}
+	// Snapshot the VM, since it may be changed after this. Evaluation only reads the methods and builtins,
+	// so every pooled VM can share this copy
+	template := VMState{
+		params:   vm.params,
+		methods:  cloneMethodTable(vm.methods),
+		builtins: vm.builtins,
+	}
+	p := &Program{compilation: compilation}
+	p.pool.New = func() any {
+		state := template
+		state.stack = make(Stack, 0, 4)
+		return &state
+	}
+	return p, nil
+}
+
+func (p *Program) Eval(env Resolver) (Result, error) {
+	return p.EvalContext(context.Background(), env)
+}
+
+// See VMState.EvalContext
+func (p *Program) EvalContext(ctx context.Context, env Resolver) (Result, error) {
+	state := p.pool.Get().(*VMState)
+	defer p.pool.Put(state)
+	return state.EvalContext(ctx, p.compilation, env)
+}
+
+func cloneMethodTable(methods MethodTable) MethodTable {
+	if methods == nil {
+		return nil
+	}
+	result := make(MethodTable, len(methods))
+	for typename, fns := range methods {
+		result[typename] = make(map[string]BFunc, len(fns))
+		for name, fn := range fns {
+			result[typename][name] = fn
+		}
+	}
+	return result
+}
@@ -7,76 +7,234 @@
 package vm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"strings"
 
+	"github.com/thomastay/expression_language/pkg/ast"
 	. "github.com/thomastay/expression_language/pkg/bytecode"
 	"github.com/thomastay/expression_language/pkg/compiler"
-	"github.com/thomastay/expression_language/pkg/parser"
 	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
 )
 
 var defaultMaxInstructions = 1000
-var defaultMaxMemory = 1048576 // 2 ** 20
+var defaultMaxMemoryBytes = 16 * 1048576 // 16 MiB
 
 func New(params Params) VMState {
 	if params.MaxInstructions == 0 {
 		params.MaxInstructions = defaultMaxInstructions
 	}
-	if params.MaxMemory == 0 {
-		params.MaxMemory = defaultMaxMemory
+	if params.MaxMemoryBytes == 0 {
+		params.MaxMemoryBytes = params.MaxMemory * runtime.ValueBytes
+	}
+	if params.MaxMemoryBytes == 0 {
+		params.MaxMemoryBytes = defaultMaxMemoryBytes
 	}
 	return VMState{
-		params: params,
-		stack:  make(Stack, 0, 4), // preallocate some space for items
+		params:   params,
+		stack:    make(Stack, 0, 4), // preallocate some space for items
+		builtins: stdlib.Builtins(params.StdlibVersion),
 	}
 }
 
 type VMEnv map[string]BVal
 
+// Provides the values of variables to Eval.
+// Use this instead of a VMEnv when computing every variable up front is expensive, e.g. if they come from a database.
+// Each variable is resolved at most once per evaluation, the first time it is loaded.
+type Resolver interface {
+	// Returns false if there is no variable called name, in which case the VM falls back to the stdlib.
+	// Errors stop the evaluation, and are returned from Eval wrapped in a *ResolveError
+	Resolve(name string) (val BVal, ok bool, err error)
+}
+
+// A VMEnv is a Resolver that never errors
+func (env VMEnv) Resolve(name string) (BVal, bool, error) {
+	val, ok := env[name]
+	return val, ok, nil
+}
+
+// Adapts a plain function into a Resolver
+type ResolverFunc func(name string) (BVal, bool, error)
+
+func (f ResolverFunc) Resolve(name string) (BVal, bool, error) {
+	return f(name)
+}
+
+// Returned by Eval when a Resolver fails to resolve a variable. Check for it with errors.As
+type ResolveError struct {
+	Name string
+	Err  error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("RuntimeError: could not resolve %s: %s", e.Name, e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// Memoizes the variables resolved during one evaluation
+type resolveCache struct {
+	resolver Resolver
+	resolved map[string]resolved
+	// Variables whose memory has been charged already
+	charged map[string]bool
+}
+
+type resolved struct {
+	val BVal
+	ok  bool
+}
+
+func (c *resolveCache) resolve(name string) (BVal, bool, error) {
+	// Lookups in a VMEnv are already cheap, no need to cache them
+	if env, isEnv := c.resolver.(VMEnv); isEnv {
+		val, ok := env[name]
+		return val, ok, nil
+	}
+	if r, isCached := c.resolved[name]; isCached {
+		return r.val, r.ok, nil
+	}
+	val, ok, err := c.resolver.Resolve(name)
+	if err != nil {
+		return nil, false, &ResolveError{Name: name, Err: err}
+	}
+	if ok && val == nil {
+		val = BNull{}
+	}
+	if c.resolved == nil {
+		c.resolved = make(map[string]resolved)
+	}
+	c.resolved[name] = resolved{val, ok}
+	return val, ok, nil
+}
+
+// Returns the memory to charge for loading the variable name, see runtime.SizeInBytes.
+// Each variable is only charged the first time it's loaded, and scalars aren't charged at all.
+func (c *resolveCache) charge(name string, val BVal) int {
+	switch val.(type) {
+	case BStr, BArray, BObj:
+	default:
+		return 0
+	}
+	if c.charged[name] {
+		return 0
+	}
+	if c.charged == nil {
+		c.charged = make(map[string]bool)
+	}
+	c.charged[name] = true
+	return runtime.SizeInBytes(val)
+}
+
 type VMState struct {
-	params Params
-	stack  Stack
+	params  Params
+	stack   Stack
+	methods MethodTable
+	// Variables from the standard library. The env passed in to Eval shadows these
+	builtins map[string]BVal
 }
 
-// Convenience method if you just want to evaluate a string. Concatenates all compile errors into one
-func (vm *VMState) EvalString(s string, env VMEnv) (Result, error) {
-	expr, err := parser.ParseString(s)
+// Convenience method if you just want to evaluate a string. If s doesn't compile, the error is a
+// *compiler.Diagnostics with all of the compile errors
+func (vm *VMState) EvalString(s string, env Resolver) (Result, error) {
+	comp, err := vm.compileString(s)
 	if err != nil {
 		return Result{}, err
 	}
-	comp := compiler.Compile(expr, compiler.Params{})
-	if len(comp.Errors) > 0 {
-		var errString string
-		for _, c := range comp.Errors {
-			errString += c.Error()
-		}
-		return Result{}, errors.New(errString)
-	}
 	return vm.Eval(comp, env)
 }
 
-func (vm *VMState) Eval(compilation compiler.Compilation, env VMEnv) (Result, error) {
+func (vm *VMState) compileString(s string) (compiler.Compilation, error) {
+	comp := compiler.CompileStringParams(s, compiler.Params{Methods: vm.methods})
+	if err := compileErrors(comp); err != nil {
+		return compiler.Compilation{}, err
+	}
+	return comp, nil
+}
+
+func compileErrors(comp compiler.Compilation) error {
+	if len(comp.Errors) == 0 {
+		return nil
+	}
+	return &compiler.Diagnostics{Source: comp.Source, Errs: comp.Errors}
+}
+
+// Evaluates a compiled expression. env is usually a VMEnv, but can be any Resolver
+func (vm *VMState) Eval(compilation compiler.Compilation, env Resolver) (Result, error) {
+	return vm.EvalContext(context.Background(), compilation, env)
+}
+
+// How many instructions EvalContext executes between checks of its context
+const cancelCheckInterval = 64
+
+// Returned by EvalContext when its context is canceled or its deadline passes.
+// It wraps the context's error, so errors.Is(err, context.DeadlineExceeded) works
+type CanceledError struct {
+	Err error
+	// Where the evaluation stopped
+	Pc            int
+	ExecutedInsts int
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("RuntimeError: evaluation stopped at pc %d after %d instructions: %s", e.Pc, e.ExecutedInsts, e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// Like Eval, but stops early if ctx is canceled or its deadline passes. ctx is checked every few instructions,
+// and before every function call. Functions wrapped with WrapFn that take a context.Context as their first
+// parameter are passed ctx, so that they can stop early too.
+//
+// EvalContext never panics. Host functions that panic return a *HostFunctionError, and bugs in the VM return
+// a *runtime.InternalError.
+func (vm *VMState) EvalContext(ctx context.Context, compilation compiler.Compilation, env Resolver) (_ Result, err error) {
 	executedInsts := 0
 	memoryUsed := 0
 	pc := 0
-	variables := env
-	if variables == nil {
-		variables = make(VMEnv)
+	if env == nil {
+		env = VMEnv{}
 	}
+	variables := resolveCache{resolver: env}
 	stack := vm.stack
 	defer func(stack Stack) {
 		stack.clear()
 		vm.stack = stack
 	}(stack)
+	defer func() {
+		if r := recover(); r != nil {
+			err = &runtime.InternalError{Value: r, Stack: string(debug.Stack()), Pc: pc}
+		}
+		if err != nil {
+			err = newEvalError(err, compilation, pc)
+		}
+	}()
 
 	codes := compilation.Bytecode
 	if vm.params.Debug {
 		fmt.Println("Constant table:")
 		fmt.Println("  ", compilation.Constants)
 	}
+	// nil if ctx can never be canceled, which saves us from checking it
+	done := ctx.Done()
 InstLoop:
-	for pc < codes.Len() && executedInsts < vm.params.MaxInstructions {
+	for pc < codes.Len() {
+		if executedInsts >= vm.params.MaxInstructions {
+			return Result{}, &BudgetExceededError{Limit: vm.params.MaxInstructions, Pc: pc, ExecutedInsts: executedInsts}
+		}
+		if done != nil && executedInsts%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return Result{}, &CanceledError{Err: err, Pc: pc, ExecutedInsts: executedInsts}
+			}
+		}
 		executedInsts++
 		inst := codes.Insts[pc]
 
@@ -90,15 +248,32 @@ InstLoop:
 		case OpLoad:
 			pos := codes.IntData[pc]
 			identName := compilation.Constants[pos].(BStr)
-			val, ok := variables[string(identName)]
-			if !ok {
-				return Result{}, fmt.Errorf("NameError: name %s is not defined", identName)
+			val, ok, err := variables.resolve(string(identName))
+			if err != nil {
+				return Result{}, err
+			}
+			if ok {
+				// Large values in the env count towards the memory limit too
+				memoryUsed += variables.charge(string(identName), val)
+				if memoryUsed > vm.params.MaxMemoryBytes {
+					return Result{}, runtime.ErrOOM
+				}
+			} else {
+				val, ok = vm.builtins[string(identName)]
+				if !ok {
+					return Result{}, &runtime.NameError{Name: string(identName)}
+				}
 			}
 			stack = append(stack, val)
 		// ----------------Binary Operations------------------
 		case OpAdd:
 			b := stack.pop()
 			a := stack.pop()
+			// Check before concatenating, so that we never allocate more than the limit
+			memoryUsed += runtime.AddAllocBytes(a, b)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			result, err := runtime.Add(a, b)
 			if err != nil {
 				return Result{}, err
@@ -110,6 +285,10 @@ InstLoop:
 			pos := codes.IntData[pc]
 			// lookup from constant table
 			b := compilation.Constants[pos]
+			memoryUsed += runtime.AddAllocBytes(a, b)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			result, err := runtime.Add(a, b)
 			if err != nil {
 				return Result{}, err
@@ -136,20 +315,28 @@ InstLoop:
 		case OpMul:
 			b := stack.pop()
 			a := stack.pop()
-			result, err := runtime.Mul(a, b, vm.params.MaxMemory-memoryUsed)
+			result, err := runtime.Mul(a, b, vm.params.MaxMemoryBytes-memoryUsed)
 			if err != nil {
 				return Result{}, err
 			}
+			memoryUsed += runtime.AllocBytes(result)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			stack.push(result)
 		case OpMulImm:
 			a := stack.pop()
 			pos := codes.IntData[pc]
 			// lookup from constant table
 			b := compilation.Constants[pos]
-			result, err := runtime.Mul(a, b, vm.params.MaxMemory-memoryUsed)
+			result, err := runtime.Mul(a, b, vm.params.MaxMemoryBytes-memoryUsed)
 			if err != nil {
 				return Result{}, err
 			}
+			memoryUsed += runtime.AllocBytes(result)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			stack.push(result)
 		case OpDiv:
 			b := stack.pop()
@@ -194,6 +381,11 @@ InstLoop:
 			if err != nil {
 				return Result{}, err
 			}
+			// String formatting creates a new string
+			memoryUsed += runtime.AllocBytes(result)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			stack.push(result)
 		case OpModImm:
 			a := stack.pop()
@@ -204,6 +396,11 @@ InstLoop:
 			if err != nil {
 				return Result{}, err
 			}
+			// String formatting creates a new string
+			memoryUsed += runtime.AllocBytes(result)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
+			}
 			stack.push(result)
 		case OpPow:
 			b := stack.pop()
@@ -284,14 +481,9 @@ InstLoop:
 			// Base is loaded before field, so field pops first
 			field := stack.pop()
 			base := stack.pop()
-			fieldStr := field.(BStr)
-			baseObj, ok := base.(BObj)
-			if !ok {
-				return Result{}, fmt.Errorf("AttributeError: %s object has no attribute %s", base, field)
-			}
-			val, ok := baseObj[string(fieldStr)]
-			if !ok {
-				return Result{}, fmt.Errorf("AttributeError: %s object has no attribute %s", base, field)
+			val, err := vm.loadAttr(base, string(field.(BStr)))
+			if err != nil {
+				return Result{}, err
 			}
 			stack.push(val)
 		// ----------------Unary Operations------------------
@@ -305,7 +497,7 @@ InstLoop:
 				a = runtime.CastBoolToInt(a)
 				stack.push(a)
 			default:
-				return Result{}, fmt.Errorf("TypeError: bad operand type for unary +: %s", a.Typename())
+				return Result{}, &runtime.TypeError{Op: "unary +", Operands: []string{a.Typename()}}
 			}
 		case OpUnaryMinus:
 			a := stack.pop()
@@ -353,27 +545,53 @@ InstLoop:
 			name := stack.pop()
 			bFn, ok := name.(BFunc)
 			if !ok {
-				return Result{}, fmt.Errorf("InterpError: Stack value %s is not a function", name)
+				return Result{}, &runtime.TypeError{Op: "()", Operands: []string{name.Typename()}}
 			}
 			// load params
 			numParams := codes.IntData[pc]
-			if numParams != bFn.NumArgs {
-				return Result{}, fmt.Errorf("RuntimeError: function %s passed wrong number of args, expected %d, got %d", bFn.Name, bFn.NumArgs, numParams)
+			if bFn.Variadic && numParams < bFn.NumArgs {
+				return Result{}, &runtime.TypeError{Op: "()", Operands: []string{bFn.Typename()}, Reason: fmt.Sprintf("function %s passed wrong number of args, expected at least %d, got %d", bFn.Name, bFn.NumArgs, numParams)}
+			}
+			if !bFn.Variadic && numParams != bFn.NumArgs {
+				return Result{}, &runtime.TypeError{Op: "()", Operands: []string{bFn.Typename()}, Reason: fmt.Sprintf("function %s passed wrong number of args, expected %d, got %d", bFn.Name, bFn.NumArgs, numParams)}
 			}
 			params := make([]BVal, numParams)
 			for i := 0; i < numParams; i++ {
 				params[i] = stack.pop()
 			}
-			result, err := bFn.Fn(params)
+			if bFn.Cost != nil {
+				executedInsts += bFn.Cost(params)
+				if executedInsts > vm.params.MaxInstructions {
+					return Result{}, &BudgetExceededError{Limit: vm.params.MaxInstructions, Pc: pc, ExecutedInsts: executedInsts, Fn: bFn.Name}
+				}
+			}
+			if bFn.FnContext != nil {
+				if err := ctx.Err(); err != nil {
+					return Result{}, &CanceledError{Err: err, Pc: pc, ExecutedInsts: executedInsts}
+				}
+			}
+			result, err := callHostFn(ctx, bFn, params, pc)
+			// Prefer reporting the cancellation over whatever error it caused in the function
+			if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+				return Result{}, &CanceledError{Err: ctxErr, Pc: pc, ExecutedInsts: executedInsts}
+			}
+			if _, ok := err.(*HostFunctionError); ok {
+				return Result{}, err
+			}
 			if err != nil {
-				return Result{}, fmt.Errorf("RuntimeError: %w", err)
+				return Result{}, &runtime.HostError{Fn: bFn.Name, Err: err}
+			}
+			// Functions can create values too, e.g. by parsing JSON
+			memoryUsed += runtime.ResultBytes(result, params)
+			if memoryUsed > vm.params.MaxMemoryBytes {
+				return Result{}, runtime.ErrOOM
 			}
 			stack.push(result)
 		// ----------------Array Operations------------------
 		case OpNewArray:
 			n := codes.IntData[pc]
-			memoryUsed += n
-			if memoryUsed > vm.params.MaxMemory {
+			memoryUsed += runtime.ArrayAllocBytes(n)
+			if memoryUsed > vm.params.MaxMemoryBytes {
 				return Result{}, runtime.ErrOOM
 			}
 			vals := make([]BVal, n)
@@ -384,26 +602,105 @@ InstLoop:
 		case OpLoadSubscript:
 			b := stack.pop()
 			a := stack.pop()
+			// Host values can overload indexing, see bytecode.Indexer
+			if result, ok, err := runtime.Index(a, b); ok {
+				if err != nil {
+					return Result{}, err
+				}
+				stack.push(result)
+				break
+			}
 			arr, ok := a.(BArray)
 			if !ok {
-				return Result{}, fmt.Errorf("TypeError: %s object is not subscriptable", a.Typename())
+				return Result{}, &runtime.TypeError{Op: "[]", Operands: []string{a.Typename()}}
 			}
 			b = runtime.CastBoolToInt(b)
 			idx, ok := b.(BInt)
 			if !ok {
-				return Result{}, fmt.Errorf("List index must be an integer, found %s", b.Typename())
+				return Result{}, &runtime.TypeError{Op: "[]", Operands: []string{a.Typename(), b.Typename()}}
 			}
 			if idx < 0 || int(idx) >= len(arr) {
-				return Result{}, fmt.Errorf("Array index %d out of bounds (len %d)", idx, len(arr))
+				return Result{}, &runtime.IndexError{Index: int(idx), Len: len(arr)}
 			}
 			stack.push(arr[idx])
 		default:
-			return Result{}, errors.New("Opcode not impl")
+			return Result{}, &runtime.InternalError{Value: fmt.Sprintf("opcode %s not implemented", inst), Pc: pc}
 		}
 		pc++
 	}
 	val := stack.pop()
-	return Result{Val: val}, nil
+	return Result{Val: val, ExecutedInsts: executedInsts, MemoryUsed: memoryUsed}, nil
+}
+
+// Wraps every error returned by EvalContext with the part of the expression that caused it. If the source is
+// known, the error message points at it:
+//
+//	TypeError: unsupported operand type(s) for +: int and string
+//	 | a + 'x'
+//	 | ^^^^^^^---
+//
+// Use errors.As to get at the underlying error, e.g. a *runtime.TypeError.
+type EvalError struct {
+	Err error
+	// The instruction that failed
+	Pc int
+	// Where instruction Pc came from in the source, if known
+	Span   ast.Span
+	Source string
+}
+
+func newEvalError(err error, compilation compiler.Compilation, pc int) *EvalError {
+	evalErr := &EvalError{Err: err, Pc: pc, Source: compilation.Source}
+	if pc >= 0 && pc < len(compilation.Spans) {
+		evalErr.Span = compilation.Spans[pc]
+	}
+	return evalErr
+}
+
+func (e *EvalError) Error() string {
+	underline := e.Span.Underline(e.Source)
+	if underline == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + "\n" + strings.TrimSuffix(underline, "\n")
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// Returned when a host function panics
+type HostFunctionError struct {
+	Fn string
+	// The value that was passed to panic
+	Value any
+	// The stack trace of the panic
+	Stack string
+	// The call instruction
+	Pc int
+}
+
+func (e *HostFunctionError) Error() string {
+	return fmt.Sprintf("RuntimeError: function %s panicked at pc %d: %v", e.Fn, e.Pc, e.Value)
+}
+
+// Unwraps the value passed to panic, if it's an error
+func (e *HostFunctionError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Calls a function, turning panics into a *HostFunctionError
+func callHostFn(ctx context.Context, bFn BFunc, params []BVal, pc int) (result BVal, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, &HostFunctionError{Fn: bFn.Name, Value: r, Stack: string(debug.Stack()), Pc: pc}
+		}
+	}()
+	if bFn.FnContext != nil {
+		return bFn.FnContext(ctx, params)
+	}
+	return bFn.Fn(params)
 }
 
 type Stack []BVal
@@ -436,12 +733,47 @@ func (stack *Stack) clear() {
 
 type Result struct {
 	Val BVal
+	// How much of the budgets in Params the evaluation used. MemoryUsed is in bytes
+	ExecutedInsts int
+	MemoryUsed    int
+}
+
+// Matches any *BudgetExceededError with errors.Is
+var ErrBudgetExceeded = errors.New("RuntimeError: exceeded the maximum number of instructions")
+
+// Returned when an evaluation runs more than Params.MaxInstructions instructions
+type BudgetExceededError struct {
+	Limit int
+	// Where the evaluation stopped
+	Pc            int
+	ExecutedInsts int
+	// The function whose Cost took the evaluation over the limit, if any
+	Fn string
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Fn != "" {
+		return fmt.Sprintf("RuntimeError: function %s exceeded the maximum number of instructions (%d) at pc %d, after %d instructions", e.Fn, e.Limit, e.Pc, e.ExecutedInsts)
+	}
+	return fmt.Sprintf("RuntimeError: exceeded the maximum number of instructions (%d) at pc %d", e.Limit, e.Pc)
+}
+
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
 }
 
 // Configuring the VM
 type Params struct {
 	MaxInstructions int
-	// The maximum number of values that can be created in the VM
+	// The maximum number of bytes that an evaluation can use. Defaults to 16 MiB.
+	// This counts strings and arrays created by the expression, values returned by functions, and strings,
+	// arrays and objects loaded from the env. See runtime.SizeInBytes for the cost of each value.
+	MaxMemoryBytes int
+	// Deprecated: use MaxMemoryBytes. If MaxMemoryBytes isn't set, it defaults to MaxMemory values of
+	// runtime.ValueBytes each
 	MaxMemory int
-	Debug     bool
+	// The version of the standard library of builtin functions to make available, e.g. stdlib.Latest.
+	// Defaults to stdlib.None, which disables it.
+	StdlibVersion int
+	Debug         bool
 }
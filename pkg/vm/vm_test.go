@@ -1,14 +1,22 @@
 package vm_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/thomastay/expression_language/pkg/bytecode"
 	"github.com/thomastay/expression_language/pkg/compiler"
 	"github.com/thomastay/expression_language/pkg/parser"
 	"github.com/thomastay/expression_language/pkg/runtime"
+	"github.com/thomastay/expression_language/pkg/stdlib"
+	"github.com/thomastay/expression_language/pkg/types"
 	"github.com/thomastay/expression_language/pkg/vm"
 )
 
@@ -267,6 +275,34 @@ var validStringsInOut = []InputOutput{
 	{"10 or unknown1 and unknown2", bytecode.BInt(10)},
 	{"10 ? b : unknownvariable", bytecode.BInt(2)},
 	{"0 ? unknownvar : b", bytecode.BInt(2)},
+	// methods on primitives
+	{"s.upper()", bytecode.BStr("I AM A STRING!")},
+	{"s.lower()", bytecode.BStr("i am a string!")},
+	{"s.len()", bytecode.BInt(14)},
+	{"'a,b,c'.split(',')[2]", bytecode.BStr("c")},
+	{"'a,b,c'.split(',').len()", bytecode.BInt(3)},
+	{"e.startsWith('Echo')", bytecode.BBool(true)},
+	{"e.endsWith('Echo')", bytecode.BBool(false)},
+	{"e.replace('dolphins', 'bats')", bytecode.BStr("Echo location for bats")},
+	{"['a', 'b'].join('-')", bytecode.BStr("a-b")},
+	{"d.len()", bytecode.BInt(2)},
+	{"d.contains(1)", bytecode.BBool(true)},
+	{"d.contains(3)", bytecode.BBool(false)},
+	{"d.indexOf(2.2)", bytecode.BInt(1)},
+	{"(0 - a).abs()", bytecode.BInt(43)},
+	{"(0 - f).abs()", bytecode.BFloat(3.14)},
+	{"f.floor()", bytecode.BFloat(3)},
+	// printf style formatting
+	{"'%d items' % a", bytecode.BStr("43 items")},
+	{"'%s and %s' % [fizz, buzz]", bytecode.BStr("fizz and buzz")},
+	{"'%.2f' % f", bytecode.BStr("3.14")},
+	{"'%5d|%-5d|%05d' % [a, a, 0 - a]", bytecode.BStr("   43|43   |-0043")},
+	{"'%x %#X %o' % [255, 255, 8]", bytecode.BStr("ff 0XFF 10")},
+	{"'%r %s' % [fizz, d]", bytecode.BStr("'fizz' [1, 2.200000]")},
+	{"'100%%' % []", bytecode.BStr("100%")},
+	{"'%+.1e' % 12345", bytecode.BStr("+1.2e+04")},
+	{"'%s' % foo", bytecode.BStr("10.5")},
+	{"'{:.2f} of {}'.format(f, a)", bytecode.BStr("3.14 of 43")},
 }
 
 func TestValidStrings(t *testing.T) {
@@ -324,6 +360,20 @@ var invalidStrings = []string{
 	"[foo(), (2, 3), fooObj.bar][5]",
 	"[1//2nasdijio2 * 5, (2, 3), 35]",
 	"emptyObj + 2",
+	// methods
+	"s.nope()",
+	"s.split(1)",
+	"s.split()",
+	"[1, 2].join(',')",
+	"null.len()",
+	// formatting
+	"'%d' % fizz",
+	"'%d %d' % [a]",
+	"'%d' % [a, b]",
+	"'%q' % a",
+	"'%d' % d",
+	"'{:d}'.format(f)",
+	"'{}'.format()",
 }
 
 func TestInvalidStrings(t *testing.T) {
@@ -341,6 +391,979 @@ func TestInvalidStrings(t *testing.T) {
 	}
 }
 
+func TestRegisterMethod(t *testing.T) {
+	m := vm.New(vm.Params{})
+	m.RegisterMethod("string", "shout", vm.WrapFn("shout", func(s string, n int) string {
+		return s + strings.Repeat("!", n)
+	}))
+	// Overrides the builtin
+	m.RegisterMethod("string", "len", vm.WrapFn("len", func(s bytecode.BVal) bytecode.BVal {
+		return bytecode.BInt(-1)
+	}))
+	// The format string isn't checked at compile time once format is overridden
+	m.RegisterMethod("string", "format", vm.WrapFn("format", func(s string, args ...bytecode.BVal) string {
+		return s + "!"
+	}))
+	tests := []InputOutput{
+		{"fizz.shout(3)", bytecode.BStr("fizz!!!")},
+		{"fizz.len()", bytecode.BInt(-1)},
+		{"fizz.upper()", bytecode.BStr("FIZZ")},
+		{"'{'.format(1)", bytecode.BStr("{!")},
+	}
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, vmSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !runtime.Eq(tt.expected, result.Val) {
+			t.Errorf("Expected %s, got %s", tt.expected, result.Val)
+		}
+	}
+	// Methods are registered per VM
+	other := vm.New(vm.Params{})
+	if _, err := other.EvalString("fizz.shout(3)", vmSeed); err == nil {
+		t.Error("Expected an error, got nil")
+	}
+}
+
+type point struct {
+	X float64 `expr:"x"`
+	Y float64 `expr:"y"`
+}
+
+func TestWrapFnNativeTypes(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["hypot"] = vm.WrapFn("hypot", math.Hypot)
+	env["repeat"] = vm.WrapFn("repeat", strings.Repeat)
+	env["total"] = vm.WrapFn("total", func(xs ...int) int {
+		sum := 0
+		for _, x := range xs {
+			sum += x
+		}
+		return sum
+	})
+	env["midpoint"] = vm.WrapFn("midpoint", func(a, b point) point {
+		return point{(a.X + b.X) / 2, (a.Y + b.Y) / 2}
+	})
+	env["p"] = bytecode.BObj{"x": bytecode.BInt(1), "y": bytecode.BFloat(-4)}
+	env["q"] = bytecode.BObj{"x": bytecode.BInt(3), "y": bytecode.BInt(-1)}
+	env["words"] = vm.WrapFn("words", func(s string) ([]string, error) {
+		if s == "" {
+			return nil, fmt.Errorf("ValueError: empty string")
+		}
+		return strings.Fields(s), nil
+	})
+	env["nowhere"] = vm.WrapFn("nowhere", func() *point { return nil })
+
+	tests := []InputOutput{
+		{"hypot(3, 4)", bytecode.BFloat(5)},
+		{"hypot(3.0, 4)", bytecode.BFloat(5)},
+		{"repeat(fizz, 2)", bytecode.BStr("fizzfizz")},
+		{"total()", bytecode.BInt(0)},
+		{"total(1, 2, 3)", bytecode.BInt(6)},
+		{"midpoint(p, q).x", bytecode.BFloat(2)},
+		{"midpoint(p, q).y", bytecode.BFloat(-2.5)},
+		{"words(e)", bytecode.BArray{bytecode.BStr("Echo"), bytecode.BStr("location"), bytecode.BStr("for"), bytecode.BStr("dolphins")}},
+		{"nowhere()", bytecode.BNull{}},
+	}
+	m := vm.New(vm.Params{})
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, env)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if !runtime.Eq(tt.expected, result.Val) {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, result.Val)
+		}
+	}
+
+	errTests := []struct {
+		in     string
+		index  int
+		errMsg string
+	}{
+		{"hypot(3, 'a')", 1, "TypeError: hypot() argument 1 must be float64, not string"},
+		{"repeat(3, 3)", 0, "TypeError: repeat() argument 0 must be string, not int"},
+		{"repeat(fizz, f)", 1, "argument 1 must be int, not float"},
+		{"total(1, 2, d)", 2, "argument 2 must be int, not array"},
+		{"midpoint(p, d)", 1, "argument 1 must be vm_test.point, not array"},
+		{"hypot(9007199254740993, 1)", 0, "cannot be represented exactly"},
+	}
+	for _, tt := range errTests {
+		_, err := m.EvalString(tt.in, env)
+		var argErr *vm.ArgTypeError
+		if !errors.As(err, &argErr) {
+			t.Errorf("%s: expected an ArgTypeError, got %v", tt.in, err)
+			continue
+		}
+		if argErr.Index != tt.index {
+			t.Errorf("%s: expected argument %d, got %d", tt.in, tt.index, argErr.Index)
+		}
+		if !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %q", tt.in, tt.errMsg, err)
+		}
+		var typeErr *runtime.TypeError
+		if !errors.As(err, &typeErr) || typeErr.Error() != argErr.Error() {
+			t.Errorf("%s: expected a TypeError, got %v", tt.in, typeErr)
+		}
+	}
+	if _, err := m.EvalString("words('')", env); err == nil || !strings.Contains(err.Error(), "ValueError: empty string") {
+		t.Errorf("Expected the function's error, got %v", err)
+	}
+}
+
+func TestWrapFnPanicsOnUnconvertibleSignature(t *testing.T) {
+	fns := []any{
+		10,
+		func(c chan int) {},
+		func() complex128 { return 0 },
+		func(m map[int]string) {},
+		func() (int, int) { return 0, 0 },
+	}
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected WrapFn to panic on %T", fn)
+				}
+			}()
+			vm.WrapFn("fn", fn)
+		}()
+	}
+}
+
+func TestFuncAdapters(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["hypot"] = vm.Func2("hypot", math.Hypot)
+	env["repeat"] = vm.Func2("repeat", strings.Repeat)
+	env["negate"] = vm.Func1("negate", func(b bool) bool { return !b })
+	env["typeOf"] = vm.Func1("typeOf", func(x bytecode.BVal) string { return x.Typename() })
+	env["norm"] = vm.Func1("norm", func(p point) float64 { return math.Hypot(p.X, p.Y) })
+	env["pair"] = vm.Func2("pair", func(a int64, b int) []int64 { return []int64{a, int64(b)} })
+
+	tests := []InputOutput{
+		{"hypot(3, 4)", bytecode.BFloat(5)},
+		{"hypot(3.0, 4.0)", bytecode.BFloat(5)},
+		{"repeat(fizz, 2)", bytecode.BStr("fizzfizz")},
+		{"negate(true)", bytecode.BBool(false)},
+		{"typeOf(d)", bytecode.BStr("array")},
+		{"norm(p)", bytecode.BFloat(5)},
+		{"pair(1, 2)", bytecode.BArray{bytecode.BInt(1), bytecode.BInt(2)}},
+	}
+	env["p"] = bytecode.BObj{"x": bytecode.BInt(3), "y": bytecode.BFloat(-4)}
+	m := vm.New(vm.Params{})
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, env)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if !runtime.Eq(tt.expected, result.Val) {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, result.Val)
+		}
+	}
+
+	errTests := []struct {
+		in     string
+		index  int
+		errMsg string
+	}{
+		{"hypot(3, 'a')", 1, "TypeError: hypot() argument 1 must be float64, not string"},
+		{"repeat(3, 3)", 0, "TypeError: repeat() argument 0 must be string, not int"},
+		{"repeat(fizz, f)", 1, "argument 1 must be int, not float"},
+		{"negate(1)", 0, "argument 0 must be bool, not int"},
+		{"norm(d)", 0, "argument 0 must be vm_test.point, not array"},
+		{"pair(1, 'a')", 1, "argument 1 must be int, not string"},
+		{"hypot(9007199254740993, 1)", 0, "cannot be represented exactly"},
+	}
+	for _, tt := range errTests {
+		_, err := m.EvalString(tt.in, env)
+		var argErr *vm.ArgTypeError
+		if !errors.As(err, &argErr) {
+			t.Errorf("%s: expected an ArgTypeError, got %v", tt.in, err)
+			continue
+		}
+		if argErr.Index != tt.index {
+			t.Errorf("%s: expected argument %d, got %d", tt.in, tt.index, argErr.Index)
+		}
+		if !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %q", tt.in, tt.errMsg, err)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	errDown := errors.New("database is down")
+	calls := make(map[string]int)
+	resolver := vm.ResolverFunc(func(name string) (bytecode.BVal, bool, error) {
+		calls[name]++
+		switch name {
+		case "x":
+			return bytecode.BInt(3), true, nil
+		case "broken":
+			return nil, false, errDown
+		default:
+			return nil, false, nil
+		}
+	})
+	m := vm.New(vm.Params{})
+	compilation := compiler.CompileString("x * x + x")
+	if len(compilation.Errors) > 0 {
+		t.Fatal(compilation.Errors)
+	}
+	for i := 1; i <= 2; i++ {
+		result, err := m.Eval(compilation, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !runtime.Eq(result.Val, bytecode.BInt(12)) {
+			t.Errorf("Expected 12, got %s", result.Val)
+		}
+		// Memoized within an evaluation, but not across them
+		if calls["x"] != i {
+			t.Errorf("Expected x to be resolved %d times, got %d", i, calls["x"])
+		}
+	}
+	// Variables that aren't used are never resolved
+	if _, err := m.EvalString("true or broken", resolver); err != nil {
+		t.Error(err)
+	}
+	if calls["broken"] != 0 {
+		t.Errorf("Expected broken not to be resolved, got %d calls", calls["broken"])
+	}
+
+	_, err := m.EvalString("x + broken", resolver)
+	var resolveErr *vm.ResolveError
+	if !errors.As(err, &resolveErr) || resolveErr.Name != "broken" {
+		t.Errorf("Expected a ResolveError for broken, got %v", err)
+	}
+	if !errors.Is(err, errDown) {
+		t.Errorf("Expected the resolver's error to be wrapped, got %v", err)
+	}
+	if _, err := m.EvalString("missing", resolver); err == nil || !strings.Contains(err.Error(), "NameError") {
+		t.Errorf("Expected a NameError, got %v", err)
+	}
+}
+
+// A host object that computes its attributes lazily
+type account struct {
+	bytecode.HostValue
+	owner    string
+	balance  float64
+	getAttrs int
+}
+
+func (a *account) String() string   { return "account(" + a.owner + ")" }
+func (a *account) IsTruthy() bool   { return true }
+func (a *account) Typename() string { return "account" }
+
+func (a *account) GetAttr(name string) (bytecode.BVal, bool, error) {
+	a.getAttrs++
+	switch name {
+	case "owner":
+		return bytecode.BStr(a.owner), true, nil
+	case "balance":
+		return bytecode.BFloat(a.balance), true, nil
+	case "frozen":
+		return nil, false, errors.New("account service unavailable")
+	}
+	return nil, false, nil
+}
+
+func (a *account) CallMethod(name string, args []bytecode.BVal) (bytecode.BVal, bool, error) {
+	switch name {
+	case "canWithdraw":
+		if len(args) != 1 {
+			return nil, true, errors.New("canWithdraw takes 1 argument")
+		}
+		amount, ok := args[0].(bytecode.BInt)
+		if !ok {
+			return nil, true, errors.New("amount must be an int")
+		}
+		return bytecode.BBool(float64(amount) <= a.balance), true, nil
+	}
+	return nil, false, nil
+}
+
+func TestHostObjects(t *testing.T) {
+	acct := &account{owner: "ada", balance: 100}
+	env := vm.CloneEnv(vmSeed)
+	env["acct"] = acct
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	// Registered methods receive the object as their receiver
+	m.RegisterMethod("account", "describe", vm.WrapFn("describe", func(a *account, prefix string) string {
+		return prefix + a.owner
+	}))
+
+	tests := []InputOutput{
+		{"acct.owner", bytecode.BStr("ada")},
+		{"acct.balance * 2", bytecode.BFloat(200)},
+		{"acct.owner.upper()", bytecode.BStr("ADA")},
+		{"acct.canWithdraw(50)", bytecode.BBool(true)},
+		{"acct.canWithdraw(500)", bytecode.BBool(false)},
+		{"acct.describe('owner: ')", bytecode.BStr("owner: ada")},
+		{"acct ? 1 : 2", bytecode.BInt(1)},
+		{"type(acct)", bytecode.BStr("account")},
+	}
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, env)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if !runtime.Eq(tt.expected, result.Val) {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, result.Val)
+		}
+	}
+	// Attributes are only computed when used
+	acct.getAttrs = 0
+	if _, err := m.EvalString("b > 100 ? acct.owner : 1", env); err != nil {
+		t.Error(err)
+	}
+	if acct.getAttrs != 0 {
+		t.Errorf("Expected no attributes to be computed, got %d", acct.getAttrs)
+	}
+
+	errTests := []struct {
+		in     string
+		errMsg string
+	}{
+		{"acct.missing()", "AttributeError: account object has no attribute missing"},
+		{"acct.frozen", "could not get attribute frozen of account object: account service unavailable"},
+		{"acct.canWithdraw('all')", "amount must be an int"},
+	}
+	for _, tt := range errTests {
+		_, err := m.EvalString(tt.in, env)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.in, tt.errMsg, err)
+		}
+	}
+}
+
+// Host value types with operator overloading
+type money struct {
+	bytecode.HostValue
+	cents int64
+}
+
+func (m money) String() string   { return fmt.Sprintf("$%d.%02d", m.cents/100, m.cents%100) }
+func (m money) Typename() string { return "money" }
+func (m money) IsTruthy() bool   { return m.cents != 0 }
+
+func (m money) Add(other bytecode.BVal, reversed bool) (bytecode.BVal, error) {
+	o, ok := other.(money)
+	if !ok {
+		return nil, bytecode.ErrNotImplemented
+	}
+	return money{cents: m.cents + o.cents}, nil
+}
+
+func (m money) Sub(other bytecode.BVal, reversed bool) (bytecode.BVal, error) {
+	o, ok := other.(bytecode.BInt)
+	if !ok {
+		return nil, bytecode.ErrNotImplemented
+	}
+	if reversed {
+		return nil, errors.New("cannot subtract money from an int")
+	}
+	return money{cents: m.cents - int64(o)*100}, nil
+}
+
+// Joins with /, so the order of the operands matters
+// Comparable, but == panics when v holds a slice
+type box struct {
+	bytecode.HostValue
+	v any
+}
+
+func (b box) String() string   { return fmt.Sprint(b.v) }
+func (b box) Typename() string { return "box" }
+
+type path struct {
+	bytecode.HostValue
+	p string
+}
+
+func (p path) String() string   { return p.p }
+func (p path) Typename() string { return "path" }
+
+func (p path) Add(other bytecode.BVal, reversed bool) (bytecode.BVal, error) {
+	o, ok := other.(bytecode.BStr)
+	if !ok {
+		return nil, bytecode.ErrNotImplemented
+	}
+	if reversed {
+		return path{p: string(o) + "/" + p.p}, nil
+	}
+	return path{p: p.p + "/" + string(o)}, nil
+}
+
+type version struct {
+	bytecode.HostValue
+	parts [3]int64
+}
+
+func (v version) String() string   { return fmt.Sprintf("v%d.%d.%d", v.parts[0], v.parts[1], v.parts[2]) }
+func (v version) Typename() string { return "version" }
+
+func (v version) Cmp(other bytecode.BVal) (int, error) {
+	o, ok := other.(version)
+	if !ok {
+		return 0, bytecode.ErrNotImplemented
+	}
+	for i := range v.parts {
+		if v.parts[i] != o.parts[i] {
+			if v.parts[i] < o.parts[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (v version) Eq(other bytecode.BVal) bool {
+	if s, ok := other.(bytecode.BStr); ok {
+		return v.String() == string(s)
+	}
+	cmp, err := v.Cmp(other)
+	return err == nil && cmp == 0
+}
+
+func (v version) Index(i bytecode.BVal) (bytecode.BVal, error) {
+	idx, ok := i.(bytecode.BInt)
+	if !ok || idx < 0 || int(idx) >= len(v.parts) {
+		return nil, fmt.Errorf("IndexError: bad version index %s", i)
+	}
+	return bytecode.BInt(v.parts[idx]), nil
+}
+
+func TestOperatorHooks(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["price"] = money{cents: 1050}
+	env["tax"] = money{cents: 99}
+	env["broke"] = money{}
+	env["v1"] = version{parts: [3]int64{1, 2, 3}}
+	env["v2"] = version{parts: [3]int64{1, 10, 0}}
+	env["acct"] = &account{owner: "ada"}
+	env["p"] = path{p: "x"}
+	env["s"] = bytecode.BStr("s")
+	env["box"] = box{v: []int{1}}
+	m := vm.New(vm.Params{})
+
+	tests := []InputOutput{
+		{"price + tax", money{cents: 1149}},
+		{"price - 1", money{cents: 950}},
+		{"broke ? 1 : 2", bytecode.BInt(2)},
+		{"price ? 1 : 2", bytecode.BInt(1)},
+		{"v1 < v2", bytecode.BBool(true)},
+		{"v2 >= v1", bytecode.BBool(true)},
+		{"v1 == v1", bytecode.BBool(true)},
+		{"v1 != v2", bytecode.BBool(true)},
+		{"v1 == 'v1.2.3'", bytecode.BBool(true)},
+		{"'v1.2.3' == v1", bytecode.BBool(true)},
+		{"v2[1]", bytecode.BInt(10)},
+		// Without hooks, host values are only equal to themselves
+		{"acct == acct", bytecode.BBool(true)},
+		{"acct == price", bytecode.BBool(false)},
+		{"price == price", bytecode.BBool(true)},
+		{"box == box", bytecode.BBool(false)},
+		{"box != box", bytecode.BBool(true)},
+		// Literals on the left stay on the left
+		{"'root' + p", path{p: "root/x"}},
+		{"p + 'y' + 'z'", path{p: "x/y/z"}},
+		{"'root' + s + 'x'", bytecode.BStr("rootsx")},
+		{"s + s + 'x'", bytecode.BStr("ssx")},
+	}
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, env)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if !runtime.Eq(tt.expected, result.Val) {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.expected, result.Val)
+		}
+	}
+
+	errTests := []struct {
+		in     string
+		errMsg string
+	}{
+		{"price + 1", "TypeError: unsupported operand type(s) for +: money and int"},
+		{"1 - price", "cannot subtract money from an int"},
+		{"price * 2", "TypeError: unsupported operand type(s) for *: money and int"},
+		{"v1 < 3", "TypeError: unsupported operand type(s) for <: version and int"},
+		{"v1[5]", "IndexError: bad version index 5"},
+		{"price[0]", "TypeError: money object is not subscriptable"},
+		{"acct + 1", "TypeError: unsupported operand type(s) for +: account and int"},
+		{"1 + price", "TypeError: unsupported operand type(s) for +: int and money"},
+	}
+	for _, tt := range errTests {
+		_, err := m.EvalString(tt.in, env)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.in, tt.errMsg, err)
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["slow"] = vm.WrapFn("slow", func(ctx context.Context, x int) (int, error) {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Second):
+			return x, nil
+		}
+	})
+	m := vm.New(vm.Params{MaxInstructions: 10000})
+
+	// Host functions are passed the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := m.EvalContext(ctx, compiler.CompileString("a + slow(1)"), env)
+	var canceledErr *vm.CanceledError
+	if !errors.As(err, &canceledErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a CanceledError wrapping DeadlineExceeded, got %v", err)
+	}
+	if canceledErr.ExecutedInsts == 0 || canceledErr.Pc == 0 {
+		t.Errorf("Expected the pc and instruction count to be reported, got %+v", canceledErr)
+	}
+	if !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Errorf("Expected the error message to mention the deadline, got %s", err)
+	}
+
+	// Already canceled contexts stop before running anything
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = m.EvalContext(ctx, compiler.CompileString("1 + 2"), env)
+	if !errors.As(err, &canceledErr) || !errors.Is(err, context.Canceled) || canceledErr.ExecutedInsts != 0 {
+		t.Errorf("Expected a CanceledError after 0 instructions, got %v", err)
+	}
+
+	// Cancellation is checked between instructions too, not just in function calls
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	env["cancel"] = vm.WrapFn("cancel", func() int {
+		cancel()
+		return 0
+	})
+	s := "cancel()" + strings.Repeat(" + a", 200)
+	_, err = m.EvalContext(ctx, compiler.CompileString(s), env)
+	if !errors.As(err, &canceledErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a CanceledError, got %v", err)
+	}
+	if canceledErr.ExecutedInsts >= 400 {
+		t.Errorf("Expected evaluation to stop early, but it ran %d instructions", canceledErr.ExecutedInsts)
+	}
+
+	// Without a deadline, EvalContext behaves like Eval
+	result, err := m.EvalContext(context.Background(), compiler.CompileString("a + 1"), env)
+	if err != nil || !runtime.Eq(result.Val, bytecode.BInt(44)) {
+		t.Errorf("Expected 44, got %v, %v", result.Val, err)
+	}
+	// The context doesn't count as an argument, and Eval passes in context.Background()
+	env["hasDeadline"] = vm.WrapFn("hasDeadline", func(ctx context.Context) bool {
+		_, ok := ctx.Deadline()
+		return ok
+	})
+	result, err = m.EvalString("hasDeadline()", env)
+	if err != nil || !runtime.Eq(result.Val, bytecode.BBool(false)) {
+		t.Errorf("Expected false, got %v, %v", result.Val, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	result, err = m.EvalContext(ctx, compiler.CompileString("hasDeadline()"), env)
+	if err != nil || !runtime.Eq(result.Val, bytecode.BBool(true)) {
+		t.Errorf("Expected true, got %v, %v", result.Val, err)
+	}
+}
+
+// Run with go test -race
+func TestProgramConcurrentEval(t *testing.T) {
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	m.RegisterMethod("int", "double", vm.Func1("double", func(x int) int { return 2 * x }))
+	shared := vm.CloneEnv(vmSeed)
+	shared["triple"] = vm.WrapFn("triple", func(x int) int { return 3 * x })
+	program, err := m.Compile("len(d + [x]) + x.double() + triple(x) + a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Programs don't see changes to the VM after they're compiled
+	m.RegisterMethod("int", "double", vm.Func1("double", func(x int) int { return 0 }))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				x := int64(g*1000 + i)
+				env := vm.ResolverFunc(func(name string) (bytecode.BVal, bool, error) {
+					if name == "x" {
+						return bytecode.BInt(x), true, nil
+					}
+					return shared.Resolve(name)
+				})
+				result, err := program.Eval(env)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				expected := bytecode.BInt(3 + 5*x + 43)
+				if !runtime.Eq(result.Val, expected) {
+					t.Errorf("Expected %s, got %s", expected, result.Val)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if _, err := m.Compile("1 +"); err == nil {
+		t.Error("Expected a compile error, got nil")
+	}
+}
+
+func TestPanicsBecomeErrors(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["boom"] = vm.WrapFn("boom", func(i int) int {
+		var arr []int
+		return arr[i]
+	})
+	m := vm.New(vm.Params{})
+	_, err := m.EvalString("1 + boom(3)", env)
+	var hostErr *vm.HostFunctionError
+	if !errors.As(err, &hostErr) {
+		t.Fatalf("Expected a HostFunctionError, got %v", err)
+	}
+	if hostErr.Fn != "boom" || hostErr.Pc == 0 || hostErr.Stack == "" {
+		t.Errorf("Missing details in %#v", hostErr)
+	}
+
+	// Bugs in the compiler or the VM are reported as internal errors
+	var internalErr *runtime.InternalError
+	compilation := compiler.Compile(nil, compiler.Params{})
+	if len(compilation.Errors) != 1 || !errors.As(compilation.Errors[0].Err, &internalErr) || internalErr.Pc != -1 {
+		t.Errorf("Expected an InternalError from the compiler, got %v", compilation.Errors)
+	}
+	// Adding with nothing on the stack
+	compilation = compiler.Compilation{}
+	compilation.Bytecode.Push(bytecode.Bytecode{Inst: bytecode.OpAdd})
+	_, err = m.Eval(compilation, env)
+	if !errors.As(err, &internalErr) || internalErr.Pc != 0 || internalErr.Stack == "" {
+		t.Errorf("Expected an InternalError from the VM, got %v", err)
+	}
+	// The VM can still be used afterwards
+	result, err := m.EvalString("a + 1", env)
+	if err != nil || result.Val != bytecode.BInt(44) {
+		t.Errorf("Expected 44, got %v, %v", result.Val, err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["fail"] = vm.WrapFn("fail", func() (int, error) { return 0, errors.New("no") })
+	m := vm.New(vm.Params{StdlibVersion: stdlib.Latest})
+	tests := []struct {
+		in    string
+		check func(err error) bool
+	}{
+		{"a + 'x'", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Op == "+" && e.Operands[0] == "int" && e.Operands[1] == "string"
+		}},
+		{"-e", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Op == "unary -"
+		}},
+		{"a < e", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Op == "<"
+		}},
+		{"a[0]", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Op == "[]" && len(e.Operands) == 1
+		}},
+		{"e(1)", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Op == "()"
+		}},
+		{"ba(1, 2)", func(err error) bool {
+			var e *runtime.TypeError
+			return errors.As(err, &e) && e.Reason != ""
+		}},
+		{"nope + 1", func(err error) bool {
+			var e *runtime.NameError
+			return errors.As(err, &e) && e.Name == "nope"
+		}},
+		{"fooObj.nope", func(err error) bool {
+			var e *runtime.AttributeError
+			return errors.As(err, &e) && e.Type == "object" && e.Name == "nope"
+		}},
+		{"d[5]", func(err error) bool {
+			var e *runtime.IndexError
+			return errors.As(err, &e) && e.Index == 5 && e.Len == 2
+		}},
+		{"a // (b - 2)", func(err error) bool {
+			var e *runtime.ArithmeticError
+			return errors.As(err, &e) && e.Op == "//" && errors.Is(err, runtime.ErrDivByZero)
+		}},
+		{"a * 9223372036854775807", func(err error) bool {
+			return errors.Is(err, runtime.ErrOverflow)
+		}},
+		{"fail()", func(err error) bool {
+			var e *runtime.HostError
+			return errors.As(err, &e) && e.Fn == "fail" && e.Err.Error() == "no"
+		}},
+	}
+	for _, tt := range tests {
+		_, err := m.EvalString(tt.in, env)
+		if !tt.check(err) {
+			t.Errorf("%s: unexpected error %#v", tt.in, err)
+		}
+	}
+}
+
+func TestErrorSpans(t *testing.T) {
+	m := vm.New(vm.Params{})
+	tests := []struct {
+		in     string
+		errMsg string
+	}{
+		{"a + 'x'", `TypeError: unsupported operand type(s) for +: int and string
+ | a + 'x'
+ | ^^^^^^^---`},
+		{"d[0] ** e", `TypeError: unsupported operand type(s) for **: int and string
+ | d[0] ** e
+ | ^^^^^^^^^---`},
+		{"1 + fooObj.nope", `AttributeError: object object has no attribute nope
+ | 1 + fooObj.nope
+ |     ^^^^^^^^^^^---`},
+		{"b * e(1)", `TypeError: string object is not callable
+ | b * e(1)
+ |     ^^^^---`},
+		// Only the line with the error is shown
+		{"a +\n  fooObj.nope", `AttributeError: object object has no attribute nope
+ |   fooObj.nope
+ |   ^^^^^^^^^^^---`},
+		{"d[5] + 1", `IndexError: array index 5 out of range (len 2)
+ | d[5] + 1
+ | ^^^^---`},
+		// Constant folding keeps the span of the nodes it replaces
+		{"(1 + 2) - e", `TypeError: unsupported operand type(s) for -: int and string
+ | (1 + 2) - e
+ |  ^^^^^^^^^^---`},
+	}
+	for _, tt := range tests {
+		_, err := m.EvalString(tt.in, vmSeed)
+		var evalErr *vm.EvalError
+		if !errors.As(err, &evalErr) {
+			t.Fatalf("%s: expected an EvalError, got %v", tt.in, err)
+		}
+		if err.Error() != tt.errMsg {
+			t.Errorf("%s: expected error\n%s\ngot\n%s", tt.in, tt.errMsg, err)
+		}
+	}
+
+	// Programs keep their source too
+	program, err := m.Compile("a - e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = program.Eval(vmSeed)
+	if err == nil || !strings.Contains(err.Error(), " | a - e\n | ^^^^^---") {
+		t.Errorf("Expected the error to point at a - e, got %v", err)
+	}
+}
+
+func TestTypeCheckedExpressionsRun(t *testing.T) {
+	schema := compiler.Schema{
+		"radius": types.Int,
+		"scale":  types.Float,
+		"name":   types.String,
+		"tags":   types.Array{Elem: types.String},
+		"user":   types.Object{"name": types.String, "age": types.Int, "greet": types.Func(types.String, types.String)},
+		"area":   types.Func(types.Float, types.Float),
+		"concat": types.VariadicFunc(types.String, types.String),
+		"host":   types.Any,
+	}.WithBuiltins(stdlib.V1)
+	env := vm.VMEnv{
+		"radius": bytecode.BInt(2),
+		"scale":  bytecode.BFloat(1.5),
+		"name":   bytecode.BStr("circle"),
+		"tags":   bytecode.BArray{bytecode.BStr("a"), bytecode.BStr("b")},
+		"user": bytecode.BObj{
+			"name":  bytecode.BStr("Ann"),
+			"age":   bytecode.BInt(30),
+			"greet": vm.WrapFn("greet", func(s string) string { return "hi " + s }),
+		},
+		"area":   vm.WrapFn("area", func(r float64) float64 { return 3 * r * r }),
+		"concat": vm.WrapFn("concat", func(xs ...string) string { return strings.Join(xs, "") }),
+		"host": bytecode.BObj{
+			"anything": vm.WrapFn("anything", func(a, b int) int { return a + b }),
+		},
+	}
+	valid := []string{
+		"radius * 2 + scale",
+		"area(radius) > 10 and name == 'circle'",
+		"tags[0] + user.name",
+		"user.greet(name).upper()",
+		"concat() + concat('a', 'b', 'c')",
+		"'%s is %d' % [user.name, user.age]",
+		"radius > 1 ? 'big' : 'small'",
+		"len(tags) + host.anything(1, 2)",
+		"json.stringify(tags)",
+		"[1, 2] * radius + [3]",
+		"-true + +radius",
+		"name * true + (tags * (radius > 1))[0]",
+		"user.describe() + user.name",
+	}
+	// The type checker and the runtime must agree on what's valid
+	describe := vm.WrapFn("describe", func(obj bytecode.BObj) string { return fmt.Sprint(len(obj), " fields") })
+	methods := map[string]map[string]bytecode.BFunc{"object": {"describe": describe}}
+	m := vm.New(vm.Params{StdlibVersion: stdlib.V1})
+	m.RegisterMethod("object", "describe", describe)
+	for _, in := range valid {
+		compilation := compiler.CompileStringParams(in, compiler.Params{Schema: schema, Methods: methods})
+		if len(compilation.Errors) > 0 {
+			t.Errorf("%s: unexpected errors %v", in, compilation.Errors)
+			continue
+		}
+		if _, err := m.Eval(compilation, env); err != nil {
+			t.Errorf("%s: type checked, but failed at runtime: %v", in, err)
+		}
+	}
+}
+
+func TestEvalStringDiagnostics(t *testing.T) {
+	m := vm.New(vm.Params{})
+	src := "1 // 0 +\n  -'a'"
+	_, err := m.EvalString(src, vmSeed)
+	var diagnostics *compiler.Diagnostics
+	expected := compiler.FormatDiagnostics(src, compiler.CompileString(src).Errors)
+	if !errors.As(err, &diagnostics) || len(diagnostics.Errs) != 2 || err.Error() != strings.TrimSuffix(expected, "\n") {
+		t.Errorf("Expected EvalString to return the diagnostics, got %v", err)
+	}
+	// The first error can still be matched
+	if !errors.Is(err, runtime.ErrDivByZero) {
+		t.Errorf("Expected a division by zero, got %v", err)
+	}
+
+	_, err = m.EvalString("[1 +, 2 *]", vmSeed)
+	if err == nil || strings.Count(err.Error(), "Infix operator must have an expression in RHS") != 2 {
+		t.Errorf("Expected both syntax errors, got %v", err)
+	}
+}
+
+func TestBudgetExceeded(t *testing.T) {
+	compilation := compiler.CompileString("a" + strings.Repeat(" + a", 50))
+	m := vm.New(vm.Params{MaxInstructions: 10})
+	_, err := m.Eval(compilation, vmSeed)
+	if !errors.Is(err, vm.ErrBudgetExceeded) {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+	var budgetErr *vm.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("Expected a BudgetExceededError, got %v", err)
+	}
+	if budgetErr.Limit != 10 || budgetErr.ExecutedInsts != 10 || budgetErr.Pc != 10 {
+		t.Errorf("Expected to stop at pc 10 after 10 instructions, got %+v", budgetErr)
+	}
+
+	// Using up the budget exactly is fine
+	numInsts := compilation.Bytecode.Len()
+	m = vm.New(vm.Params{MaxInstructions: numInsts})
+	result, err := m.Eval(compilation, vmSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !runtime.Eq(result.Val, bytecode.BInt(43*51)) {
+		t.Errorf("Expected %d, got %s", 43*51, result.Val)
+	}
+	if result.ExecutedInsts != numInsts {
+		t.Errorf("Expected %d instructions to be executed, got %d", numInsts, result.ExecutedInsts)
+	}
+}
+
+func TestResultReportsUsage(t *testing.T) {
+	m := vm.New(vm.Params{})
+	tests := []struct {
+		in            string
+		executedInsts int
+		memoryUsed    int
+	}{
+		{"1", 1, 0},
+		{"a + 1", 2, 0},
+		// A new array of 3 values
+		{"[1, 2, a]", 4, 16 + 24 + 3*16},
+		// fooObj, with its 2 entries. The float returned by baz is a scalar, which costs nothing
+		{"fooObj.baz(1)", 5, 16 + 48 + (16 + 3 + 16) + (16 + 3 + 64)},
+		{"fizz + 'buzz'", 2, 16 + 16 + 4 + 16 + 16 + 8},
+	}
+	for _, tt := range tests {
+		result, err := m.EvalString(tt.in, vmSeed)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if result.ExecutedInsts != tt.executedInsts || result.MemoryUsed != tt.memoryUsed {
+			t.Errorf("%s: expected %d instructions and %d memory, got %d and %d", tt.in, tt.executedInsts, tt.memoryUsed, result.ExecutedInsts, result.MemoryUsed)
+		}
+	}
+}
+
+func TestMaxMemoryBytes(t *testing.T) {
+	env := vm.CloneEnv(vmSeed)
+	env["big"] = bytecode.BStr(strings.Repeat("x", 100000))
+	env["id"] = vm.WrapFn("id", func(x bytecode.BVal) bytecode.BVal { return x })
+	env["pair"] = vm.WrapFn("pair", func(x bytecode.BVal) bytecode.BVal { return bytecode.BArray{x, x} })
+	env["nested"] = bytecode.BArray{bytecode.BArray{env["big"]}}
+	env["first"] = vm.WrapFn("first", func(x bytecode.BArray) bytecode.BVal { return x[0] })
+	env["dig"] = vm.WrapFn("dig", func(x bytecode.BArray) bytecode.BVal { return x[0].(bytecode.BArray)[0] })
+	tests := []struct {
+		in       string
+		maxBytes int
+		oom      bool
+	}{
+		// Both halves and the result are counted, since none of them are freed during the evaluation
+		{"'x' * 1000000 + 'x' * 1000000", 4100000, false},
+		{"'x' * 1000000 + 'x' * 1000000", 3000000, true},
+		{"'x' * 1000000 + 'x' * 1000000", 1000000, true},
+		{"[1] * 100000", 16 * 100000, true},
+		{"[1] * 1000 + [1] * 1000", 16 * 4100, false},
+		{"[1] * 1000 + [1] * 1000", 16 * 3000, true},
+		{"'%s!' % big", 300000, false},
+		{"'%s!' % big", 150000, true},
+		// Env values are only charged once, no matter how often they're used
+		{"big", 100100, false},
+		{"big", 90000, true},
+		{"len(big) + len(big) + len(big)", 100100, false},
+		// Functions are only charged for what they allocate, not for values they return as is
+		{"len(id(big) + '') + len(id(id(big)))", 210000, false},
+		{"len(pair(big) + pair(big))", 100300, false},
+		{"len(id(big) + big)", 210000, true},
+		{"len(first(nested)) + len(first(first(nested)))", 110000, false},
+		// Only values directly in the args are known to be shared, so big is charged again
+		{"len(dig(nested))", 210000, false},
+		{"len(dig(nested))", 150000, true},
+		{"json.stringify(d)", 200, false},
+		{"json.stringify(d) * 10", 200, true},
+	}
+	for _, tt := range tests {
+		m := vm.New(vm.Params{StdlibVersion: stdlib.Latest, MaxMemoryBytes: tt.maxBytes, MaxInstructions: 100})
+		_, err := m.EvalString(tt.in, env)
+		if tt.oom && !errors.Is(err, runtime.ErrOOM) {
+			t.Errorf("%s with %d bytes: expected to run out of memory, got %v", tt.in, tt.maxBytes, err)
+		}
+		if !tt.oom && err != nil {
+			t.Errorf("%s with %d bytes: %s", tt.in, tt.maxBytes, err)
+		}
+	}
+}
+
 func TestFizzBuzz(t *testing.T) {
 	env := vm.CloneEnv(vmSeed)
 	m := vm.New(vm.Params{})
@@ -430,6 +1453,36 @@ func BenchmarkCollatzRegular(b *testing.B) {
 	}
 }
 
+// Compares the cost of calling host functions wrapped with reflection against the generic adapters
+func BenchmarkCollatzWrapFn(b *testing.B) {
+	benchmarkHostCollatz(b, vm.WrapFn("collatz", collatz))
+}
+
+func BenchmarkCollatzFunc1(b *testing.B) {
+	benchmarkHostCollatz(b, vm.Func1("collatz", collatz))
+}
+
+func benchmarkHostCollatz(b *testing.B, fn bytecode.BFunc) {
+	m := vm.New(vm.Params{})
+	env := vm.CloneEnv(vmSeed)
+	env["collatz"] = fn
+	compilation := compiler.CompileString("collatz(i)")
+	if len(compilation.Errors) > 0 {
+		b.Fatal("Found compile errors")
+	}
+	b.ReportAllocs()
+	for numRuns := 0; numRuns < b.N; numRuns++ {
+		for i := 100000; i > 1; {
+			env["i"] = bytecode.BInt(int64(i))
+			result, err := m.Eval(compilation, env)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i = int(result.Val.(bytecode.BInt))
+		}
+	}
+}
+
 func fizzBuzz(i int) string {
 	if i%3 == 0 {
 		if i%5 == 0 {
@@ -525,6 +1578,45 @@ func FuzzVM(f *testing.F) {
 	})
 }
 
+// Compiling and evaluating should never panic, even when host functions do. The compiler and VM recover from
+// their own panics, so bugs show up as a *runtime.InternalError instead
+func FuzzNoPanics(f *testing.F) {
+	env := vm.CloneEnv(vmSeed)
+	env["boom"] = vm.WrapFn("boom", func(x bytecode.BVal) bytecode.BVal {
+		panic(fmt.Sprintf("boom %s", x))
+	})
+	for _, tc := range append(validStrings, invalidStrings...) {
+		f.Add(tc)
+	}
+	f.Add("boom(1)")
+	f.Add("[boom, 1][a % 2]('x')")
+	m := vm.New(testingVMParams)
+	f.Fuzz(func(t *testing.T, s string) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("%q panicked: %v", s, r)
+			}
+		}()
+		checkCompilation := func(c compiler.Compilation) {
+			for _, err := range c.Errors {
+				if err.Code == compiler.CodeInternal {
+					t.Fatalf("%q failed to compile with an internal error: %v", s, err.Err)
+				}
+			}
+		}
+		// Including partial trees from expressions with syntax errors
+		if expr, _ := parser.ParseString(s); expr != nil {
+			checkCompilation(compiler.Compile(expr, compiler.Params{}))
+		}
+		checkCompilation(compiler.CompileString(s))
+		_, err := m.EvalString(s, env)
+		var internalErr *runtime.InternalError
+		if errors.As(err, &internalErr) {
+			t.Fatalf("%q failed with an internal error: %v\n%s", s, err, internalErr.Stack)
+		}
+	})
+}
+
 func FuzzVMRandAST(f *testing.F) {
 	maxDepth := 20
 	vm := vm.New(testingVMParams)
@@ -1,24 +1,78 @@
 package vm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	. "github.com/thomastay/expression_language/pkg/bytecode"
+	"github.com/thomastay/expression_language/pkg/runtime"
 )
 
 var ErrInvalidNumParams = errors.New("Invalid number of arguments provided")
 
 var bValType = reflect.TypeOf((*BVal)(nil)).Elem()
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Returned by functions wrapped with WrapFn when an argument can't be converted to the Go parameter type.
+// Check for it with errors.As. It is also a *runtime.TypeError, like the type errors of builtin functions
+type ArgTypeError struct {
+	Fn string
+	// 0 based index of the argument
+	Index int
+	Err   *ConversionError
+}
+
+func (e *ArgTypeError) Error() string {
+	if e.Err.Path == "" && e.Err.Reason == "" {
+		return fmt.Sprintf("TypeError: %s() argument %d must be %s, not %s", e.Fn, e.Index, e.Err.To, e.Err.From)
+	}
+	msg := fmt.Sprintf("TypeError: %s() argument %d: cannot convert %s to %s", e.Fn, e.Index, e.Err.From, e.Err.To)
+	if e.Err.Path != "" {
+		msg += " at " + e.Err.Path
+	}
+	if e.Err.Reason != "" {
+		msg += ": " + e.Err.Reason
+	}
+	return msg
+}
+
+func (e *ArgTypeError) Unwrap() error {
+	return e.Err
+}
+
+// Lets errors.As convert the error to a *runtime.TypeError
+func (e *ArgTypeError) As(target any) bool {
+	typeErr, ok := target.(**runtime.TypeError)
+	if !ok {
+		return false
+	}
+	*typeErr = &runtime.TypeError{Op: "()", Reason: strings.TrimPrefix(e.Error(), "TypeError: ")}
+	return true
+}
 
 // Wrap a function and its name
-// A function must have the following return types. Any number of parameters accepted, but no variadics for now.
+// A function must have one of the following return types, where T is any type that bytecode.FromGo can convert.
+//
+//	func (...)
+//	func (...) T
+//	func (...) (T, error)
 //
-//	func (a bytecode.BVal)
-//	func (a bytecode.BVal) bytecode.BVal
-//	func (a bytecode.BVal) (bytecode.BVal, error)
+// Parameters can be BVals, or any type that bytecode.ToGo can convert to, e.g.
+//
+//	func (x int, name string, scale float64) (float64, error)
+//
+// Arguments are converted when the function is called. Ints are passed to float parameters if they fit exactly,
+// and arguments that can't be converted are reported as an *ArgTypeError instead of a panic.
+// Variadic functions like func (xs ...int) int are supported too.
+//
+// If the first parameter is a context.Context, it isn't counted as an argument. Instead, it is passed the
+// context given to EvalContext, or context.Background() when called through Eval.
+//
+// WrapFn panics if the function's signature can never be converted, e.g. if it takes in a channel.
 func WrapFn(name string, ff any) BFunc {
 	fn := reflect.ValueOf(ff)
 	fnType := fn.Type()
@@ -29,18 +83,29 @@ func WrapFn(name string, ff any) BFunc {
 		panic("Functions should only have 0, 1, or 2 return values")
 	}
 
-	numIn := fnType.NumIn()
+	// Functions can take in the context passed to EvalContext as their first parameter
+	takesContext := fnType.NumIn() > 0 && fnType.In(0) == contextType
+	firstParam := 0
+	if takesContext {
+		firstParam = 1
+	}
+	numIn := fnType.NumIn() - firstParam
+	paramTypes := make([]reflect.Type, numIn)
 	for i := 0; i < numIn; i++ {
-		t := fnType.In(i)
-		if !t.Implements(bValType) {
-			panic("Function param does not implement BVal")
+		t := fnType.In(firstParam + i)
+		if fnType.IsVariadic() && i == numIn-1 {
+			t = t.Elem()
+		}
+		if !isConvertible(t) {
+			panic(fmt.Sprintf("Function param %d has type %s, which cannot be converted from a BVal", i, t))
 		}
+		paramTypes[i] = t
 	}
 	numOut := fnType.NumOut()
 	if numOut > 0 {
 		t := fnType.Out(0)
-		if !t.Implements(bValType) {
-			panic("Function return value 1 does not implement BVal")
+		if !isConvertible(t) {
+			panic(fmt.Sprintf("Function return value 1 has type %s, which cannot be converted to a BVal", t))
 		}
 	}
 	if numOut > 1 {
@@ -49,33 +114,79 @@ func WrapFn(name string, ff any) BFunc {
 			panic("Function return value 2 does not implement Error")
 		}
 	}
-	var err error
-	f := func(args []BVal) (BVal, error) {
-		reflectArgs := make([]reflect.Value, len(args))
+	numArgs := numIn
+	if fnType.IsVariadic() {
+		numArgs--
+	}
+	f := func(ctx context.Context, args []BVal) (BVal, error) {
+		reflectArgs := make([]reflect.Value, firstParam+len(args))
+		if takesContext {
+			reflectArgs[0] = reflect.ValueOf(&ctx).Elem()
+		}
 		for i, arg := range args {
-			reflectArgs[i] = reflect.ValueOf(arg)
+			t := paramTypes[numIn-1]
+			if i < numIn {
+				t = paramTypes[i]
+			}
+			v := reflect.New(t)
+			if err := ToGo(arg, v.Interface()); err != nil {
+				var convErr *ConversionError
+				if errors.As(err, &convErr) {
+					return nil, &ArgTypeError{Fn: name, Index: i, Err: convErr}
+				}
+				return nil, err
+			}
+			reflectArgs[firstParam+i] = v.Elem()
 		}
 		reflectVals := fn.Call(reflectArgs)
 		switch len(reflectVals) {
 		case 0:
 			return BNull{}, nil
 		case 1:
-			return toBVal(reflectVals[0]), nil
+			return toBVal(name, reflectVals[0])
 		case 2:
-			err, _ = reflectVals[1].Interface().(error)
-			return toBVal(reflectVals[0]), err
+			if err, _ := reflectVals[1].Interface().(error); err != nil {
+				return nil, err
+			}
+			return toBVal(name, reflectVals[0])
 		default:
 			panic("Should not reach this point, wrong number of returns")
 		}
 	}
-	return BFunc{Fn: f, NumArgs: fnType.NumIn(), Name: name}
+	bFn := BFunc{
+		Fn: func(args []BVal) (BVal, error) {
+			return f(context.Background(), args)
+		},
+		NumArgs:  numArgs,
+		Name:     name,
+		Variadic: fnType.IsVariadic(),
+	}
+	if takesContext {
+		bFn.FnContext = f
+	}
+	return bFn
 }
 
-func toBVal(val reflect.Value) BVal {
-	if val.IsNil() {
-		return BNull{}
+func toBVal(name string, val reflect.Value) (BVal, error) {
+	return resultToBVal(name, val.Interface())
+}
+
+// Whether values of type t could be converted by bytecode.ToGo and bytecode.FromGo.
+// This only rules out types that can never be converted, conversions can still fail at runtime
+func isConvertible(t reflect.Type) bool {
+	if t.Implements(bValType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return false
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return isConvertible(t.Elem())
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && isConvertible(t.Elem())
+	default:
+		return true
 	}
-	return val.Interface().(BVal)
 }
 
 // Clones an env